@@ -1,22 +1,67 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
+	"flag"
+	"fmt"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
+	"opencatd-open/pkg/config"
+	"opencatd-open/pkg/logger"
+	"opencatd-open/pkg/metrics"
+	"opencatd-open/pkg/secret"
+	"opencatd-open/pkg/tracing"
 	"opencatd-open/router"
 	"opencatd-open/store"
 	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
 	"gorm.io/gorm"
 )
 
 //go:embed dist/*
 var web embed.FS
 
+// 由 makefile 通过 -ldflags -X 注入
+var (
+	Version        string
+	GitCommitLog   string
+	BuildTime      string
+	BuildGoVersion string
+)
+
+func buildInfo() router.BuildInfo {
+	version := Version
+	if version == "" {
+		version = "dev"
+	}
+	goVersion := BuildGoVersion
+	if goVersion == "" {
+		goVersion = runtime.Version()
+	}
+	return router.BuildInfo{
+		Version:        version,
+		GitCommit:      GitCommitLog,
+		BuildTime:      BuildTime,
+		BuildGoVersion: goVersion,
+	}
+}
+
 func getFileSystem(path string) http.FileSystem {
 	fs, err := fs.Sub(web, path)
 	if err != nil {
@@ -26,13 +71,52 @@ func getFileSystem(path string) http.FileSystem {
 	return http.FS(fs)
 }
 
+// loadConfig 读取配置文件与环境变量, 不合法时退出
+func loadConfig() *config.Config {
+	cfg, err := config.Load(config.Path())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return cfg
+}
+
+func storeConfig(cfg *config.Config) store.Config {
+	return store.Config{
+		Driver:         cfg.Database.Driver,
+		DSN:            cfg.Database.DSN,
+		UsageDSN:       cfg.Database.UsageDSN,
+		MasterKeyFile:  "./db/master.key",
+		SkipMigrations: !cfg.Database.AutoMigrate,
+	}
+}
+
+func retentionPolicy(cfg *config.Config) store.RetentionPolicy {
+	return store.RetentionPolicy{
+		Days:       cfg.Retention.Days,
+		ArchiveDir: cfg.Retention.ArchiveDir,
+		Interval:   cfg.Retention.Interval.Std(),
+	}
+}
+
+// openStore 按配置打开数据库, 失败时退出
+func openStore(cfg *config.Config) *store.Store {
+	st, err := store.Open(storeConfig(cfg))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return st
+}
+
 func main() {
 	args := os.Args[1:]
 	if len(args) > 0 {
 		switch args[0] {
 		case "reset_root":
+			st := openStore(loadConfig())
+			defer st.Close()
 			log.Println("reset root token...")
-			if _, err := store.GetUserByID(uint(1)); err != nil {
+			root, err := st.GetOwner(context.Background())
+			if err != nil {
 				if err == gorm.ErrRecordNotFound {
 					log.Println("请在opencat(或其他APP)客户端完成team初始化")
 					return
@@ -42,83 +126,412 @@ func main() {
 				}
 			}
 			ntoken := uuid.NewString()
-			if err := store.UpdateUser(uint(1), ntoken); err != nil {
+			if err := st.UpdateUser(context.Background(), root.ID, ntoken); err != nil {
 				log.Fatalln(err)
 				return
 			}
-			log.Println("new root token:", ntoken)
+			cliAudit(st, router.AuditUserResetToken, "user", root.ID, nil, nil)
+			log.Println("new root token for", root.Name+":", ntoken)
 			return
 		case "root_token":
-			log.Println("reset root token...")
-			if user, err := store.GetUserByID(uint(1)); err != nil {
+			st := openStore(loadConfig())
+			defer st.Close()
+			if user, err := st.GetOwner(context.Background()); err != nil {
 				log.Fatalln(err)
 				return
 			} else {
-				log.Println("root token:", user.Token)
+				log.Println("root token prefix for", user.Name+":", user.TokenPrefix)
+				log.Println("token 仅以哈希保存, 无法再次查看; 如已遗失请使用 reset_root 重置")
 				return
 			}
+		case "config":
+			runConfig(args[1:])
+			return
+		case "migrate":
+			runMigrate(args[1:])
+			return
+		case "backup":
+			if len(args) < 2 {
+				log.Fatalln("usage: opencatd backup <path>")
+			}
+			st := openStore(loadConfig())
+			defer st.Close()
+			if err := backup(st, args[1]); err != nil {
+				log.Fatalln(err)
+			}
+			log.Println("backup written to", args[1])
+			return
+		case "restore":
+			if len(args) < 2 {
+				log.Fatalln("usage: opencatd restore <path>")
+			}
+			restore(args[1])
+			return
+		case "prune":
+			runPrune(args[1:])
+			return
+		case "rotate_master_key":
+			st := openStore(loadConfig())
+			defer st.Close()
+			rotateMasterKey(st)
+			return
+		case "version":
+			info := buildInfo()
+			fmt.Printf("opencatd %s\ncommit: %s\nbuilt: %s\ngo: %s\n", info.Version, info.GitCommit, info.BuildTime, info.BuildGoVersion)
+			return
 		default:
 			return
 		}
 
 	}
-	port := os.Getenv("PORT")
-	r := gin.Default()
-	group := r.Group("/1")
-	{
-		group.Use(router.AuthMiddleware())
+	cfgPath := config.Path()
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logger.Init(cfg.Logging.Level, cfg.Logging.Format)
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer shutdownTracing(context.Background())
+	ssoClient, err := router.SSOFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	st := openStore(cfg)
+	// 关闭自动迁移时, 未执行的迁移会让旧数据无法认证或解密, 拒绝启动
+	if err := st.RequireMigrated(); err != nil {
+		log.Fatalln(err)
+	}
+	reg := metrics.NewRegistry()
+	h := router.New(st, cfg, router.Options{Registerer: reg, SSO: ssoClient})
 
-		// 获取当前用户信息
-		group.GET("/me", router.HandleMe)
+	r := gin.New()
+	// 默认不信任任何代理, 避免客户端伪造 X-Forwarded-For 写入审计日志与请求日志
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalln(err)
+	}
+	r.Use(router.RequestLogger(), gin.Recovery())
+	h.Register(r)
 
-		group.GET("/me/usages", router.HandleMeUsage)
+	if cfg.Features.Metrics {
+		r.GET("/metrics", h.MetricsAuthMiddleware(), gin.WrapH(metrics.Handler(reg)))
+	}
 
-		// 获取所有Key
-		group.GET("/keys", router.HandleKeys)
+	r.GET("/version", router.HandleVersion(buildInfo()))
 
-		// 获取所有用户信息
-		group.GET("/users", router.HandleUsers)
+	// r.POST("/v1/chat/completions", h.HandleProy)
+	// r.GET("/v1/models", h.HandleProy)
+	// r.GET("/v1/dashboard/billing/subscription", h.HandleProy)
+
+	// r.Use(static.Serve("/", static.LocalFile("dist", false)))
+	if cfg.Features.WebUI {
+		idxFS, err := fs.Sub(web, "dist")
+		if err != nil {
+			panic(err)
+		}
+		r.GET("/", gin.WrapH(http.FileServer(http.FS(idxFS))))
+		assetsFS, err := fs.Sub(web, "dist/assets")
+		if err != nil {
+			panic(err)
+		}
+		r.GET("/assets/*filepath", gin.WrapH(http.StripPrefix("/assets/", http.FileServer(http.FS(assetsFS)))))
+	}
+	srv := &http.Server{Addr: cfg.Listen, Handler: r}
+	go func() {
+		slog.Info("listening", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalln(err)
+		}
+	}()
 
-		group.GET("/usages", router.HandleUsage)
+	retentionCtx, stopRetention := context.WithCancel(context.Background())
+	retentionDone := make(chan struct{})
+	go func() {
+		defer close(retentionDone)
+		st.RunRetention(retentionCtx, retentionPolicy(cfg))
+	}()
 
-		// 添加Key
-		group.POST("/keys", router.HandleAddKey)
+	// SIGHUP 或配置文件变化时重载配置
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-reloadCtx.Done():
+				return
+			case <-hup:
+				reloadConfig(h, "sighup")
+			}
+		}
+	}()
+	if cfgPath != "" {
+		go config.Watch(reloadCtx, cfgPath, configWatchInterval, func() {
+			reloadConfig(h, "file changed")
+		})
+	}
 
-		// 删除Key
-		group.DELETE("/keys/:id", router.HandleDelKey)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	stopReload()
+	// 中断进行中的清理 (事务回滚, 下次重跑), 之后再关闭数据库
+	stopRetention()
+	<-retentionDone
+	gracefulShutdown(srv, h, st, sig, h.Config().ShutdownTimeout.Std())
+}
 
-		// 添加用户
-		group.POST("/users", router.HandleAddUser)
+const configWatchInterval = 5 * time.Second
 
-		// 删除用户
-		group.DELETE("/users/:id", router.HandleDelUser)
+var reloadMu sync.Mutex
 
-		// 重置用户Token
-		group.POST("/users/:id/reset", router.HandleResetUserToken)
+// reloadConfig 重新查找并读取配置, 替换到 h 并记录变化的字段; 配置不合法时保留当前配置
+func reloadConfig(h *router.Handler, reason string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	next, err := config.Load(config.Path())
+	if err != nil {
+		slog.Error("reload config failed, keeping current config", "reason", reason, "err", err)
+		return
+	}
+	changes := config.Diff(h.Config(), next)
+	if len(changes) == 0 {
+		slog.Info("config reloaded, nothing changed", "reason", reason)
+		return
+	}
+	for _, c := range changes {
+		if c.Restart {
+			slog.Warn("config changed, takes effect after restart", "field", c.Field, "old", c.Old, "new", c.New)
+		} else {
+			slog.Info("config changed", "field", c.Field, "old", c.Old, "new", c.New)
+		}
 	}
+	logger.Init(next.Logging.Level, next.Logging.Format)
+	h.Reload(next)
+	slog.Info("config reloaded", "reason", reason, "changes", len(changes))
+}
 
-	// 初始化用户
-	r.POST("/1/users/init", router.Handleinit)
+// runConfig 执行 config check [path], 校验配置并打印生效的配置 (隐藏连接串与 token)
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		log.Fatalln("usage: opencatd config check [path]")
+	}
+	path := config.Path()
+	if len(args) > 1 {
+		path = args[1]
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if path == "" {
+		path = "(defaults and environment only)"
+	}
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("# %s: ok\n%s", path, out)
+}
 
-	r.Any("/v1/*proxypath", router.HandleProy)
+// runMigrate 执行 migrate up|down [n]|status, down 默认回滚最近一个迁移
+func runMigrate(args []string) {
+	cfg := storeConfig(loadConfig())
+	cfg.SkipMigrations = true
+	st, err := store.Open(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer st.Close()
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up":
+		done, err := st.MigrateUp()
+		for _, m := range done {
+			log.Printf("applied %d %s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(done) == 0 {
+			log.Println("no pending migrations")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				log.Fatalln("usage: opencatd migrate down [n]")
+			}
+		}
+		done, err := st.MigrateDown(steps)
+		for _, m := range done {
+			log.Printf("reverted %d %s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case "status":
+		status, err := st.MigrationStatus()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-32s  %s\n", m.Version, m.Name, applied)
+		}
+	default:
+		log.Fatalln("usage: opencatd migrate up|down [n]|status")
+	}
+}
 
-	// r.POST("/v1/chat/completions", router.HandleProy)
-	// r.GET("/v1/models", router.HandleProy)
-	// r.GET("/v1/dashboard/billing/subscription", router.HandleProy)
+// runPrune 按保留策略立即清理一次原始用量, 参数默认取自环境变量
+func runPrune(args []string) {
+	cfg := loadConfig()
+	policy := retentionPolicy(cfg)
+	fset := flag.NewFlagSet("prune", flag.ExitOnError)
+	fset.IntVar(&policy.Days, "days", policy.Days, "keep raw usage rows for this many days")
+	fset.StringVar(&policy.ArchiveDir, "archive", policy.ArchiveDir, "archive pruned rows to this directory instead of only deleting them")
+	dryRun := fset.Bool("dry-run", false, "report what would be pruned without changing anything")
+	fset.Parse(args)
+	if policy.Days < 1 {
+		log.Fatalln("usage: opencatd prune [-dry-run] [-days n] [-archive dir] (or set retention.days)")
+	}
+	st := openStore(cfg)
+	defer st.Close()
+	res, err := st.PruneUsage(context.Background(), policy, *dryRun)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	verb := "pruned"
+	if *dryRun {
+		verb = "would prune"
+	}
+	log.Printf("%s %d rows over %d days, %d daily rollups repaired", verb, res.Rows, res.Days, res.Repaired)
+	for _, f := range res.Files {
+		log.Println("archive:", f)
+	}
+}
 
-	// r.Use(static.Serve("/", static.LocalFile("dist", false)))
-	idxFS, err := fs.Sub(web, "dist")
+// backup 先写入同目录的临时文件, 完成后再改名, 避免留下不完整的备份
+func backup(st *store.Store, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = st.Backup(context.Background(), f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	r.GET("/", gin.WrapH(http.FileServer(http.FS(idxFS))))
-	assetsFS, err := fs.Sub(web, "dist/assets")
 	if err != nil {
-		panic(err)
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// restore 需在服务停止时执行; 恢复后上游 Key 只能用备份时的主密钥解密
+func restore(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	cfg := loadConfig()
+	m, err := store.Restore(storeConfig(cfg), f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// 审计记录写入恢复后的库
+	st := openStore(cfg)
+	defer st.Close()
+	cliAudit(st, router.AuditBackupRestore, "backup", 0, nil, map[string]interface{}{
+		"path": path, "backupCreatedAt": m.CreatedAt, "masterKeyVersion": m.MasterKeyVersion,
+	})
+	log.Printf("restored backup created at %s, previous files kept as *.bak", m.CreatedAt.Format(time.RFC3339))
+	log.Printf("upstream keys are encrypted with master key version %d, make sure it is configured", m.MasterKeyVersion)
+}
+
+// rotateMasterKey 把所有 Key 重新包裹到新主密钥下.
+// 主密钥来自文件时使用 OPENCATD_NEW_MASTER_KEY (未设置则随机生成), 先写入文件再重新包裹, 运行中的服务自动读取新文件;
+// 主密钥来自环境变量时需先把新主密钥设为 OPENCATD_MASTER_KEY、旧主密钥放入 OPENCATD_MASTER_KEY_PREVIOUS 并重启,
+// 再执行本命令把旧数据重新包裹到当前主密钥下
+func rotateMasterKey(st *store.Store) {
+	current := st.ActiveMasterKey()
+	next := current
+	if st.KeyringFile() != "" {
+		next = secret.GenerateMasterKey(current.Version + 1)
+		if v := os.Getenv("OPENCATD_NEW_MASTER_KEY"); v != "" {
+			mk, err := secret.ParseMasterKey(v)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if !strings.Contains(v, ":") {
+				mk.Version = current.Version + 1
+			}
+			next = mk
+		}
+		if next.Version == current.Version {
+			log.Fatalln("new master key must use a different version than", current.Version)
+		}
+	} else if os.Getenv("OPENCATD_NEW_MASTER_KEY") != "" {
+		log.Fatalln(store.ErrMasterKeyFromEnv)
+	}
+	n, err := st.RotateMasterKey(context.Background(), next)
+	if err != nil {
+		log.Fatalln("rotate master key:", err)
+	}
+	log.Printf("re-encrypted %d keys with master key v%d", n, next.Version)
+	cliAudit(st, router.AuditMasterKeyRotate, "master_key", 0,
+		map[string]interface{}{"version": current.Version},
+		map[string]interface{}{"version": next.Version, "keys": n})
+	if file := st.KeyringFile(); file != "" {
+		log.Printf("new master key written to %s, running servers pick it up automatically", file)
+		return
+	}
+	log.Printf("all keys now use master key v%d, remove the old keys from OPENCATD_MASTER_KEY_PREVIOUS", next.Version)
+}
+
+// cliAudit 记录命令行执行的管理操作, 操作者记为 cli 与系统用户名; 写入失败只打印日志
+func cliAudit(st *store.Store, action, targetType string, targetID uint, before, after interface{}) {
+	actor := "cli"
+	if u, err := user.Current(); err == nil {
+		actor += ":" + u.Username
+	}
+	e := &store.AuditEvent{Action: action, TargetType: targetType, TargetID: targetID, ActorName: actor}
+	if err := st.RecordAudit(context.Background(), e, store.Diff(before, after)); err != nil {
+		log.Println("record audit event:", err)
+	}
+}
+
+// gracefulShutdown 停止接收新连接, 在 SHUTDOWN_TIMEOUT (默认 30s) 内等待进行中的流结束,
+// 随后等待用量写入完成并关闭数据库
+func gracefulShutdown(srv *http.Server, h *router.Handler, st *store.Store, sig os.Signal, timeout time.Duration) {
+	slog.Info("shutting down", "signal", sig.String(), "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("in-flight requests did not finish in time, closing connections", "err", err)
+		srv.Close()
+	}
+
+	// 强制断开的流仍会记录已产生的用量, 这里再给写库留一点时间
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := h.WaitInflight(flushCtx); err != nil {
+		slog.Error("pending usage writes not flushed", "err", err)
 	}
-	r.GET("/assets/*filepath", gin.WrapH(http.StripPrefix("/assets/", http.FileServer(http.FS(assetsFS)))))
-	if port == "" {
-		port = "80"
+	if err := st.Close(); err != nil {
+		slog.Error("close database", "err", err)
 	}
-	r.Run(":" + port)
+	slog.Info("shutdown complete")
 }
@@ -18,7 +18,10 @@ curl $AZURE_OPENAI_ENDPOINT/openai/deployments/gpt-35-turbo/chat/completions?api
 package azureopenai
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strings"
@@ -47,15 +50,27 @@ type ModelsList struct {
 }
 
 func Models(endpoint, apikey string) (*ModelsList, error) {
+	return ModelsContext(context.Background(), http.DefaultClient, endpoint, apikey)
+}
+
+// ModelsContext 列出 Azure 资源下的部署, 非 2xx 响应作为错误返回
+func ModelsContext(ctx context.Context, client *http.Client, endpoint, apikey string) (*ModelsList, error) {
 	endpoint = RemoveTrailingSlash(endpoint)
 	var modelsl ModelsList
-	req, _ := http.NewRequest(http.MethodGet, endpoint+"/openai/deployments?api-version=2022-12-01", nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/openai/deployments?api-version=2022-12-01", nil)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("api-key", apikey)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("list deployments: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
 	err = json.NewDecoder(resp.Body).Decode(&modelsl)
 	if err != nil {
 		return nil, err
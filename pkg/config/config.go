@@ -0,0 +1,454 @@
+// Package config 定义 opencatd 的配置. 先取默认值, 再读取 YAML/TOML 配置文件,
+// 最后由环境变量覆盖, 加载完成后统一校验
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration 在配置文件与环境变量中写作 "30s", "5m" 等
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration { return time.Duration(d) }
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type Config struct {
+	// Listen 为监听地址; 兼容旧的 PORT 环境变量
+	Listen string `yaml:"listen" toml:"listen" env:"LISTEN_ADDR"`
+	// ShutdownTimeout 为优雅退出时等待进行中请求的上限
+	ShutdownTimeout Duration `yaml:"shutdownTimeout" toml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+	// MetricsToken 为 Prometheus 抓取 /metrics 使用的专用 token
+	MetricsToken string `yaml:"metricsToken" toml:"metricsToken" env:"METRICS_TOKEN"`
+	// TrustedProxies 为可信反向代理的 IP 或 CIDR, 只有来自这些地址的 X-Forwarded-For 才用于客户端 IP;
+	// 默认为空, 即始终使用连接的对端地址. 环境变量以逗号分隔
+	TrustedProxies []string `yaml:"trustedProxies" toml:"trustedProxies" env:"TRUSTED_PROXIES"`
+
+	Database  Database  `yaml:"database" toml:"database"`
+	Upstream  Upstream  `yaml:"upstream" toml:"upstream"`
+	RateLimit RateLimit `yaml:"rateLimit" toml:"rateLimit"`
+	Logging   Logging   `yaml:"logging" toml:"logging"`
+	Retention Retention `yaml:"retention" toml:"retention"`
+	Features  Features  `yaml:"features" toml:"features"`
+	Routing   Routing   `yaml:"routing" toml:"routing"`
+	// Pricing 为各模型每 1K token 的价格 (美元), 配置文件中的条目覆盖或补充默认价格
+	Pricing map[string]Price `yaml:"pricing" toml:"pricing"`
+}
+
+type Database struct {
+	Driver string `yaml:"driver" toml:"driver" env:"DB_DRIVER"`
+	// DSN 为主库连接串, sqlite 时为文件路径
+	DSN string `yaml:"dsn" toml:"dsn" env:"DB_DSN"`
+	// UsageDSN 为用量库连接串, 非 sqlite 时默认与主库共用
+	UsageDSN string `yaml:"usageDsn" toml:"usageDsn" env:"USAGE_DB_DSN"`
+	// AutoMigrate 为 false 时由 opencatd migrate up 手动执行迁移, 存在待执行的迁移时拒绝启动
+	AutoMigrate bool `yaml:"autoMigrate" toml:"autoMigrate" env:"DB_AUTO_MIGRATE"`
+}
+
+type Upstream struct {
+	// BaseURL 为未单独设置 endpoint 的 OpenAI Key 使用的上游地址
+	BaseURL         string `yaml:"baseUrl" toml:"baseUrl" env:"openai_endpoint"`
+	AzureAPIVersion string `yaml:"azureApiVersion" toml:"azureApiVersion" env:"AZURE_API_VERSION"`
+	// 以下为访问上游的 HTTP 客户端参数, 0 表示不限制
+	DialTimeout           Duration `yaml:"dialTimeout" toml:"dialTimeout" env:"UPSTREAM_DIAL_TIMEOUT"`
+	TLSHandshakeTimeout   Duration `yaml:"tlsHandshakeTimeout" toml:"tlsHandshakeTimeout" env:"UPSTREAM_TLS_HANDSHAKE_TIMEOUT"`
+	ResponseHeaderTimeout Duration `yaml:"responseHeaderTimeout" toml:"responseHeaderTimeout" env:"UPSTREAM_RESPONSE_HEADER_TIMEOUT"`
+	IdleConnTimeout       Duration `yaml:"idleConnTimeout" toml:"idleConnTimeout" env:"UPSTREAM_IDLE_CONN_TIMEOUT"`
+	MaxIdleConns          int      `yaml:"maxIdleConns" toml:"maxIdleConns" env:"UPSTREAM_MAX_IDLE_CONNS"`
+	// FirstByteTimeout 为发出请求到收到上游响应头的上限, 非流式请求包括整个生成过程
+	FirstByteTimeout Duration `yaml:"firstByteTimeout" toml:"firstByteTimeout" env:"UPSTREAM_FIRST_BYTE_TIMEOUT"`
+	// ChunkIdleTimeout 为读取响应体时两次收到数据之间的上限, 超时则中止流式输出
+	ChunkIdleTimeout Duration `yaml:"chunkIdleTimeout" toml:"chunkIdleTimeout" env:"UPSTREAM_CHUNK_IDLE_TIMEOUT"`
+	// TLS 为访问上游的默认证书设置, 始终校验上游证书
+	TLS TLS `yaml:"tls" toml:"tls"`
+	// Hosts 按主机名覆盖 TLS, 例如经由企业出口代理访问的 Azure 资源
+	Hosts map[string]TLS `yaml:"hosts" toml:"hosts"`
+}
+
+type TLS struct {
+	// CAFile 为追加到系统根证书之后信任的 CA 证书 (PEM)
+	CAFile string `yaml:"caFile" toml:"caFile" env:"UPSTREAM_CA_FILE"`
+	// CertFile 与 KeyFile 为可选的客户端证书 (PEM), 需同时设置
+	CertFile string `yaml:"certFile" toml:"certFile" env:"UPSTREAM_CERT_FILE"`
+	KeyFile  string `yaml:"keyFile" toml:"keyFile" env:"UPSTREAM_KEY_FILE"`
+}
+
+// TLSConfig 返回访问 host 的证书设置: Hosts 中有该主机时使用其设置, 否则使用 TLS
+func (u *Upstream) TLSConfig(host string) (*tls.Config, error) {
+	t, ok := u.Hosts[strings.ToLower(host)]
+	if !ok {
+		t = u.TLS
+	}
+	return t.Config()
+}
+
+// Config 读取证书文件创建 tls.Config
+func (t TLS) Config() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, errors.New("certFile and keyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+type RateLimit struct {
+	// PerUser 为每个用户每分钟的代理请求数上限, 0 表示不限; 与组的限流同时生效
+	PerUser int `yaml:"perUser" toml:"perUser" env:"RATE_LIMIT_PER_USER"`
+}
+
+type Logging struct {
+	// Level 为 debug|info|warn|error
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+	// Format 为 json|text
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT"`
+}
+
+type Retention struct {
+	// Days 为原始用量保留天数, 0 表示不清理
+	Days       int      `yaml:"days" toml:"days" env:"USAGE_RETENTION_DAYS"`
+	ArchiveDir string   `yaml:"archiveDir" toml:"archiveDir" env:"USAGE_ARCHIVE_DIR"`
+	Interval   Duration `yaml:"interval" toml:"interval" env:"USAGE_PRUNE_INTERVAL"`
+}
+
+type Features struct {
+	// Metrics 开启 /metrics
+	Metrics bool `yaml:"metrics" toml:"metrics" env:"FEATURE_METRICS"`
+	// WebUI 开启内置的管理页面
+	WebUI bool `yaml:"webUI" toml:"webUI" env:"FEATURE_WEB_UI"`
+}
+
+// 选取 Key 的策略
+const (
+	// RoutingWeighted 按 Key 的权重随机选取
+	RoutingWeighted = "weighted"
+	// RoutingRoundRobin 依次轮换, 忽略权重
+	RoutingRoundRobin = "roundRobin"
+)
+
+type Routing struct {
+	Strategy string `yaml:"strategy" toml:"strategy" env:"ROUTING_STRATEGY"`
+}
+
+type Price struct {
+	Prompt     float64 `yaml:"prompt" toml:"prompt"`
+	Completion float64 `yaml:"completion" toml:"completion"`
+}
+
+// Cost 按价格表计算费用, 未配置价格的模型为 0
+func (c *Config) Cost(model string, promptCount, completionCount int) float64 {
+	p := c.Pricing[model]
+	return p.Prompt*float64(promptCount)/1000 + p.Completion*float64(completionCount)/1000
+}
+
+// MetricModel 返回指标中的 model 标签: 有定价的模型原样返回, 其余记为 "other", 避免任意模型名产生新的时间序列
+func (c *Config) MetricModel(model string) string {
+	if _, ok := c.Pricing[model]; ok {
+		return model
+	}
+	return "other"
+}
+
+// Default 返回与未使用配置文件时行为一致的默认配置
+func Default() *Config {
+	return &Config{
+		Listen:          ":80",
+		ShutdownTimeout: Duration(30 * time.Second),
+		Database: Database{
+			Driver:      "sqlite",
+			AutoMigrate: true,
+		},
+		Upstream: Upstream{
+			BaseURL:             "https://api.openai.com",
+			AzureAPIVersion:     "2023-05-15",
+			DialTimeout:         Duration(30 * time.Second),
+			TLSHandshakeTimeout: Duration(10 * time.Second),
+			IdleConnTimeout:     Duration(90 * time.Second),
+			MaxIdleConns:        100,
+			FirstByteTimeout:    Duration(5 * time.Minute),
+			ChunkIdleTimeout:    Duration(time.Minute),
+		},
+		Logging:   Logging{Level: "info", Format: "json"},
+		Retention: Retention{Interval: Duration(24 * time.Hour)},
+		Features:  Features{Metrics: true, WebUI: true},
+		Routing:   Routing{Strategy: RoutingWeighted},
+		Pricing: map[string]Price{
+			"gpt-3.5-turbo":      {Prompt: 0.002, Completion: 0.002},
+			"gpt-3.5-turbo-0301": {Prompt: 0.002, Completion: 0.002},
+			"gpt-4":              {Prompt: 0.03, Completion: 0.06},
+			"gpt-4-0314":         {Prompt: 0.03, Completion: 0.06},
+			"gpt-4-32k":          {Prompt: 0.06, Completion: 0.12},
+			"gpt-4-32k-0314":     {Prompt: 0.06, Completion: 0.12},
+		},
+	}
+}
+
+// defaultPaths 为未设置 OPENCATD_CONFIG 时依次查找的配置文件, 都不存在则只使用默认值与环境变量
+var defaultPaths = []string{"config.yaml", "config.yml", "config.toml", "db/config.yaml", "db/config.yml", "db/config.toml"}
+
+// Path 返回 OPENCATD_CONFIG 或第一个存在的默认配置文件, 都没有时为空
+func Path() string {
+	if p := os.Getenv("OPENCATD_CONFIG"); p != "" {
+		return p
+	}
+	for _, p := range defaultPaths {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// Load 读取 path (为空则跳过), 应用环境变量覆盖并校验
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := decode(path, b, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	// 旧版本只支持 PORT
+	if port := os.Getenv("PORT"); port != "" && os.Getenv("LISTEN_ADDR") == "" {
+		cfg.Listen = ":" + port
+	}
+	cfg.normalize()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decode 按扩展名解析 YAML 或 TOML, 未知字段视为错误以便发现拼写错误
+func decode(path string, b []byte, cfg *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		dec := toml.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		return dec.Decode(cfg)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported config format %q, use .yaml or .toml", filepath.Ext(path))
+}
+
+// applyEnv 用 env 标签指定的环境变量覆盖对应字段
+func applyEnv(v reflect.Value) error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct && t.Field(i).Tag.Get("env") == "" {
+			if err := applyEnv(f); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		name := t.Field(i).Tag.Get("env")
+		val, ok := os.LookupEnv(name)
+		if name == "" || !ok || val == "" {
+			continue
+		}
+		if err := setField(f, val); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %w", name, val, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func setField(f reflect.Value, val string) error {
+	if u, ok := f.Addr().Interface().(interface{ UnmarshalText([]byte) error }); ok {
+		return u.UnmarshalText([]byte(val))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(val)
+	case reflect.Int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %s", f.Type())
+		}
+		var items []string
+		for _, s := range strings.Split(val, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				items = append(items, s)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
+
+// normalize 补齐依赖其他字段的默认值
+func (c *Config) normalize() {
+	c.Upstream.BaseURL = strings.TrimSuffix(strings.TrimSpace(c.Upstream.BaseURL), "/")
+	if len(c.Upstream.Hosts) > 0 {
+		hosts := make(map[string]TLS, len(c.Upstream.Hosts))
+		for host, t := range c.Upstream.Hosts {
+			hosts[strings.ToLower(host)] = t
+		}
+		c.Upstream.Hosts = hosts
+	}
+	c.Logging.Level = strings.ToLower(c.Logging.Level)
+	c.Logging.Format = strings.ToLower(c.Logging.Format)
+	if c.Database.Driver == "sqlite" {
+		if c.Database.DSN == "" {
+			c.Database.DSN = "./db/cat.db"
+		}
+		if c.Database.UsageDSN == "" {
+			c.Database.UsageDSN = "./db/usage.db"
+		}
+	} else if c.Database.UsageDSN == "" {
+		c.Database.UsageDSN = c.Database.DSN
+	}
+}
+
+// Validate 返回所有不合法的字段
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	_, _, err := net.SplitHostPort(c.Listen)
+	check(err == nil, "listen: invalid address %q", c.Listen)
+	check(c.ShutdownTimeout >= 0, "shutdownTimeout: must not be negative")
+	for _, p := range c.TrustedProxies {
+		_, _, err := net.ParseCIDR(p)
+		check(err == nil || net.ParseIP(p) != nil, "trustedProxies: invalid IP or CIDR %q", p)
+	}
+
+	switch c.Database.Driver {
+	case "sqlite":
+	case "postgres", "mysql":
+		check(c.Database.DSN != "", "database.dsn: required for driver %s", c.Database.Driver)
+	default:
+		errs = append(errs, fmt.Errorf("database.driver: unsupported driver %q", c.Database.Driver))
+	}
+
+	u, err := url.Parse(c.Upstream.BaseURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "upstream.baseUrl: invalid url %q", c.Upstream.BaseURL)
+	check(c.Upstream.AzureAPIVersion != "", "upstream.azureApiVersion: must not be empty")
+	for name, d := range map[string]Duration{
+		"dialTimeout":           c.Upstream.DialTimeout,
+		"tlsHandshakeTimeout":   c.Upstream.TLSHandshakeTimeout,
+		"responseHeaderTimeout": c.Upstream.ResponseHeaderTimeout,
+		"idleConnTimeout":       c.Upstream.IdleConnTimeout,
+		"firstByteTimeout":      c.Upstream.FirstByteTimeout,
+		"chunkIdleTimeout":      c.Upstream.ChunkIdleTimeout,
+	} {
+		check(d >= 0, "upstream.%s: must not be negative", name)
+	}
+	check(c.Upstream.MaxIdleConns >= 0, "upstream.maxIdleConns: must not be negative")
+	if _, err := c.Upstream.TLS.Config(); err != nil {
+		errs = append(errs, fmt.Errorf("upstream.tls: %w", err))
+	}
+	for host, t := range c.Upstream.Hosts {
+		if _, err := t.Config(); err != nil {
+			errs = append(errs, fmt.Errorf("upstream.hosts.%s: %w", host, err))
+		}
+	}
+
+	check(c.RateLimit.PerUser >= 0, "rateLimit.perUser: must not be negative")
+
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs = append(errs, fmt.Errorf("logging.level: unsupported level %q", c.Logging.Level))
+	}
+	check(c.Logging.Format == "json" || c.Logging.Format == "text", "logging.format: unsupported format %q", c.Logging.Format)
+
+	check(c.Retention.Days >= 0, "retention.days: must not be negative")
+	check(c.Retention.Interval > 0, "retention.interval: must be positive")
+
+	check(c.Routing.Strategy == RoutingWeighted || c.Routing.Strategy == RoutingRoundRobin, "routing.strategy: unsupported strategy %q", c.Routing.Strategy)
+	for model, p := range c.Pricing {
+		check(p.Prompt >= 0 && p.Completion >= 0, "pricing.%s: price must not be negative", model)
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted 返回隐藏了连接串与 token 的副本, 用于打印
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.MetricsToken != "" {
+		r.MetricsToken = "***"
+	}
+	if r.Database.Driver != "sqlite" {
+		r.Database.DSN = "***"
+		r.Database.UsageDSN = "***"
+	}
+	return &r
+}
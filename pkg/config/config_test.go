@@ -0,0 +1,135 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadYAMLAndTOML(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+listen: ":8080"
+upstream:
+  baseUrl: https://proxy.example.com/
+  firstByteTimeout: 2m
+rateLimit:
+  perUser: 30
+pricing:
+  my-model: {prompt: 0.5, completion: 1}
+`,
+		"config.toml": `
+listen = ":8080"
+[upstream]
+baseUrl = "https://proxy.example.com/"
+firstByteTimeout = "2m"
+[rateLimit]
+perUser = 30
+[pricing.my-model]
+prompt = 0.5
+completion = 1
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := Load(writeFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Listen != ":8080" || cfg.Upstream.BaseURL != "https://proxy.example.com" || cfg.RateLimit.PerUser != 30 {
+				t.Errorf("cfg = %+v", cfg)
+			}
+			if cfg.Upstream.FirstByteTimeout.Std() != 2*time.Minute {
+				t.Errorf("firstByteTimeout = %v", cfg.Upstream.FirstByteTimeout.Std())
+			}
+			// 未设置的字段保持默认值, 价格表在默认价格上补充
+			if cfg.Upstream.ChunkIdleTimeout.Std() != time.Minute || cfg.Database.DSN != "./db/cat.db" {
+				t.Errorf("defaults lost: chunkIdleTimeout %v, dsn %q", cfg.Upstream.ChunkIdleTimeout.Std(), cfg.Database.DSN)
+			}
+			if cfg.Pricing["my-model"].Completion != 1 || cfg.Pricing["gpt-4"].Prompt != 0.03 {
+				t.Errorf("pricing = %v", cfg.Pricing)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	for name, content := range map[string]string{
+		"config.yaml": "upstream:\n  baseUri: https://example.com\n",
+		"config.toml": "[upstream]\nbaseUri = \"https://example.com\"\n",
+		"config.json": "{}",
+	} {
+		if _, err := Load(writeFile(t, name, content)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	path := writeFile(t, "config.yaml", "listen: \":8080\"\nlogging:\n  level: info\n")
+	t.Setenv("LOG_LEVEL", "DEBUG")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+	t.Setenv("UPSTREAM_CHUNK_IDLE_TIMEOUT", "15s")
+	// LISTEN_ADDR 未设置时兼容旧的 PORT
+	t.Setenv("PORT", "9000")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Logging.Level != "debug" || cfg.Listen != ":9000" || cfg.Upstream.ChunkIdleTimeout.Std() != 15*time.Second {
+		t.Errorf("level %q, listen %q, chunkIdleTimeout %v", cfg.Logging.Level, cfg.Listen, cfg.Upstream.ChunkIdleTimeout.Std())
+	}
+	if len(cfg.TrustedProxies) != 2 || cfg.TrustedProxies[1] != "192.168.1.1" {
+		t.Errorf("trustedProxies = %v", cfg.TrustedProxies)
+	}
+
+	t.Setenv("RATE_LIMIT_PER_USER", "many")
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "RATE_LIMIT_PER_USER") {
+		t.Errorf("invalid env: err = %v", err)
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	cfg := Default()
+	cfg.Listen = "nope"
+	cfg.Database.Driver = "oracle"
+	cfg.RateLimit.PerUser = -1
+	cfg.Routing.Strategy = "random"
+	cfg.Upstream.ChunkIdleTimeout = Duration(-time.Second)
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid config passed validation")
+	}
+	for _, field := range []string{"listen", "database.driver", "rateLimit.perUser", "routing.strategy", "upstream.chunkIdleTimeout"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("error does not mention %s: %v", field, err)
+		}
+	}
+	if err := Default().Validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+}
+
+func TestRedactedHidesSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.MetricsToken = "scrape-secret"
+	cfg.Database = Database{Driver: "postgres", DSN: "postgres://cat:pw@db/cat", UsageDSN: "postgres://cat:pw@db/cat"}
+	r := cfg.Redacted()
+	if r.MetricsToken != "***" || r.Database.DSN != "***" || r.Database.UsageDSN != "***" {
+		t.Errorf("redacted = %+v", r)
+	}
+	if cfg.MetricsToken != "scrape-secret" {
+		t.Error("Redacted modified the original")
+	}
+}
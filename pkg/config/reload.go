@@ -0,0 +1,124 @@
+package config
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Change 为两份配置之间一个字段的变化, Old/New 已隐藏敏感值
+type Change struct {
+	Field string
+	Old   string
+	New   string
+	// Restart 为 true 表示该字段只在启动时读取, 重载后不生效
+	Restart bool
+}
+
+// secretFields 的值在 Diff 中以 *** 显示
+var secretFields = map[string]bool{"metricsToken": true, "database.dsn": true, "database.usageDsn": true}
+
+// restartPrefixes 为只在启动时读取的字段
+var restartPrefixes = []string{"listen", "trustedProxies", "database.", "features.", "retention."}
+
+// Diff 按字段 (配置文件中的路径) 返回 old 到 new 的变化, 按字段名排序
+func Diff(old, new *Config) []Change {
+	before, after := map[string]string{}, map[string]string{}
+	flatten(reflect.ValueOf(*old), "", before)
+	flatten(reflect.ValueOf(*new), "", after)
+	fields := map[string]bool{}
+	for f := range before {
+		fields[f] = true
+	}
+	for f := range after {
+		fields[f] = true
+	}
+	var changes []Change
+	for f := range fields {
+		o, oldOK := before[f]
+		n, newOK := after[f]
+		if o == n && oldOK == newOK {
+			continue
+		}
+		if !oldOK {
+			o = "(unset)"
+		}
+		if !newOK {
+			n = "(unset)"
+		}
+		if secretFields[f] {
+			o, n = "***", "***"
+		}
+		ch := Change{Field: f, Old: o, New: n}
+		for _, p := range restartPrefixes {
+			if f == p || strings.HasPrefix(f, p) {
+				ch.Restart = true
+			}
+		}
+		changes = append(changes, ch)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// flatten 以 yaml 标签拼出字段路径, 把叶子字段格式化为字符串
+func flatten(v reflect.Value, prefix string, out map[string]string) {
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		b, _ := m.MarshalText()
+		out[prefix] = string(b)
+		return
+	}
+	join := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "." + name
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			flatten(v.Field(i), join(name), out)
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			flatten(v.MapIndex(k), join(fmt.Sprint(k.Interface())), out)
+		}
+	default:
+		out[prefix] = fmt.Sprint(v.Interface())
+	}
+}
+
+// Watch 每隔 interval 检查 path 的修改时间与大小, 变化时调用 onChange, 直到 ctx 结束.
+// 轮询同样适用于挂载卷与 Kubernetes ConfigMap 的符号链接替换
+func Watch(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	mod, size := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m, sz := stat()
+		if m.Equal(mod) && sz == size {
+			continue
+		}
+		mod, size = m, sz
+		onChange()
+	}
+}
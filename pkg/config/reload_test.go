@@ -0,0 +1,72 @@
+package config
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	old := Default()
+	next := Default()
+	next.Pricing = map[string]Price{"gpt-4": {Prompt: 0.01, Completion: 0.03}, "new-model": {Prompt: 1}}
+	next.Listen = ":8080"
+	next.MetricsToken = "scrape-secret"
+	next.Upstream.ChunkIdleTimeout = Duration(10 * time.Second)
+
+	changes := map[string]Change{}
+	for _, c := range Diff(old, next) {
+		changes[c.Field] = c
+	}
+	tests := []struct {
+		field    string
+		old, new string
+		restart  bool
+	}{
+		{"listen", ":80", ":8080", true},
+		{"metricsToken", "***", "***", false},
+		{"pricing.gpt-4.prompt", "0.03", "0.01", false},
+		{"pricing.new-model.prompt", "(unset)", "1", false},
+		{"pricing.gpt-3.5-turbo.prompt", "0.002", "(unset)", false},
+		{"upstream.chunkIdleTimeout", "1m0s", "10s", false},
+	}
+	for _, tt := range tests {
+		c, ok := changes[tt.field]
+		if !ok {
+			t.Errorf("%s: no change reported", tt.field)
+			continue
+		}
+		if c.Old != tt.old || c.New != tt.new || c.Restart != tt.restart {
+			t.Errorf("%s: %+v, want %s -> %s restart %v", tt.field, c, tt.old, tt.new, tt.restart)
+		}
+	}
+	if _, ok := changes["upstream.baseUrl"]; ok {
+		t.Error("unchanged field reported")
+	}
+	if got := Diff(old, Default()); len(got) != 0 {
+		t.Errorf("identical configs: %v", got)
+	}
+}
+
+func TestWatchReportsFileChanges(t *testing.T) {
+	path := writeFile(t, "config.yaml", "listen: \":80\"\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 10)
+	go Watch(ctx, path, 10*time.Millisecond, func() { changed <- struct{}{} })
+
+	select {
+	case <-changed:
+		t.Fatal("change reported before the file changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := os.WriteFile(path, []byte("listen: \":8080\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("change not reported")
+	}
+}
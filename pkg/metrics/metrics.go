@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "opencatd"
+
+// Metrics 持有代理请求、用量与流的指标, 由 New 创建并注册到给定的 Registerer
+type Metrics struct {
+	reg prometheus.Registerer
+
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	tokensTotal     *prometheus.CounterVec
+	costTotal       *prometheus.CounterVec
+	inflightStreams prometheus.Gauge
+}
+
+// NewRegistry 返回带 Go 运行时与进程指标的 Registry, 供 /metrics 使用
+func NewRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// New 创建指标并注册到 reg, reg 为 nil 时只在内存中累加, 不对外暴露
+func New(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+	m := &Metrics{
+		reg: reg,
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Proxied requests by route, model, key and upstream status.",
+		}, []string{"route", "model", "key", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of proxied requests by route, model, key and upstream status.",
+			Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 40, 80, 160},
+		}, []string{"route", "model", "key", "status"}),
+		tokensTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tokens_total",
+			Help:      "Tokens consumed by user, model and kind (prompt|completion).",
+		}, []string{"user", "model", "kind"}),
+		costTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cost_dollars_total",
+			Help:      "Estimated cost in USD by user and model.",
+		}, []string{"user", "model"}),
+		inflightStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "inflight_streams",
+			Help:      "Streaming responses currently being relayed.",
+		}),
+	}
+	reg.MustRegister(m.requestsTotal, m.requestDuration, m.tokensTotal, m.costTotal, m.inflightStreams)
+	return m
+}
+
+// Handler 返回 /metrics 的 http.Handler
+func Handler(g prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+}
+
+// RegisterGaugeFunc 注册一个在抓取时求值的 gauge, 用于暴露 key 数量等外部状态
+func (m *Metrics) RegisterGaugeFunc(name, help string, fn func() float64) {
+	m.reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// Request 记录一次代理请求的生命周期, 由 HandleProy 创建并在返回时 Done
+type Request struct {
+	Route  string
+	Model  string
+	Key    string
+	Status int
+	m      *Metrics
+	start  time.Time
+	stream bool
+}
+
+func (m *Metrics) StartRequest(route string) *Request {
+	return &Request{Route: route, m: m, start: time.Now()}
+}
+
+// StreamStarted 标记开始转发流式响应
+func (r *Request) StreamStarted() {
+	if r.stream {
+		return
+	}
+	r.stream = true
+	r.m.inflightStreams.Inc()
+}
+
+func (r *Request) Done() {
+	if r.stream {
+		r.m.inflightStreams.Dec()
+	}
+	status := "error"
+	if r.Status > 0 {
+		status = strconv.Itoa(r.Status)
+	}
+	r.m.requestsTotal.WithLabelValues(r.Route, r.Model, r.Key, status).Inc()
+	r.m.requestDuration.WithLabelValues(r.Route, r.Model, r.Key, status).Observe(time.Since(r.start).Seconds())
+}
+
+// RecordUsage 累加用户在某个模型上的 token 与花费
+func (m *Metrics) RecordUsage(userID int, model string, promptTokens, completionTokens int, cost float64) {
+	user := strconv.Itoa(userID)
+	m.tokensTotal.WithLabelValues(user, model, "prompt").Add(float64(promptTokens))
+	m.tokensTotal.WithLabelValues(user, model, "completion").Add(float64(completionTokens))
+	m.costTotal.WithLabelValues(user, model).Add(cost)
+}
@@ -0,0 +1,413 @@
+// Package secret 实现上游 API Key 的信封加密:
+// 每条记录使用随机数据密钥 (DEK) 以 AES-256-GCM 加密, DEK 再由带版本号的主密钥 (KEK) 加密.
+// 密文格式为 "enc:v<版本>:<base64(加密后的DEK)>:<base64(密文)>", 轮换主密钥只需重新包裹 DEK.
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const prefix = "enc:"
+
+var ErrUnknownVersion = errors.New("secret: master key version not available")
+
+// MasterKey 是带版本号的主密钥
+type MasterKey struct {
+	Version uint32
+	Key     []byte
+}
+
+// ParseMasterKey 解析 "<version>:<base64>" 或 "<base64>" (版本 1).
+// 非 32 字节 base64 的字符串按口令处理, 以 SHA-256 派生密钥
+func ParseMasterKey(s string) (MasterKey, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return MasterKey{}, errors.New("secret: empty master key")
+	}
+	version := uint32(1)
+	if i := strings.Index(s, ":"); i > 0 {
+		if v, err := strconv.ParseUint(s[:i], 10, 32); err == nil {
+			version = uint32(v)
+			s = s[i+1:]
+		}
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+		return MasterKey{Version: version, Key: b}, nil
+	}
+	sum := sha256.Sum256([]byte(s))
+	return MasterKey{Version: version, Key: sum[:]}, nil
+}
+
+func GenerateMasterKey(version uint32) MasterKey {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return MasterKey{Version: version, Key: b}
+}
+
+func (m MasterKey) String() string {
+	return fmt.Sprintf("%d:%s", m.Version, base64.StdEncoding.EncodeToString(m.Key))
+}
+
+// Fingerprint 返回明文在该主密钥下的 HMAC-SHA256 (hex), 用于在不解密的情况下判断重复.
+// HMAC 密钥由主密钥派生, 不直接使用主密钥; 主密钥轮换后指纹随之改变
+func (m MasterKey) Fingerprint(plaintext string) string {
+	derive := hmac.New(sha256.New, m.Key)
+	derive.Write([]byte("opencatd key fingerprint"))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(plaintext))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Keyring 持有当前主密钥以及用于解密旧数据的历史主密钥
+type Keyring struct {
+	active MasterKey
+	keys   map[uint32][]byte
+	// File 记录主密钥来源文件, 轮换时写回; 主密钥来自环境变量时为空
+	File string
+	// modTime 与 size 为读取 File 时的文件状态, 由 Refresh 判断文件是否被修改
+	modTime time.Time
+	size    int64
+}
+
+var ErrNoMasterKey = errors.New("secret: no master key configured, set OPENCATD_MASTER_KEY or OPENCATD_MASTER_KEY_FILE (outside the data directory)")
+
+func NewKeyring(active MasterKey, previous ...MasterKey) *Keyring {
+	kr := &Keyring{active: active, keys: map[uint32][]byte{active.Version: active.Key}}
+	for _, p := range previous {
+		kr.add(p)
+	}
+	return kr
+}
+
+// DevMode 为 OPENCATD_MASTER_KEY_DEV=true, 允许把主密钥自动生成在数据目录中, 仅用于开发
+func DevMode() bool {
+	v, _ := strconv.ParseBool(os.Getenv("OPENCATD_MASTER_KEY_DEV"))
+	return v
+}
+
+// KeyFile 返回 LoadKeyring 将读取的主密钥文件, 主密钥来自 OPENCATD_MASTER_KEY 或未配置时为空
+func KeyFile(devFile string) string {
+	if os.Getenv("OPENCATD_MASTER_KEY") != "" {
+		return ""
+	}
+	if file := os.Getenv("OPENCATD_MASTER_KEY_FILE"); file != "" {
+		return file
+	}
+	if DevMode() {
+		return devFile
+	}
+	return ""
+}
+
+// LoadKeyring 依次读取 OPENCATD_MASTER_KEY, OPENCATD_MASTER_KEY_FILE (不存在则生成);
+// 都未设置时只有 DevMode 下才使用 devFile, 否则返回 ErrNoMasterKey.
+// OPENCATD_MASTER_KEY_PREVIOUS 以逗号分隔提供旧主密钥
+func LoadKeyring(devFile string) (kr *Keyring, generated bool, err error) {
+	if v := os.Getenv("OPENCATD_MASTER_KEY"); v != "" {
+		active, err := ParseMasterKey(v)
+		if err != nil {
+			return nil, false, err
+		}
+		kr = NewKeyring(active)
+	} else {
+		file := KeyFile(devFile)
+		if file == "" {
+			return nil, false, ErrNoMasterKey
+		}
+		kr, err = ReadKeyFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			if err = WriteKeyFile(file, NewKeyring(GenerateMasterKey(1))); err == nil {
+				kr, err = ReadKeyFile(file)
+				generated = true
+			}
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	for _, p := range strings.Split(os.Getenv("OPENCATD_MASTER_KEY_PREVIOUS"), ",") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		mk, err := ParseMasterKey(p)
+		if err != nil {
+			return nil, false, err
+		}
+		kr.add(mk)
+	}
+	return kr, generated, nil
+}
+
+// ReadKeyFile 读取主密钥文件: 第一行为当前主密钥, 其余各行为轮换中保留的旧主密钥
+func ReadKeyFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var keys []MasterKey
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		mk, err := ParseMasterKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, mk)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: empty master key file", path)
+	}
+	kr := NewKeyring(keys[0], keys[1:]...)
+	kr.File, kr.modTime, kr.size = path, st.ModTime(), st.Size()
+	return kr, nil
+}
+
+// WriteKeyFile 以先写临时文件再改名的方式写入 kr 的全部主密钥, 中途失败不会留下残缺的文件
+func WriteKeyFile(path string, kr *Keyring) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, mk := range kr.Keys() {
+		b.WriteString(mk.String() + "\n")
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Refresh 在主密钥文件被修改后 (例如 rotate_master_key) 重新读取, 已加载的旧主密钥继续保留到重启;
+// 文件未变化或主密钥来自环境变量时返回 kr 本身
+func (kr *Keyring) Refresh() (*Keyring, error) {
+	if kr.File == "" {
+		return kr, nil
+	}
+	st, err := os.Stat(kr.File)
+	if err != nil {
+		return kr, err
+	}
+	if st.ModTime().Equal(kr.modTime) && st.Size() == kr.size {
+		return kr, nil
+	}
+	next, err := ReadKeyFile(kr.File)
+	if err != nil {
+		return kr, err
+	}
+	for _, mk := range kr.Keys() {
+		next.add(mk)
+	}
+	return next, nil
+}
+
+// WithActive 返回以 active 为当前主密钥并保留 kr 中所有主密钥的新 Keyring
+func (kr *Keyring) WithActive(active MasterKey) *Keyring {
+	next := NewKeyring(active, kr.Keys()...)
+	next.File = kr.File
+	return next
+}
+
+// Keys 返回当前主密钥及按版本从新到旧排列的旧主密钥
+func (kr *Keyring) Keys() []MasterKey {
+	keys := []MasterKey{kr.active}
+	var versions []uint32
+	for v := range kr.keys {
+		if v != kr.active.Version {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+	for _, v := range versions {
+		keys = append(keys, MasterKey{Version: v, Key: kr.keys[v]})
+	}
+	return keys
+}
+
+func (kr *Keyring) add(mk MasterKey) {
+	if _, ok := kr.keys[mk.Version]; !ok {
+		kr.keys[mk.Version] = mk.Key
+	}
+}
+
+func (kr *Keyring) Active() MasterKey {
+	return kr.active
+}
+
+// Fingerprint 返回明文在当前主密钥下的指纹
+func (kr *Keyring) Fingerprint(plaintext string) string {
+	return kr.active.Fingerprint(plaintext)
+}
+
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// Encrypt 用新的 DEK 加密明文, 并以当前主密钥包裹 DEK
+func (kr *Keyring) Encrypt(plaintext string) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	ct, err := seal(dek, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return kr.wrap(kr.active, dek, ct)
+}
+
+func (kr *Keyring) Decrypt(s string) (string, error) {
+	dek, ct, err := kr.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+	pt, err := open(dek, ct)
+	if err != nil {
+		return "", err
+	}
+	return string(pt), nil
+}
+
+// Rewrap 用 to 重新包裹 DEK, 数据密文保持不变
+func (kr *Keyring) Rewrap(s string, to MasterKey) (string, error) {
+	dek, ct, err := kr.unwrap(s)
+	if err != nil {
+		return "", err
+	}
+	return kr.wrap(to, dek, ct)
+}
+
+func (kr *Keyring) wrap(mk MasterKey, dek, ct []byte) (string, error) {
+	wrapped, err := seal(mk.Key, dek)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.StdEncoding
+	return fmt.Sprintf("%sv%d:%s:%s", prefix, mk.Version, enc.EncodeToString(wrapped), enc.EncodeToString(ct)), nil
+}
+
+func (kr *Keyring) unwrap(s string) (dek, ct []byte, err error) {
+	if !IsEncrypted(s) {
+		return nil, nil, errors.New("secret: value is not encrypted")
+	}
+	parts := strings.Split(strings.TrimPrefix(s, prefix), ":")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "v") {
+		return nil, nil, errors.New("secret: malformed ciphertext")
+	}
+	v, err := strconv.ParseUint(parts[0][1:], 10, 32)
+	if err != nil {
+		return nil, nil, errors.New("secret: malformed key version")
+	}
+	kek, ok := kr.keys[uint32(v)]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: v%d", ErrUnknownVersion, v)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	if ct, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return nil, nil, err
+	}
+	if dek, err = open(kek, wrapped); err != nil {
+		return nil, nil, fmt.Errorf("secret: unwrap data key: %w", err)
+	}
+	return dek, ct, nil
+}
+
+// Version 返回密文所用主密钥版本
+func Version(s string) (uint32, bool) {
+	if !IsEncrypted(s) {
+		return 0, false
+	}
+	v, _, _ := strings.Cut(strings.TrimPrefix(s, prefix), ":")
+	n, err := strconv.ParseUint(strings.TrimPrefix(v, "v"), 10, 32)
+	return uint32(n), err == nil
+}
+
+// Mask 把 "sk-abcdefgh1234" 显示为 "sk-...1234"
+func Mask(s string) string {
+	if len(s) <= 8 {
+		return "..."
+	}
+	head := s[:3]
+	if i := strings.Index(s, "-"); i > 0 && i < 8 {
+		head = s[:i+1]
+	}
+	return head + "..." + s[len(s)-4:]
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("secret: ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,75 @@
+package secret
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadKeyringRequiresExplicitKey(t *testing.T) {
+	for _, env := range []string{"OPENCATD_MASTER_KEY", "OPENCATD_MASTER_KEY_FILE", "OPENCATD_MASTER_KEY_PREVIOUS", "OPENCATD_MASTER_KEY_DEV"} {
+		t.Setenv(env, "")
+	}
+	devFile := filepath.Join(t.TempDir(), "db", "master.key")
+	if _, _, err := LoadKeyring(devFile); !errors.Is(err, ErrNoMasterKey) {
+		t.Fatalf("no master key configured: err = %v, want ErrNoMasterKey", err)
+	}
+	if _, err := os.Stat(devFile); !os.IsNotExist(err) {
+		t.Fatal("master key generated without OPENCATD_MASTER_KEY_DEV")
+	}
+
+	t.Setenv("OPENCATD_MASTER_KEY_DEV", "true")
+	kr, generated, err := LoadKeyring(devFile)
+	if err != nil || !generated || kr.File != devFile {
+		t.Fatalf("dev mode: kr %+v, generated %v, err %v", kr, generated, err)
+	}
+
+	t.Setenv("OPENCATD_MASTER_KEY_DEV", "")
+	file := filepath.Join(t.TempDir(), "secrets", "master.key")
+	t.Setenv("OPENCATD_MASTER_KEY_FILE", file)
+	if kr, generated, err = LoadKeyring(devFile); err != nil || !generated || kr.File != file {
+		t.Fatalf("explicit file: kr %+v, generated %v, err %v", kr, generated, err)
+	}
+	again, generated, err := LoadKeyring(devFile)
+	if err != nil || generated || again.Active().String() != kr.Active().String() {
+		t.Fatalf("reload explicit file: generated %v, err %v", generated, err)
+	}
+}
+
+func TestKeyFileKeepsPreviousKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "master.key")
+	v1 := GenerateMasterKey(1)
+	if err := WriteKeyFile(file, NewKeyring(v1)); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := ReadKeyFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := kr.Encrypt("sk-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, err := kr.Refresh(); err != nil || same != kr {
+		t.Fatalf("refresh of an unchanged file returned a new keyring: %v", err)
+	}
+
+	v2 := GenerateMasterKey(2)
+	if err := WriteKeyFile(file, kr.WithActive(v2)); err != nil {
+		t.Fatal(err)
+	}
+	next, err := kr.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Active().Version != 2 {
+		t.Fatalf("active after refresh = v%d, want v2", next.Active().Version)
+	}
+	if pt, err := next.Decrypt(ct); err != nil || pt != "sk-a" {
+		t.Fatalf("decrypt v1 ciphertext after refresh: %q, %v", pt, err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+}
@@ -0,0 +1,196 @@
+// Package sso 实现管理接口的 OIDC 授权码登录. 通过环境变量配置, 未设置 OIDC_ISSUER 时不启用
+package sso
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var ErrDisabled = errors.New("sso: oidc is not configured")
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL 为 IdP 回调地址, 形如 https://cat.example.com/1/auth/oidc/callback
+	RedirectURL string
+	Scopes      []string
+	// GroupsClaim 为 ID Token 中用户组所在的 claim
+	GroupsClaim string
+	// RoleMap 为 IdP 组到角色的映射, 用户属于多个组时取权限最高的角色
+	RoleMap map[string]string
+	// DefaultRole 为未匹配任何组时的角色, 为空则拒绝登录
+	DefaultRole string
+	SessionTTL  time.Duration
+	// PostLoginURL 为登录成功后跳转的地址
+	PostLoginURL string
+}
+
+func (c *Config) Enabled() bool {
+	return c != nil && c.Issuer != ""
+}
+
+// ConfigFromEnv 读取 OIDC_* 环境变量, OIDC_ISSUER 为空时返回 nil
+func ConfigFromEnv() (*Config, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		GroupsClaim:  "groups",
+		RoleMap:      map[string]string{},
+		DefaultRole:  os.Getenv("OIDC_DEFAULT_ROLE"),
+		SessionTTL:   12 * time.Hour,
+		PostLoginURL: "/",
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("sso: OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required")
+	}
+	if v := os.Getenv("OIDC_SCOPES"); v != "" {
+		cfg.Scopes = strings.Fields(strings.ReplaceAll(v, ",", " "))
+	}
+	if v := os.Getenv("OIDC_GROUPS_CLAIM"); v != "" {
+		cfg.GroupsClaim = v
+	}
+	// OIDC_ROLE_MAP 形如 "platform=owner,ai-admins=admin,finance=auditor"
+	for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAP"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("sso: invalid OIDC_ROLE_MAP entry %q", pair)
+		}
+		cfg.RoleMap[strings.TrimSpace(group)] = strings.TrimSpace(role)
+	}
+	if v := os.Getenv("OIDC_SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("sso: invalid OIDC_SESSION_TTL: %w", err)
+		}
+		cfg.SessionTTL = d
+	}
+	if v := os.Getenv("OIDC_POST_LOGIN_URL"); v != "" {
+		cfg.PostLoginURL = v
+	}
+	return cfg, nil
+}
+
+// Identity 是从 ID Token 中取得的用户信息
+type Identity struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// Client 在首次使用时才请求 IdP 的 discovery 文档, IdP 暂时不可用不影响服务启动
+type Client struct {
+	cfg *Config
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func NewClient(cfg *Config) *Client {
+	return &Client{cfg: cfg}
+}
+
+func (c *Client) Config() *Config {
+	if c == nil {
+		return nil
+	}
+	return c.cfg
+}
+
+func (c *Client) discover(ctx context.Context) (*oidc.Provider, error) {
+	if c == nil || !c.cfg.Enabled() {
+		return nil, ErrDisabled
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.provider != nil {
+		return c.provider, nil
+	}
+	p, err := oidc.NewProvider(ctx, c.cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("sso: discovery: %w", err)
+	}
+	c.provider = p
+	return p, nil
+}
+
+func (c *Client) oauth2Config(p *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.cfg.ClientID,
+		ClientSecret: c.cfg.ClientSecret,
+		RedirectURL:  c.cfg.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       c.cfg.Scopes,
+	}
+}
+
+// AuthCodeURL 返回跳转到 IdP 的登录地址
+func (c *Client) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	p, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return c.oauth2Config(p).AuthCodeURL(state, oidc.Nonce(nonce)), nil
+}
+
+// Exchange 用授权码换取并校验 ID Token, 校验 nonce 后返回用户信息
+func (c *Client) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	p, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := c.oauth2Config(p).Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("sso: exchange code: %w", err)
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("sso: token response has no id_token")
+	}
+	idt, err := p.Verifier(&oidc.Config{ClientID: c.cfg.ClientID}).Verify(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("sso: verify id_token: %w", err)
+	}
+	if idt.Nonce != nonce {
+		return nil, errors.New("sso: nonce mismatch")
+	}
+	var claims map[string]interface{}
+	if err := idt.Claims(&claims); err != nil {
+		return nil, err
+	}
+	id := &Identity{Subject: idt.Subject}
+	id.Email, _ = claims["email"].(string)
+	id.Username, _ = claims["preferred_username"].(string)
+	switch g := claims[c.cfg.GroupsClaim].(type) {
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	case string:
+		id.Groups = strings.Fields(strings.ReplaceAll(g, ",", " "))
+	}
+	sort.Strings(id.Groups)
+	return id, nil
+}
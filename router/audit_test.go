@@ -0,0 +1,69 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"opencatd-open/store"
+	"strings"
+	"testing"
+	"time"
+)
+
+type auditPage struct {
+	Total  int `json:"total"`
+	Events []struct {
+		ActorName  string          `json:"actorName"`
+		TargetType string          `json:"targetType"`
+		Diff       json.RawMessage `json:"diff"`
+	} `json:"events"`
+}
+
+func TestAuditQueryIncludesWholeToDate(t *testing.T) {
+	s := newTestServer(t, nil, Options{})
+	root := s.initRoot(t)
+	body := map[string]any{"key": "sk-secret-value", "name": "k1"}
+	if code := s.do(t, http.MethodPost, "/1/keys?skip_validation=true", root, body, nil); code != http.StatusOK {
+		t.Fatalf("add key: status %d", code)
+	}
+
+	today := time.Now().Format("2006-01-02")
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"action=key.create", 1},
+		{"action=key.create&from=" + today + "&to=" + today, 1},
+		{"action=key.create&to=" + today, 1},
+		{"action=key.create&to=" + yesterday, 0},
+		{"action=key.create&to=" + time.Now().Add(-time.Hour).Format(time.RFC3339), 0},
+		{"action=key.delete", 0},
+	}
+	for _, tt := range tests {
+		var page auditPage
+		if code := s.do(t, http.MethodGet, "/1/audit?"+tt.query, root, nil, &page); code != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.query, code)
+		}
+		if page.Total != tt.want {
+			t.Errorf("%s: total %d, want %d", tt.query, page.Total, tt.want)
+		}
+	}
+	if code := s.do(t, http.MethodGet, "/1/audit?to=yesterday", root, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid to: status %d, want 400", code)
+	}
+
+	var page auditPage
+	s.do(t, http.MethodGet, "/1/audit?action=key.create", root, nil, &page)
+	e := page.Events[0]
+	if e.ActorName != "root" || e.TargetType != "key" {
+		t.Errorf("event = %+v", e)
+	}
+	if strings.Contains(string(e.Diff), "sk-secret-value") {
+		t.Errorf("audit diff leaks the key: %s", e.Diff)
+	}
+	var diff map[string]store.FieldChange
+	if err := json.Unmarshal(e.Diff, &diff); err != nil || fmt.Sprint(diff["name"].New) != "k1" {
+		t.Errorf("diff = %s, %v", e.Diff, err)
+	}
+}
@@ -0,0 +1,47 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"opencatd-open/pkg/logger"
+	"opencatd-open/store"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// backupWriter 在第一次写入时才发送响应头, 快照失败时仍可返回 JSON 错误
+type backupWriter struct {
+	c       *gin.Context
+	started bool
+}
+
+func (w *backupWriter) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.c.Header("Content-Type", "application/gzip")
+		w.c.Header("Content-Disposition", `attachment; filename="opencatd-`+time.Now().UTC().Format("20060102-150405")+`.tar.gz"`)
+		w.c.Status(http.StatusOK)
+	}
+	return w.c.Writer.Write(p)
+}
+
+// HandleBackup 以 tar.gz 流式返回主库与用量库的一致快照, 可用 opencatd restore 恢复
+func (h *Handler) HandleBackup(c *gin.Context) {
+	w := &backupWriter{c: c}
+	err := h.store.Backup(c.Request.Context(), w)
+	if err != nil {
+		if w.started {
+			// 响应头已发送, 截断的备份包在恢复时会因校验失败被拒绝
+			logger.FromContext(c.Request.Context()).Error("stream backup", "err", err)
+			return
+		}
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrBackupUnsupported) {
+			status = http.StatusNotImplemented
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, AuditBackup, "backup", 0, nil, nil)
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBackupRequiresPermission(t *testing.T) {
+	s := newTestServer(t, nil, Options{})
+	root := s.initRoot(t)
+	var member User
+	if code := s.do(t, http.MethodPost, "/1/users", root, map[string]string{"name": "alice"}, &member); code != http.StatusOK {
+		t.Fatalf("add user: status %d", code)
+	}
+	if code := s.do(t, http.MethodPost, "/1/backup", member.Token, nil, nil); code != http.StatusForbidden {
+		t.Errorf("member backup: status %d, want 403", code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/1/backup", nil)
+	req.Header.Set("Authorization", "Bearer "+root)
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("backup: status %d, body %s", w.Code, w.Body)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	if len(names) != 3 || names[0] != "manifest.json" {
+		t.Errorf("backup contents = %v", names)
+	}
+	var page auditPage
+	s.do(t, http.MethodGet, "/1/audit?action="+AuditBackup, root, nil, &page)
+	if page.Total != 1 {
+		t.Errorf("backup audit events = %d, want 1", page.Total)
+	}
+}
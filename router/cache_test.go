@@ -0,0 +1,71 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"opencatd-open/pkg/config"
+	"sync"
+	"testing"
+)
+
+// 用 go test -race 运行: 修改 Key 会重建缓存, 与代理请求中的读取并发
+func TestPatchKeyWhileProxying(t *testing.T) {
+	up := newFakeUpstream(t)
+	cfg := config.Default()
+	cfg.Upstream.BaseURL = up.URL
+	s := newTestServer(t, cfg, Options{})
+	root := s.initRoot(t)
+	s.addTestKey(t, root, "k1", up.URL)
+	s.addTestKey(t, root, "k2", up.URL)
+	keys, err := s.store.GetAllKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/1/keys/%d", keys[0].ID)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if code := s.do(t, http.MethodPost, "/v1/chat/completions", root, chatBody("gpt-4"), nil); code != http.StatusOK {
+					t.Errorf("chat: status %d", code)
+					return
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				body := map[string]any{"weight": i*20 + j + 1, "enabled": true}
+				if code := s.do(t, http.MethodPatch, path, root, body, nil); code != http.StatusOK {
+					t.Errorf("patch key: status %d", code)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := s.store.KeyCount(); n != 2 {
+		t.Errorf("KeyCount = %d, want 2", n)
+	}
+}
+
+func TestAddKeyRejectsUnknownApiType(t *testing.T) {
+	s := newTestServer(t, nil, Options{})
+	root := s.initRoot(t)
+	body := map[string]any{"key": "sk-1", "name": "k1", "api_type": "claude"}
+	if code := s.do(t, http.MethodPost, "/1/keys", root, body, nil); code != http.StatusBadRequest {
+		t.Errorf("unknown api_type: status %d, want 400", code)
+	}
+	if n := s.store.KeyCount(); n != 0 {
+		t.Errorf("KeyCount = %d, want 0", n)
+	}
+	body["api_type"] = "azure_openai"
+	body["endpoint"] = "https://res.openai.azure.com"
+	if code := s.do(t, http.MethodPost, "/1/keys?skip_validation=true", root, body, nil); code != http.StatusOK {
+		t.Errorf("azure_openai: status %d, want 200", code)
+	}
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"opencatd-open/pkg/config"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddingsUseSiteKey(t *testing.T) {
+	var gotAuth, gotPath, gotBody string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotAuth, gotPath, gotBody = r.Header.Get("Authorization"), r.URL.Path, string(b)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"object":"list","data":[{"object":"embedding","index":0,"embedding":[0.1]}],"model":"text-embedding-ada-002","usage":{"prompt_tokens":2,"total_tokens":2}}`)
+	}))
+	t.Cleanup(up.Close)
+	cfg := config.Default()
+	cfg.Upstream.BaseURL = up.URL
+	s := newTestServer(t, cfg, Options{})
+	root := s.initRoot(t)
+	s.addTestKey(t, root, "k1", up.URL)
+
+	body := map[string]any{"model": "text-embedding-ada-002", "input": "hello"}
+	if code := s.do(t, http.MethodPost, "/v1/embeddings", root, body, nil); code != http.StatusOK {
+		t.Fatalf("embeddings: status %d", code)
+	}
+	if gotAuth != "Bearer sk-k1" {
+		t.Errorf("upstream Authorization = %q, want the site key", gotAuth)
+	}
+	if gotPath != "/v1/embeddings" || strings.TrimSpace(gotBody) != `{"input":"hello","model":"text-embedding-ada-002"}` {
+		t.Errorf("upstream got %s %s, want the request forwarded unchanged", gotPath, gotBody)
+	}
+
+	_, chat := s.addToken(t, root, map[string]any{"name": "chat", "scopes": []string{"chat"}})
+	gotAuth = ""
+	if code := s.do(t, http.MethodPost, "/v1/embeddings", chat.Token, body, nil); code != http.StatusForbidden {
+		t.Errorf("chat-only token: status %d, want 403", code)
+	}
+	_, narrow := s.addToken(t, root, map[string]any{"name": "narrow", "scopes": []string{"embeddings"}, "models": []string{"text-embedding-3-small"}})
+	if code := s.do(t, http.MethodPost, "/v1/embeddings", narrow.Token, body, nil); code != http.StatusForbidden {
+		t.Errorf("model not allowed: status %d, want 403", code)
+	}
+	if gotAuth != "" {
+		t.Error("rejected requests reached the upstream")
+	}
+}
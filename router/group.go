@@ -0,0 +1,215 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"opencatd-open/store"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sakurasan/to"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GroupReq 为创建/修改组的请求体, 修改时省略的字段保持不变
+type GroupReq struct {
+	Name          *string   `json:"name,omitempty"`
+	ParentID      *uint     `json:"parentId,omitempty"`
+	MonthlyBudget *float64  `json:"monthlyBudget,omitempty"`
+	RateLimit     *int      `json:"rateLimit,omitempty"`
+	Models        *[]string `json:"models,omitempty"`
+	KeyIDs        *[]uint   `json:"keyIds,omitempty"`
+	Notes         *string   `json:"notes,omitempty"`
+}
+
+// toPatch 校验请求体, 并确认引用的 Key 存在
+func (r GroupReq) toPatch(ctx context.Context, st *store.Store) (store.GroupPatch, error) {
+	p := store.GroupPatch{ParentID: r.ParentID, Notes: r.Notes}
+	if r.Name != nil {
+		name := strings.TrimSpace(*r.Name)
+		if name == "" {
+			return p, errors.New("invalid group name")
+		}
+		p.Name = &name
+	}
+	if r.MonthlyBudget != nil {
+		if *r.MonthlyBudget < 0 {
+			return p, errors.New("monthlyBudget must not be negative")
+		}
+		p.MonthlyBudget = r.MonthlyBudget
+	}
+	if r.RateLimit != nil {
+		if *r.RateLimit < 0 {
+			return p, errors.New("rateLimit must not be negative")
+		}
+		p.RateLimit = r.RateLimit
+	}
+	if r.Models != nil {
+		models := []string{}
+		for _, m := range *r.Models {
+			if m = strings.TrimSpace(m); m != "" {
+				models = append(models, m)
+			}
+		}
+		p.Models = &models
+	}
+	if r.KeyIDs != nil {
+		for _, id := range *r.KeyIDs {
+			if _, err := st.GetKeyByID(ctx, id); err != nil {
+				return p, fmt.Errorf("invalid key id %d", id)
+			}
+		}
+		p.KeyIDs = r.KeyIDs
+	}
+	return p, nil
+}
+
+func (h *Handler) HandleGroups(c *gin.Context) {
+	groups, err := h.store.GetAllGroups(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+func (h *Handler) HandleAddGroup(c *gin.Context) {
+	var body GroupReq
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Name == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group name"})
+		return
+	}
+	p, err := body.toPatch(c.Request.Context(), h.store)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	g := &store.Group{Name: *p.Name}
+	if p.ParentID != nil && *p.ParentID != 0 {
+		g.ParentID = p.ParentID
+	}
+	if err := h.store.CreateGroup(c.Request.Context(), g, p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	g, err = h.store.GetGroup(c.Request.Context(), g.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, AuditGroupCreate, "group", g.ID, nil, g)
+	c.JSON(http.StatusOK, g)
+}
+
+func (h *Handler) HandleUpdateGroup(c *gin.Context) {
+	before, err := h.store.GetGroup(c.Request.Context(), uint(to.Int(c.Param("id"))))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid group id"})
+		return
+	}
+	var body GroupReq
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := body.toPatch(c.Request.Context(), h.store)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.store.UpdateGroup(c.Request.Context(), before.ID, p); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrGroupCycle) || errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	after, err := h.store.GetGroup(c.Request.Context(), before.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, AuditGroupUpdate, "group", after.ID, before, after)
+	c.JSON(http.StatusOK, after)
+}
+
+func (h *Handler) HandleDelGroup(c *gin.Context) {
+	g, err := h.store.GetGroup(c.Request.Context(), uint(to.Int(c.Param("id"))))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid group id"})
+		return
+	}
+	if err := h.store.DeleteGroup(c.Request.Context(), g.ID); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrGroupInUse) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, AuditGroupDelete, "group", g.ID, g, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
+
+// groupLimiter 是按组计数的固定一分钟窗口限流. 与 userLimiter 一样只在本进程内计数,
+// 多个实例时组的实际上限为 rateLimit 乘以实例数
+type groupLimiter struct {
+	mu     sync.Mutex
+	window int64
+	counts map[uint]int
+}
+
+// allow 在组链上每个组都未超限时为所有组计数一次, 否则返回超限的组
+func (l *groupLimiter) allow(chain []store.Group) (store.Group, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w := time.Now().Unix() / 60; w != l.window {
+		l.window = w
+		l.counts = map[uint]int{}
+	}
+	for _, g := range chain {
+		if g.RateLimit > 0 && l.counts[g.ID] >= g.RateLimit {
+			return g, false
+		}
+	}
+	for _, g := range chain {
+		l.counts[g.ID]++
+	}
+	return store.Group{}, true
+}
+
+// checkGroupPolicy 依次检查组链上的模型、预算与限流, 返回 HTTP 状态码与错误信息, 通过时状态码为 0
+func (h *Handler) checkGroupPolicy(ctx context.Context, chain []store.Group, model string) (int, string) {
+	for _, g := range chain {
+		if !g.AllowsModel(model) {
+			return http.StatusForbidden, fmt.Sprintf("model %s is not allowed for group %s", model, g.Name)
+		}
+	}
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for _, g := range chain {
+		if g.MonthlyBudget <= 0 {
+			continue
+		}
+		spend, err := h.store.GroupSpend(ctx, g.ID, monthStart)
+		if err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+		if spend >= g.MonthlyBudget {
+			return http.StatusTooManyRequests, fmt.Sprintf("group %s has exceeded its monthly budget", g.Name)
+		}
+	}
+	if g, ok := h.groupLimits.allow(chain); !ok {
+		return http.StatusTooManyRequests, fmt.Sprintf("group %s rate limit exceeded", g.Name)
+	}
+	return 0, ""
+}
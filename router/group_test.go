@@ -0,0 +1,73 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"opencatd-open/pkg/config"
+	"opencatd-open/store"
+	"testing"
+)
+
+// addGroupMember 创建组内用户并返回其 token
+func (s *testServer) addGroupMember(t *testing.T, root, name string, groupID uint) User {
+	t.Helper()
+	var u User
+	if code := s.do(t, http.MethodPost, "/1/users", root, map[string]string{"name": name}, &u); code != http.StatusOK {
+		t.Fatalf("add user %s: status %d", name, code)
+	}
+	if code := s.do(t, http.MethodPatch, fmt.Sprintf("/1/users/%d", u.ID), root, map[string]any{"groupId": groupID}, nil); code != http.StatusOK {
+		t.Fatalf("move %s to group %d: status %d", name, groupID, code)
+	}
+	return u
+}
+
+func TestGroupPolicyAppliesToAncestors(t *testing.T) {
+	up := newFakeUpstream(t)
+	cfg := config.Default()
+	cfg.Upstream.BaseURL = up.URL
+	s := newTestServer(t, cfg, Options{})
+	root := s.initRoot(t)
+	s.addTestKey(t, root, "k1", up.URL)
+
+	var parent, child, spender store.Group
+	if code := s.do(t, http.MethodPost, "/1/groups", root, map[string]any{"name": "eng", "models": []string{"gpt-4"}, "rateLimit": 2}, &parent); code != http.StatusOK {
+		t.Fatalf("add group: status %d", code)
+	}
+	if code := s.do(t, http.MethodPost, "/1/groups", root, map[string]any{"name": "eng-ml", "parentId": parent.ID}, &child); code != http.StatusOK {
+		t.Fatalf("add subgroup: status %d", code)
+	}
+	if code := s.do(t, http.MethodPatch, fmt.Sprintf("/1/groups/%d", parent.ID), root, map[string]any{"parentId": child.ID}, nil); code != http.StatusBadRequest {
+		t.Errorf("group cycle: status %d, want 400", code)
+	}
+	alice := s.addGroupMember(t, root, "alice", child.ID)
+
+	// 上级组的模型限制与共享限流对下级组成员生效
+	if code := s.do(t, http.MethodPost, "/v1/chat/completions", alice.Token, chatBody("gpt-3.5-turbo"), nil); code != http.StatusForbidden {
+		t.Errorf("model outside the group's list: status %d, want 403", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := s.do(t, http.MethodPost, "/v1/chat/completions", alice.Token, chatBody("gpt-4"), nil); code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, code)
+		}
+	}
+	if code := s.do(t, http.MethodPost, "/v1/chat/completions", alice.Token, chatBody("gpt-4"), nil); code != http.StatusTooManyRequests {
+		t.Errorf("over the group rate limit: status %d, want 429", code)
+	}
+
+	// 当月费用达到预算后拒绝
+	if code := s.do(t, http.MethodPost, "/1/groups", root, map[string]any{"name": "capped", "monthlyBudget": 1}, &spender); code != http.StatusOK {
+		t.Fatalf("add budget group: status %d", code)
+	}
+	bob := s.addGroupMember(t, root, "bob", spender.ID)
+	ctx := context.Background()
+	if err := s.store.Record(ctx, &store.Tokens{UserID: bob.ID, TotalTokens: 1, Cost: "1.5", Model: "gpt-4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store.SumDaily(ctx, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code := s.do(t, http.MethodPost, "/v1/chat/completions", bob.Token, chatBody("gpt-4"), nil); code != http.StatusTooManyRequests {
+		t.Errorf("over the monthly budget: status %d, want 429", code)
+	}
+}
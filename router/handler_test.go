@@ -0,0 +1,117 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"opencatd-open/pkg/config"
+	"opencatd-open/pkg/secret"
+	"opencatd-open/store"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestStore 打开内存 sqlite 上的 store
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+	st, err := store.Open(store.Config{
+		Driver:   store.DriverSQLite,
+		DSN:      ":memory:",
+		UsageDSN: ":memory:",
+		Keyring:  secret.NewKeyring(secret.GenerateMasterKey(1)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+// testServer 为挂载了全部路由的 Handler
+type testServer struct {
+	*Handler
+	engine *gin.Engine
+}
+
+func newTestServer(t *testing.T, cfg *config.Config, opts Options) *testServer {
+	t.Helper()
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	h := New(newTestStore(t), cfg, opts)
+	r := gin.New()
+	h.Register(r)
+	return &testServer{Handler: h, engine: r}
+}
+
+// do 发送请求并把 JSON 响应解码到 out (非 nil 时)
+func (s *testServer) do(t *testing.T, method, path, token string, body, out any) int {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+// initRoot 初始化 root 用户并返回其 token
+func (s *testServer) initRoot(t *testing.T) string {
+	t.Helper()
+	var root User
+	if code := s.do(t, http.MethodPost, "/1/users/init", "", nil, &root); code != http.StatusOK || root.Token == "" {
+		t.Fatalf("init: status %d, user %+v", code, root)
+	}
+	return root.Token
+}
+
+func TestHandlersAreIndependent(t *testing.T) {
+	// 两个 Handler 注册到同一个 Registerer 会因指标重名而 panic, 各自使用独立的 Registry
+	a := newTestServer(t, nil, Options{Registerer: prometheus.NewRegistry()})
+	b := newTestServer(t, nil, Options{Registerer: prometheus.NewRegistry()})
+	// 不传 Registerer 时指标不对外暴露, 也不会与其他 Handler 冲突
+	newTestServer(t, nil, Options{})
+
+	token := a.initRoot(t)
+	var me User
+	if code := a.do(t, http.MethodGet, "/1/me", token, nil, &me); code != http.StatusOK || me.Name != "root" {
+		t.Fatalf("GET /1/me on a: status %d, user %+v", code, me)
+	}
+	if code := b.do(t, http.MethodGet, "/1/me", token, nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("GET /1/me on b with a's token: status %d, want 401", code)
+	}
+	if code := a.do(t, http.MethodPost, "/1/users/init", "", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("second init: status %d, want 403", code)
+	}
+}
+
+func TestRateLimitIsPerHandler(t *testing.T) {
+	a := newTestServer(t, nil, Options{})
+	b := newTestServer(t, nil, Options{})
+	if !a.userLimits.allow(1, 1) || a.userLimits.allow(1, 1) {
+		t.Fatal("a: want the first request allowed and the second rejected")
+	}
+	if !b.userLimits.allow(1, 1) {
+		t.Fatal("b: limit must not be shared with a")
+	}
+}
@@ -0,0 +1,62 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BuildInfo struct {
+	Version        string `json:"version"`
+	GitCommit      string `json:"gitCommit,omitempty"`
+	BuildTime      string `json:"buildTime,omitempty"`
+	BuildGoVersion string `json:"goVersion,omitempty"`
+}
+
+// HandleHealthz 进程存活即返回 200
+func HandleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// HandleReadyz 检查数据库、是否存在可用的 owner (root) 以及可用 Key
+func (h *Handler) HandleReadyz(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+	if err := h.store.Ping(ctx); err != nil {
+		checks["database"] = err.Error()
+		ready = false
+	} else {
+		checks["database"] = "ok"
+	}
+
+	if _, err := h.store.GetOwner(ctx); err != nil {
+		checks["root"] = "not initialised"
+		ready = false
+	} else {
+		checks["root"] = "ok"
+	}
+
+	if h.store.KeyCount() == 0 {
+		checks["keys"] = "no api key available"
+		ready = false
+	} else {
+		checks["keys"] = "ok"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ready": ready, "checks": checks})
+}
+
+func HandleVersion(info BuildInfo) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, info)
+	}
+}
@@ -0,0 +1,51 @@
+package router
+
+import (
+	"net/http"
+	"opencatd-open/store"
+	"testing"
+)
+
+func TestAddKeyValidatesLikePatch(t *testing.T) {
+	s := newTestServer(t, nil, Options{})
+	root := s.initRoot(t)
+	for name, body := range map[string]map[string]any{
+		"scheme":      {"key": "sk-1", "name": "k1", "endpoint": "ftp://example.com"},
+		"host":        {"key": "sk-1", "name": "k1", "endpoint": "https://"},
+		"weight":      {"key": "sk-1", "name": "k1", "weight": 0},
+		"deployments": {"key": "sk-1", "name": "k1", "api_type": "azure_openai", "deployments": map[string]string{"gpt-4": " "}},
+		"empty key":   {"key": " ", "name": "k1"},
+		"empty name":  {"key": "sk-1", "name": " "},
+	} {
+		if code := s.do(t, http.MethodPost, "/1/keys?skip_validation=true", root, body, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, code)
+		}
+	}
+	if n := s.store.KeyCount(); n != 0 {
+		t.Fatalf("KeyCount = %d, want 0", n)
+	}
+
+	// 新建的 Azure Key 直接带上部署映射等字段, 无需再 PATCH
+	body := map[string]any{
+		"key": "az-1", "name": "Az1", "api_type": "azure_openai", "endpoint": "https://res.openai.azure.com/",
+		"deployments": map[string]string{"gpt-4": "gpt4-prod"}, "weight": 3, "enabled": false, "notes": "eu",
+	}
+	var k store.Key
+	if code := s.do(t, http.MethodPost, "/1/keys?skip_validation=true", root, body, &k); code != http.StatusOK {
+		t.Fatalf("add azure key: status %d", code)
+	}
+	if k.Name != "az1" || k.EndPoint != "https://res.openai.azure.com" || k.ResourceName != "res" {
+		t.Errorf("key = %+v", k)
+	}
+	if dep, ok := k.Deployment("gpt-4"); !ok || dep != "gpt4-prod" || k.Weight != 3 || k.Enabled || k.Notes != "eu" {
+		t.Errorf("deployment %q, weight %d, enabled %v, notes %q", dep, k.Weight, k.Enabled, k.Notes)
+	}
+
+	// 省略的字段使用默认值
+	if code := s.do(t, http.MethodPost, "/1/keys?skip_validation=true", root, map[string]any{"key": "sk-2", "name": "k2"}, &k); code != http.StatusOK {
+		t.Fatalf("add openai key: status %d", code)
+	}
+	if k.ApiType != "openai" || !k.Enabled || k.Weight != 1 {
+		t.Errorf("defaults: api_type %q, enabled %v, weight %d", k.ApiType, k.Enabled, k.Weight)
+	}
+}
@@ -0,0 +1,186 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"opencatd-open/pkg/azureopenai"
+	"opencatd-open/store"
+	"strings"
+	"time"
+
+	"github.com/Sakurasan/to"
+	"github.com/gin-gonic/gin"
+)
+
+const keyProbeTimeout = 15 * time.Second
+
+// KeyProbe 是一次 Key 探测的结果
+type KeyProbe struct {
+	OK         bool             `json:"ok"`
+	Models     []string         `json:"models,omitempty"`
+	LatencyMs  int64            `json:"latencyMs"`
+	Error      string           `json:"error,omitempty"`
+	Completion *CompletionProbe `json:"completion,omitempty"`
+}
+
+// CompletionProbe 是 1 token 补全请求的结果
+type CompletionProbe struct {
+	OK        bool   `json:"ok"`
+	Model     string `json:"model"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HandleTestKey 探测已保存的 Key: ?completion=true 时追加一次 1 token 的补全, ?model= 指定模型
+func (h *Handler) HandleTestKey(c *gin.Context) {
+	k, err := h.store.GetKeyByID(c.Request.Context(), uint(to.Int(c.Param("id"))))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid key id"})
+		return
+	}
+	apikey, err := h.store.KeySecret(*k)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, h.probeKey(c.Request.Context(), k, apikey, completionModel(c)))
+}
+
+// completionModel 返回需要补全探测的模型, 未要求时为空
+func completionModel(c *gin.Context) string {
+	if c.Query("completion") != "true" {
+		return ""
+	}
+	if m := c.Query("model"); m != "" {
+		return m
+	}
+	return GPT3Dot5Turbo
+}
+
+// probeKey 列出 Key 可访问的模型 (Azure 为部署), model 非空时再发送一次 1 token 补全
+func (h *Handler) probeKey(ctx context.Context, k *store.Key, apikey, model string) KeyProbe {
+	ctx, cancel := context.WithTimeout(withKeyTransport(ctx, k), keyProbeTimeout)
+	defer cancel()
+
+	var res KeyProbe
+	start := time.Now()
+	models, err := h.listKeyModels(ctx, k, apikey)
+	res.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.OK = true
+	res.Models = models
+
+	if model != "" {
+		cp := &CompletionProbe{Model: model}
+		start = time.Now()
+		err := h.probeCompletion(ctx, k, apikey, model)
+		cp.LatencyMs = time.Since(start).Milliseconds()
+		if err != nil {
+			cp.Error = err.Error()
+			res.OK = false
+		} else {
+			cp.OK = true
+		}
+		res.Completion = cp
+	}
+	return res
+}
+
+func azureEndpoint(k *store.Key) string {
+	if k.EndPoint != "" {
+		return strings.TrimSuffix(k.EndPoint, "/")
+	}
+	return fmt.Sprintf("https://%s.openai.azure.com", k.ResourceName)
+}
+
+func (h *Handler) openaiEndpoint(k *store.Key) string {
+	if k.EndPoint != "" {
+		return strings.TrimSuffix(k.EndPoint, "/")
+	}
+	return h.Config().Upstream.BaseURL
+}
+
+func (h *Handler) listKeyModels(ctx context.Context, k *store.Key, apikey string) ([]string, error) {
+	var models []string
+	if k.ApiType == "azure_openai" {
+		list, err := azureopenai.ModelsContext(ctx, h.current().client, azureEndpoint(k), apikey)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range list.Data {
+			models = append(models, d.ID)
+		}
+		return models, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.openaiEndpoint(k)+"/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apikey)
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := h.doProbe(req, &list); err != nil {
+		return nil, err
+	}
+	for _, m := range list.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
+func (h *Handler) probeCompletion(ctx context.Context, k *store.Key, apikey, model string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":      model,
+		"messages":   []ChatCompletionMessage{{Role: "user", Content: "ping"}},
+		"max_tokens": 1,
+	})
+	var url string
+	if k.ApiType == "azure_openai" {
+		deployment, ok := k.Deployment(model)
+		if !ok {
+			deployment = modelmap(model)
+		}
+		url = fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", azureEndpoint(k), deployment, h.Config().Upstream.AzureAPIVersion)
+	} else {
+		url = h.openaiEndpoint(k) + "/v1/chat/completions"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if k.ApiType == "azure_openai" {
+		req.Header.Set("api-key", apikey)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+apikey)
+	}
+	return h.doProbe(req, nil)
+}
+
+// doProbe 发送请求, 非 2xx 响应作为错误返回, out 非 nil 时解析 JSON 响应
+func (h *Handler) doProbe(req *http.Request, out interface{}) error {
+	resp, err := h.current().client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
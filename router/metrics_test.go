@@ -0,0 +1,113 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"opencatd-open/pkg/config"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newFakeUpstream 对任意路径返回一个非流式的 chat completion
+func newFakeUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"x","object":"chat.completion","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// addTestKey 添加一个指向 endpoint 的 openai Key
+func (s *testServer) addTestKey(t *testing.T, token, name, endpoint string) {
+	t.Helper()
+	body := map[string]any{"key": "sk-" + name, "name": name, "api_type": "openai", "endpoint": endpoint}
+	if code := s.do(t, http.MethodPost, "/1/keys", token, body, nil); code != http.StatusOK {
+		t.Fatalf("add key %s: status %d", name, code)
+	}
+}
+
+func chatBody(model string) map[string]any {
+	return map[string]any{"model": model, "messages": []map[string]string{{"role": "user", "content": "hi"}}}
+}
+
+func TestMetricsLabelsAreBounded(t *testing.T) {
+	up := newFakeUpstream(t)
+	cfg := config.Default()
+	cfg.Upstream.BaseURL = up.URL
+	reg := prometheus.NewRegistry()
+	s := newTestServer(t, cfg, Options{Registerer: reg})
+	token := s.initRoot(t)
+	s.addTestKey(t, token, "k1", up.URL)
+
+	for _, model := range []string{"gpt-4", "made-up-model-1", "made-up-model-2"} {
+		if code := s.do(t, http.MethodPost, "/v1/chat/completions", token, chatBody(model), nil); code != http.StatusOK {
+			t.Fatalf("chat %s: status %d", model, code)
+		}
+	}
+	// 其他路径只透传调用方自己的上游 Key
+	for _, path := range []string{"/v1/models", "/v1/no-such-route/1", "/v1/no-such-route/2"} {
+		if code := s.do(t, http.MethodGet, path, "sk-caller", nil, nil); code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, code)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, f := range families {
+		if f.GetName() != "opencatd_requests_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			got[labels["route"]+" "+labels["model"]] += m.GetCounter().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"/v1/chat/completions gpt-4": 1,
+		"/v1/chat/completions other": 2,
+		"/v1/models ":                1,
+		"other ":                     2,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("requests_total series = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("requests_total{%s} = %v, want %v", strings.TrimSpace(k), got[k], v)
+		}
+	}
+}
+
+func TestMetricsScrapeToken(t *testing.T) {
+	cfg := config.Default()
+	cfg.MetricsToken = "scrape-secret"
+	s := newTestServer(t, cfg, Options{})
+	s.engine.GET("/metrics", s.MetricsAuthMiddleware(), func(c *gin.Context) { c.Status(http.StatusOK) })
+	tests := []struct {
+		token string
+		want  int
+	}{
+		{"scrape-secret", http.StatusOK},
+		{"scrape-secreX", http.StatusUnauthorized},
+		{"scrape-secret-longer", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if code := s.do(t, http.MethodGet, "/metrics", tt.token, nil, nil); code != tt.want {
+			t.Errorf("token %q: status %d, want %d", tt.token, code, tt.want)
+		}
+	}
+}
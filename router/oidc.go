@@ -0,0 +1,174 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"opencatd-open/pkg/logger"
+	"opencatd-open/pkg/sso"
+	"opencatd-open/store"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// SessionCookie 保存 SSO 登录后的会话 token
+	SessionCookie = "opencatd_session"
+	// oidcStateCookie 在跳转 IdP 期间保存 "state.nonce"
+	oidcStateCookie  = "opencatd_oidc"
+	oidcCallbackPath = "/1/auth/oidc"
+)
+
+// SSOFromEnv 读取 OIDC_* 配置并校验角色映射, 未配置时返回 nil, SSO 路由返回 404
+func SSOFromEnv() (*sso.Client, error) {
+	cfg, err := sso.ConfigFromEnv()
+	if err != nil || cfg == nil {
+		return nil, err
+	}
+	for group, role := range cfg.RoleMap {
+		if !store.Role(role).Valid() {
+			return nil, fmt.Errorf("sso: invalid role %q for group %q", role, group)
+		}
+	}
+	if cfg.DefaultRole != "" && !store.Role(cfg.DefaultRole).Valid() {
+		return nil, fmt.Errorf("sso: invalid OIDC_DEFAULT_ROLE %q", cfg.DefaultRole)
+	}
+	return sso.NewClient(cfg), nil
+}
+
+// ssoRole 按组映射取权限最高的角色, 未匹配时使用默认角色, 返回空表示不允许登录
+func ssoRole(cfg *sso.Config, groups []string) store.Role {
+	var role store.Role
+	for _, g := range groups {
+		if r, ok := cfg.RoleMap[g]; ok && store.Role(r).Outranks(role) {
+			role = store.Role(r)
+		}
+	}
+	if role == "" {
+		role = store.Role(cfg.DefaultRole)
+	}
+	return role
+}
+
+// secureCookie 按回调地址判断站点是否经 HTTPS 访问. TLS 通常在反向代理处终止,
+// 不能以 c.Request.TLS 判断
+func secureCookie(cfg *sso.Config) bool {
+	return cfg != nil && strings.HasPrefix(cfg.RedirectURL, "https://")
+}
+
+// HandleOIDCLogin 跳转到 IdP 登录
+func (h *Handler) HandleOIDCLogin(c *gin.Context) {
+	cfg := h.sso.Config()
+	if !cfg.Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": sso.ErrDisabled.Error()})
+		return
+	}
+	state, nonce := uuid.NewString(), uuid.NewString()
+	url, err := h.sso.AuthCodeURL(c.Request.Context(), state, nonce)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Error("oidc login", "err", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state+"."+nonce, 600, oidcCallbackPath, "", secureCookie(cfg), true)
+	c.Redirect(http.StatusFound, url)
+}
+
+// HandleOIDCCallback 校验 IdP 回调, 首次登录时创建用户, 每次登录按组同步角色并签发会话
+func (h *Handler) HandleOIDCCallback(c *gin.Context) {
+	cfg := h.sso.Config()
+	if !cfg.Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": sso.ErrDisabled.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	lg := logger.FromContext(ctx)
+
+	stored, _ := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, oidcCallbackPath, "", secureCookie(cfg), true)
+	if e := c.Query("error"); e != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": e + ": " + c.Query("error_description")})
+		return
+	}
+	state, nonce, ok := strings.Cut(stored, ".")
+	if !ok || state == "" || c.Query("state") != state {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid oidc state"})
+		return
+	}
+	id, err := h.sso.Exchange(ctx, c.Query("code"), nonce)
+	if err != nil {
+		lg.Warn("oidc callback", "err", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	role := ssoRole(cfg, id.Groups)
+	if role == "" {
+		lg.Warn("oidc login denied, no role mapped", "sub", id.Subject, "groups", id.Groups)
+		c.JSON(http.StatusForbidden, gin.H{"error": "no opencatd role is mapped to your groups"})
+		return
+	}
+
+	u, err := h.store.GetUserBySubject(ctx, id.Subject)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		name := id.Username
+		if name == "" {
+			name = id.Email
+		}
+		if name == "" {
+			name = id.Subject
+		}
+		if _, err := h.store.GetUserByName(ctx, name); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "user name " + name + " is already taken by a local user"})
+			return
+		}
+		if u, err = h.store.ProvisionSSOUser(ctx, id.Subject, name, role); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(currentUserKey, u)
+		h.audit(c, AuditUserCreate, "user", u.ID, nil, toUser(u))
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	default:
+		if u.Disabled {
+			c.JSON(http.StatusForbidden, gin.H{"error": store.ErrUserDisabled.Error()})
+			return
+		}
+		c.Set(currentUserKey, u)
+		before := toUser(u)
+		if err := h.store.SyncSSORole(ctx, u, role); err != nil {
+			// 不因组变更而失去最后一个 owner, 保留原角色
+			lg.Warn("oidc role sync", "user", u.Name, "role", role, "err", err)
+		} else if before.Role != string(u.Role) {
+			h.audit(c, AuditUserSetRole, "user", u.ID, before, toUser(u))
+		}
+	}
+
+	token, err := h.store.CreateSession(ctx, u.ID, cfg.SessionTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	lg.Info("oidc login", "user", u.Name, "role", u.Role, "groups", id.Groups)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SessionCookie, token, int(cfg.SessionTTL.Seconds()), "/", "", secureCookie(cfg), true)
+	c.Redirect(http.StatusFound, cfg.PostLoginURL)
+}
+
+// HandleLogout 注销当前会话
+func (h *Handler) HandleLogout(c *gin.Context) {
+	if token, err := c.Cookie(SessionCookie); err == nil && token != "" {
+		if err := h.store.DeleteSession(c.Request.Context(), token); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.SetCookie(SessionCookie, "", -1, "/", "", secureCookie(h.sso.Config()), true)
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
@@ -0,0 +1,274 @@
+package router
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"opencatd-open/pkg/sso"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubIdP 是一个最小的 OIDC 提供方: discovery, JWKS 与 token 端点, 签发的 ID Token 使用 claims
+type stubIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]any
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &stubIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "use": "sig", "alg": "RS256", "kid": "test",
+			"n": b64(key.N.Bytes()),
+			"e": b64(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "at", "token_type": "Bearer", "expires_in": 3600,
+			"id_token": idp.sign(t),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// setClaims 设置下一次签发的 ID Token, 补齐 iss, aud 与有效期
+func (idp *stubIdP) setClaims(claims map[string]any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	now := time.Now()
+	full := map[string]any{"iss": idp.URL, "aud": "opencatd", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}
+	for k, v := range claims {
+		full[k] = v
+	}
+	idp.claims = full
+}
+
+func (idp *stubIdP) sign(t *testing.T) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(idp.claims)
+	signing := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signing + "." + b64(sig)
+}
+
+func newOIDCTestServer(t *testing.T, idp *stubIdP) *testServer {
+	t.Helper()
+	client := sso.NewClient(&sso.Config{
+		Issuer:       idp.URL,
+		ClientID:     "opencatd",
+		ClientSecret: "secret",
+		RedirectURL:  "http://cat.example.com/1/auth/oidc/callback",
+		Scopes:       []string{"openid"},
+		GroupsClaim:  "groups",
+		RoleMap:      map[string]string{"ai-admins": "admin"},
+		SessionTTL:   time.Hour,
+		PostLoginURL: "/",
+	})
+	return newTestServer(t, nil, Options{SSO: client})
+}
+
+// oidcLogin 请求登录跳转, 返回 IdP 地址中的 state 与 nonce 以及状态 cookie
+func (s *testServer) oidcLogin(t *testing.T) (state, nonce string, cookie *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d, body %s", w.Code, w.Body)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login did not set the state cookie")
+	}
+	return loc.Query().Get("state"), loc.Query().Get("nonce"), cookie
+}
+
+func (s *testServer) oidcCallback(t *testing.T, state, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/1/auth/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestOIDCRejectsStateMismatch(t *testing.T) {
+	idp := newStubIdP(t)
+	s := newOIDCTestServer(t, idp)
+	_, nonce, cookie := s.oidcLogin(t)
+	idp.setClaims(map[string]any{"sub": "u-1", "nonce": nonce, "groups": []string{"ai-admins"}})
+
+	if w := s.oidcCallback(t, "forged-state", "good-code", cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("forged state: status %d, want 400", w.Code)
+	}
+	state, _, _ := s.oidcLogin(t)
+	if w := s.oidcCallback(t, state, "good-code", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("missing state cookie: status %d, want 400", w.Code)
+	}
+}
+
+func TestOIDCRejectsNonceMismatch(t *testing.T) {
+	idp := newStubIdP(t)
+	s := newOIDCTestServer(t, idp)
+	state, _, cookie := s.oidcLogin(t)
+	idp.setClaims(map[string]any{"sub": "u-1", "nonce": "replayed-nonce", "groups": []string{"ai-admins"}})
+
+	w := s.oidcCallback(t, state, "good-code", cookie)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("nonce mismatch: status %d, want 401", w.Code)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookie && c.Value != "" {
+			t.Error("session issued despite nonce mismatch")
+		}
+	}
+}
+
+func TestOIDCLoginCreatesSessionAndLinksUser(t *testing.T) {
+	idp := newStubIdP(t)
+	s := newOIDCTestServer(t, idp)
+	s.initRoot(t)
+
+	login := func() *http.Cookie {
+		t.Helper()
+		state, nonce, cookie := s.oidcLogin(t)
+		idp.setClaims(map[string]any{"sub": "u-1", "nonce": nonce, "preferred_username": "alice", "groups": []string{"ai-admins"}})
+		w := s.oidcCallback(t, state, "good-code", cookie)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+			t.Fatalf("callback: status %d, location %q, body %s", w.Code, w.Header().Get("Location"), w.Body)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == SessionCookie && c.Value != "" {
+				return c
+			}
+		}
+		t.Fatal("callback did not set a session cookie")
+		return nil
+	}
+	me := func(session *http.Cookie) User {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/1/me", nil)
+		req.AddCookie(session)
+		w := httptest.NewRecorder()
+		s.engine.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("/1/me with session: status %d", w.Code)
+		}
+		var u User
+		if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	first := me(login())
+	if first.Name != "alice" || first.Role != "admin" {
+		t.Fatalf("provisioned user = %+v, want alice with the admin role", first)
+	}
+	u, err := s.store.GetUserBySubject(context.Background(), "u-1")
+	if err != nil || int(u.ID) != first.ID {
+		t.Fatalf("user not linked to the OIDC subject: %v, %v", u, err)
+	}
+	// 再次登录复用同一用户, 不重复创建
+	second := me(login())
+	if second.ID != first.ID {
+		t.Errorf("second login user id = %d, want %d", second.ID, first.ID)
+	}
+	users, err := s.store.GetAllUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("users = %d, want root and alice", len(users))
+	}
+}
+
+// 注销时清除会话 cookie 的属性与登录时一致, TLS 在反向代理处终止时同样带 Secure
+func TestLogoutCookieIsSecureBehindProxy(t *testing.T) {
+	client := sso.NewClient(&sso.Config{
+		Issuer:      "https://idp.example.com",
+		ClientID:    "opencatd",
+		RedirectURL: "https://cat.example.com/1/auth/oidc/callback",
+		SessionTTL:  time.Hour,
+	})
+	s := newTestServer(t, nil, Options{SSO: client})
+	s.initRoot(t)
+	root, err := s.store.GetUserByName(context.Background(), "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := s.store.CreateSession(context.Background(), root.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/1/auth/logout", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session})
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("logout: status %d, body %s", w.Code, w.Body)
+	}
+	var cleared *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookie {
+			cleared = c
+		}
+	}
+	if cleared == nil || !cleared.Secure || !cleared.HttpOnly || cleared.MaxAge >= 0 {
+		t.Errorf("logout cookie = %+v, want a cleared Secure HttpOnly cookie", cleared)
+	}
+}
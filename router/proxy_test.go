@@ -0,0 +1,101 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"opencatd-open/pkg/config"
+	"sync"
+	"testing"
+)
+
+// recordingUpstream 记录收到的请求头, 返回一个固定的对话响应
+type recordingUpstream struct {
+	*httptest.Server
+	mu      sync.Mutex
+	headers []http.Header
+}
+
+func newRecordingUpstream(t *testing.T) *recordingUpstream {
+	t.Helper()
+	up := &recordingUpstream{}
+	up.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		up.mu.Lock()
+		up.headers = append(up.headers, r.Header.Clone())
+		up.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"x","object":"chat.completion","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":"hi"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+	}))
+	t.Cleanup(up.Close)
+	return up
+}
+
+func (up *recordingUpstream) requests() []http.Header {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return append([]http.Header(nil), up.headers...)
+}
+
+// proxyWithCookie 以 token 与会话 cookie 发送代理请求
+func (s *testServer) proxyWithCookie(t *testing.T, path, token string, body any) int {
+	t.Helper()
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: "session-secret"})
+	w := httptest.NewRecorder()
+	s.engine.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestLocalCredentialsNotForwarded(t *testing.T) {
+	for _, apiType := range []string{"openai", "azure_openai"} {
+		t.Run(apiType, func(t *testing.T) {
+			up := newRecordingUpstream(t)
+			cfg := config.Default()
+			cfg.Upstream.BaseURL = up.URL
+			s := newTestServer(t, cfg, Options{})
+			root := s.initRoot(t)
+			body := map[string]any{"key": "sk-site", "name": "k1", "api_type": apiType, "endpoint": up.URL}
+			if code := s.do(t, http.MethodPost, "/1/keys?skip_validation=true", root, body, nil); code != http.StatusOK {
+				t.Fatalf("add key: status %d", code)
+			}
+
+			if code := s.proxyWithCookie(t, "/v1/chat/completions", root, chatBody("gpt-4")); code != http.StatusOK {
+				t.Fatalf("chat: status %d", code)
+			}
+			got := up.requests()
+			if len(got) != 1 {
+				t.Fatalf("upstream requests = %d, want 1", len(got))
+			}
+			h := got[0]
+			if h.Get("Cookie") != "" {
+				t.Errorf("upstream Cookie = %q", h.Get("Cookie"))
+			}
+			switch apiType {
+			case "azure_openai":
+				if h.Get("api-key") != "sk-site" || h.Get("Authorization") != "" {
+					t.Errorf("upstream api-key %q, Authorization %q", h.Get("api-key"), h.Get("Authorization"))
+				}
+			default:
+				if h.Get("Authorization") != "Bearer sk-site" {
+					t.Errorf("upstream Authorization = %q, want the site key", h.Get("Authorization"))
+				}
+			}
+
+			// 不经站点 Key 的路径不得把本地 token 透传到上游
+			for _, path := range []string{"/v1/completions", "/v1/models"} {
+				if code := s.proxyWithCookie(t, path, root, chatBody("gpt-4")); code != http.StatusNotFound {
+					t.Errorf("%s: status %d, want 404", path, code)
+				}
+			}
+			if n := len(up.requests()); n != 1 {
+				t.Errorf("upstream requests = %d, want 1", n)
+			}
+		})
+	}
+}
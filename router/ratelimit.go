@@ -0,0 +1,29 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// userLimiter 是按用户计数的固定一分钟窗口限流, 上限来自配置 rateLimit.perUser.
+// 计数只在本进程内, 多个实例时每个实例各自限流
+type userLimiter struct {
+	mu     sync.Mutex
+	window int64
+	counts map[uint]int
+}
+
+// allow 在用户本分钟的请求数未达到 limit 时计数一次并返回 true
+func (l *userLimiter) allow(id uint, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w := time.Now().Unix() / 60; w != l.window {
+		l.window = w
+		l.counts = map[uint]int{}
+	}
+	if l.counts[id] >= limit {
+		return false
+	}
+	l.counts[id]++
+	return true
+}
@@ -0,0 +1,62 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"opencatd-open/pkg/config"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReloadAppliesToLaterRequests(t *testing.T) {
+	up := newFakeUpstream(t)
+	cfg := config.Default()
+	cfg.Upstream.BaseURL = up.URL
+	cfg.Pricing = map[string]config.Price{"gpt-4": {}}
+	s := newTestServer(t, cfg, Options{})
+	root := s.initRoot(t)
+	s.addTestKey(t, root, "k1", up.URL)
+	var me User
+	s.do(t, http.MethodGet, "/1/me", root, nil, &me)
+
+	spent := func() float64 {
+		t.Helper()
+		if code := s.do(t, http.MethodPost, "/v1/chat/completions", root, chatBody("gpt-4"), nil); code != http.StatusOK {
+			t.Fatalf("chat: status %d", code)
+		}
+		s.inflight.Wait()
+		today := time.Now().UTC()
+		u, err := s.store.QueryUserUsage(context.Background(), strconv.Itoa(me.ID), today.Format("2006-01-02"), today.AddDate(0, 0, 1).Format("2006-01-02"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, _ := strconv.ParseFloat(u.Cost, 64)
+		return f
+	}
+	if got := spent(); got != 0 {
+		t.Fatalf("cost before reload = %v, want 0", got)
+	}
+	client := s.current().client
+
+	// 只改价格表时沿用原客户端与连接池
+	next := *cfg
+	next.Pricing = map[string]config.Price{"gpt-4": {Prompt: 1000, Completion: 1000}}
+	s.Reload(&next)
+	if s.current().client != client {
+		t.Error("client replaced although upstream settings did not change")
+	}
+	if got := spent(); got <= 0 {
+		t.Errorf("cost after reload = %v, want the new price applied", got)
+	}
+
+	changed := next
+	changed.Upstream.ChunkIdleTimeout = config.Duration(time.Second)
+	s.Reload(&changed)
+	if s.current().client == client {
+		t.Error("client kept although upstream settings changed")
+	}
+	if s.Config().Upstream.ChunkIdleTimeout.Std() != time.Second {
+		t.Errorf("Config() = %+v", s.Config().Upstream)
+	}
+}
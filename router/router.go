@@ -3,19 +3,26 @@ package router
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
-	"opencatd-open/pkg/azureopenai"
+	"net/url"
+	"opencatd-open/pkg/config"
+	"opencatd-open/pkg/logger"
+	"opencatd-open/pkg/metrics"
+	"opencatd-open/pkg/sso"
+	"opencatd-open/pkg/tracing"
 	"opencatd-open/store"
-	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sakurasan/to"
@@ -23,25 +30,50 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/pkoukk/tiktoken-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
 var (
-	rootToken     string
-	baseUrl       = "https://api.openai.com"
 	GPT3Dot5Turbo = "gpt-3.5-turbo"
 	GPT4          = "gpt-4"
-	client        = getHttpClient()
 )
 
 type User struct {
-	IsDelete  bool   `json:"IsDelete,omitempty"`
 	ID        int    `json:"id,omitempty"`
 	UpdatedAt string `json:"updatedAt,omitempty"`
 	Name      string `json:"name,omitempty"`
 	Token     string `json:"token,omitempty"`
-	CreatedAt string `json:"createdAt,omitempty"`
+	// TokenPrefix 用于辨认 token, 完整 token 只在创建或重置时返回一次
+	TokenPrefix string `json:"tokenPrefix,omitempty"`
+	Role        string `json:"role,omitempty"`
+	GroupID     *uint  `json:"groupId,omitempty"`
+	Disabled    bool   `json:"disabled"`
+	CreatedAt   string `json:"createdAt,omitempty"`
+}
+
+func toUser(u *store.User) User {
+	return User{
+		ID:          int(u.ID),
+		UpdatedAt:   u.UpdatedAt.Format(time.RFC3339),
+		Name:        u.Name,
+		TokenPrefix: u.TokenPrefix,
+		Role:        string(u.Role),
+		GroupID:     u.GroupID,
+		Disabled:    u.Disabled,
+		CreatedAt:   u.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// withToken 返回携带一次性明文 token 的用户信息
+func withToken(u *store.User, token string) User {
+	res := toUser(u)
+	res.Token = token
+	return res
 }
 
 type Key struct {
@@ -52,6 +84,15 @@ type Key struct {
 	Endpoint  string `json:"endpoint,omitempty"`
 	UpdatedAt string `json:"updatedAt,omitempty"`
 	CreatedAt string `json:"createdAt,omitempty"`
+	// InsecureSkipVerify 为 true 时不校验该 Key 上游的证书, 会记录警告
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// Transport 为该 Key 的代理、超时与 HTTP/2 设置
+	Transport *store.KeyTransport `json:"transport,omitempty"`
+	// 以下字段与 PATCH /1/keys/:id 相同, 省略时使用默认值
+	Deployments *map[string]string `json:"deployments,omitempty"`
+	Enabled     *bool              `json:"enabled,omitempty"`
+	Weight      *int               `json:"weight,omitempty"`
+	Notes       *string            `json:"notes,omitempty"`
 }
 
 type ChatCompletionMessage struct {
@@ -94,117 +135,204 @@ type ChatCompletionResponse struct {
 	} `json:"usage"`
 }
 
-func init() {
-	if openai_endpoint := os.Getenv("openai_endpoint"); openai_endpoint != "" {
-		log.Println(fmt.Sprintf("replace %s to %s", baseUrl, openai_endpoint))
-		baseUrl = openai_endpoint
+// Handler 持有路由依赖的 store、当前配置与各请求共享的状态, 由 New 创建并注册为 gin 的处理函数
+type Handler struct {
+	store   *store.Store
+	rt      atomic.Pointer[runtimeConfig]
+	metrics *metrics.Metrics
+	sso     *sso.Client
+
+	// inflight 跟踪进行中的代理请求(包括其用量写入), 供优雅退出时等待
+	inflight    sync.WaitGroup
+	userLimits  *userLimiter
+	groupLimits *groupLimiter
+}
+
+// runtimeConfig 为一份配置及据其创建的上游客户端, 重载时整体替换.
+// 每个请求开始时取一次, 进行中的请求 (包括流式输出) 始终使用自己的那份
+type runtimeConfig struct {
+	cfg    *config.Config
+	client *http.Client
+}
+
+// Options 为 Handler 的可选依赖
+type Options struct {
+	// Registerer 用于注册指标, 为 nil 时指标不对外暴露
+	Registerer prometheus.Registerer
+	// SSO 为 OIDC 客户端, 为 nil 时 SSO 路由返回 404
+	SSO *sso.Client
+}
+
+func New(st *store.Store, cfg *config.Config, opts Options) *Handler {
+	h := &Handler{
+		store:       st,
+		metrics:     metrics.New(opts.Registerer),
+		sso:         opts.SSO,
+		userLimits:  &userLimiter{counts: map[uint]int{}},
+		groupLimits: &groupLimiter{counts: map[uint]int{}},
 	}
+	h.rt.Store(&runtimeConfig{cfg: cfg, client: newHTTPClient(cfg.Upstream)})
+	h.metrics.RegisterGaugeFunc("keys_available", "Upstream keys currently in rotation.", func() float64 {
+		return float64(h.store.KeyCount())
+	})
+	return h
 }
 
-func AuthMiddleware() gin.HandlerFunc {
+func (h *Handler) current() *runtimeConfig {
+	return h.rt.Load()
+}
+
+// Config 返回当前生效的配置
+func (h *Handler) Config() *config.Config {
+	return h.current().cfg
+}
+
+// Reload 原子替换配置, 之后的请求使用新配置; 上游参数未变时沿用原客户端以保留连接池
+func (h *Handler) Reload(cfg *config.Config) {
+	prev := h.current()
+	next := &runtimeConfig{cfg: cfg, client: prev.client}
+	if !reflect.DeepEqual(prev.cfg.Upstream, cfg.Upstream) {
+		next.client = newHTTPClient(cfg.Upstream)
+	}
+	h.rt.Store(next)
+	if next.client != prev.client {
+		// 只关闭空闲连接, 进行中的请求不受影响
+		prev.client.CloseIdleConnections()
+	}
+}
+
+// MetricsAuthMiddleware 允许具备 admin:read 权限的用户 token 或配置的 metricsToken 访问 /metrics
+func (h *Handler) MetricsAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if rootToken == "" {
-			u, err := store.GetUserByID(uint(1))
-			if err != nil {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-				c.Abort()
-				return
-			}
-			rootToken = u.Token
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		if scrape := h.Config().MetricsToken; scrape != "" && subtle.ConstantTimeCompare([]byte(token), []byte(scrape)) == 1 {
+			c.Next()
+			return
+		}
+		cred, err := h.store.Authenticate(c.Request.Context(), token)
+		if err != nil || !cred.Allows(store.ScopeAdmin) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
 		}
+		u, err := h.store.GetUserByID(c.Request.Context(), cred.UserID)
+		if err != nil || !u.Role.Can(store.PermAdminRead) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+const (
+	currentUserKey       = "current_user"
+	currentCredentialKey = "current_credential"
+)
+
+// AuthMiddleware 校验 Bearer token 或 SSO 会话 cookie 并把当前用户放入 context, 权限由 RequirePermission 检查
+func (h *Handler) AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var cred *store.Credential
+		var err error
 		token := c.GetHeader("Authorization")
-		if token == "" || token[:7] != "Bearer " {
+		if len(token) >= 7 && token[:7] == "Bearer " {
+			cred, err = h.store.Authenticate(c.Request.Context(), token[7:])
+		} else if session, _ := c.Cookie(SessionCookie); session != "" {
+			cred, err = h.store.AuthenticateSession(c.Request.Context(), session)
+		} else {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
-		if store.IsExistAuthCache(token[7:]) {
-			if strings.HasPrefix(c.Request.URL.Path, "/1/me") {
-				c.Next()
-				return
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) && !errors.Is(err, store.ErrTokenExpired) && !errors.Is(err, store.ErrUserDisabled) {
+				logger.FromContext(c.Request.Context()).Error("authenticate", "err", err)
 			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
 		}
-		if token[7:] != rootToken {
-			u, err := store.GetUserByID(uint(1))
-			if err != nil {
-				log.Println(err)
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-				c.Abort()
-				return
-			}
-			if token[:7] != u.Token {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-				c.Abort()
-				return
-			}
-			rootToken = u.Token
-			store.LoadAuthCache()
+		u, err := h.store.GetUserByID(c.Request.Context(), cred.UserID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
 		}
-		// 可以在这里对 token 进行验证并检查权限
+		c.Set(currentUserKey, u)
+		c.Set(currentCredentialKey, cred)
+		c.Next()
+	}
+}
 
+// RequireScope 要求所用 token 带有 scope; 用户主 token 与 SSO 会话拥有全部 scope
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cred := currentCredential(c); cred == nil || !cred.Allows(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
 
-func Handleinit(c *gin.Context) {
-	user, err := store.GetUserByID(1)
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			u := store.User{Name: "root", Token: uuid.NewString()}
-			u.ID = 1
-			if err := store.CreateUser(&u); err != nil {
-				c.JSON(http.StatusForbidden, gin.H{
-					"error": err.Error(),
-				})
-				return
-			} else {
-				rootToken = u.Token
-				resJSON := User{
-					false,
-					int(u.ID),
-					u.UpdatedAt.Format(time.RFC3339),
-					u.Name,
-					u.Token,
-					u.CreatedAt.Format(time.RFC3339),
-				}
-				c.JSON(http.StatusOK, resJSON)
-				return
-			}
+// RequirePermission 要求当前用户的角色具备 perm, 且所用 token 带有 admin scope
+func RequirePermission(perm store.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := currentUser(c)
+		cred := currentCredential(c)
+		if u == nil || cred == nil || !cred.Allows(store.ScopeAdmin) || !u.Role.Can(perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"error": err.Error(),
-		})
-		return
+		c.Next()
 	}
-	if user.ID == uint(1) {
-		c.JSON(http.StatusForbidden, gin.H{
-			"error": "super user already exists, use cli to reset password",
-		})
+}
+
+func currentUser(c *gin.Context) *store.User {
+	if v, ok := c.Get(currentUserKey); ok {
+		return v.(*store.User)
 	}
+	return nil
 }
 
-func HandleMe(c *gin.Context) {
-	token := c.GetHeader("Authorization")
-	u, err := store.GetUserByToken(token[7:])
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
+func currentCredential(c *gin.Context) *store.Credential {
+	if v, ok := c.Get(currentCredentialKey); ok {
+		return v.(*store.Credential)
+	}
+	return nil
+}
+
+// canManageUser 只有 owner 可以管理 owner 账号
+func canManageUser(actor, target *store.User) bool {
+	if target.Role == store.RoleOwner {
+		return actor.Role.Can(store.PermOwnersWrite)
+	}
+	return actor.Role.Can(store.PermUsersWrite)
+}
+
+// Handleinit 在尚无 owner 时创建 root 用户并返回其 token
+func (h *Handler) Handleinit(c *gin.Context) {
+	token := uuid.NewString()
+	u := store.User{Name: "root", Token: token}
+	if err := h.store.CreateFirstOwner(c.Request.Context(), &u); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
 			"error": err.Error(),
 		})
+		return
 	}
+	c.JSON(http.StatusOK, withToken(&u, token))
+}
 
-	resJSON := User{
-		false,
-		int(u.ID),
-		u.UpdatedAt.Format(time.RFC3339),
-		u.Name,
-		u.Token,
-		u.CreatedAt.Format(time.RFC3339),
-	}
-	c.JSON(http.StatusOK, resJSON)
+func HandleMe(c *gin.Context) {
+	c.JSON(http.StatusOK, toUser(currentUser(c)))
 }
 
-func HandleMeUsage(c *gin.Context) {
-	token := c.GetHeader("Authorization")
+func (h *Handler) HandleMeUsage(c *gin.Context) {
 	fromStr := c.Query("from")
 	toStr := c.Query("to")
 	getMonthStartAndEnd := func() (start, end string) {
@@ -223,12 +351,8 @@ func HandleMeUsage(c *gin.Context) {
 	if fromStr == "" || toStr == "" {
 		fromStr, toStr = getMonthStartAndEnd()
 	}
-	user, err := store.GetUserByToken(token)
-	if err != nil {
-		c.AbortWithError(http.StatusForbidden, err)
-		return
-	}
-	usage, err := store.QueryUserUsage(to.String(user.ID), fromStr, toStr)
+	user := currentUser(c)
+	usage, err := h.store.QueryUserUsage(c.Request.Context(), to.String(user.ID), fromStr, toStr)
 	if err != nil {
 		c.AbortWithError(http.StatusForbidden, err)
 		return
@@ -237,8 +361,8 @@ func HandleMeUsage(c *gin.Context) {
 	c.JSON(200, usage)
 }
 
-func HandleKeys(c *gin.Context) {
-	keys, err := store.GetAllKeys()
+func (h *Handler) HandleKeys(c *gin.Context) {
+	keys, err := h.store.GetAllKeys(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"error": err.Error(),
@@ -248,8 +372,8 @@ func HandleKeys(c *gin.Context) {
 	c.JSON(http.StatusOK, keys)
 }
 
-func HandleUsers(c *gin.Context) {
-	users, err := store.GetAllUsers()
+func (h *Handler) HandleUsers(c *gin.Context) {
+	users, err := h.store.GetAllUsers(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"error": err.Error(),
@@ -259,7 +383,7 @@ func HandleUsers(c *gin.Context) {
 	c.JSON(http.StatusOK, users)
 }
 
-func HandleAddKey(c *gin.Context) {
+func (h *Handler) HandleAddKey(c *gin.Context) {
 	var body Key
 	if err := c.BindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
@@ -267,79 +391,108 @@ func HandleAddKey(c *gin.Context) {
 		}})
 		return
 	}
-	body.Name = strings.ToLower(strings.TrimSpace(body.Name))
-	body.Key = strings.TrimSpace(body.Key)
-	if strings.HasPrefix(body.Name, "azure.") {
-		keynames := strings.Split(body.Name, ".")
-		if len(keynames) < 2 {
+	apiType, resourceName := body.ApiType, ""
+	if name := strings.ToLower(strings.TrimSpace(body.Name)); strings.HasPrefix(name, "azure.") {
+		// 兼容以 azure.<资源名> 命名的 Azure Key
+		apiType, resourceName = "azure_openai", strings.Split(name, ".")[1]
+	} else if apiType == "" {
+		apiType = "openai"
+	}
+	// 与 PATCH 使用相同的校验
+	req := KeyPatchReq{
+		Key:                &body.Key,
+		Name:               &body.Name,
+		ApiType:            &apiType,
+		Endpoint:           &body.Endpoint,
+		Deployments:        body.Deployments,
+		Enabled:            body.Enabled,
+		Weight:             body.Weight,
+		Notes:              body.Notes,
+		InsecureSkipVerify: &body.InsecureSkipVerify,
+		Transport:          body.Transport,
+	}
+	patch, err := req.toPatch(&store.Key{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
+			"message": err.Error(),
+		}})
+		return
+	}
+	k := newKey(patch)
+	if k.ResourceName == "" {
+		k.ResourceName = resourceName
+	}
+	if k.InsecureSkipVerify {
+		logger.FromContext(c.Request.Context()).Warn("upstream certificate verification disabled for key", "key", k.Name)
+	}
+
+	// 保存前探测 Key 是否可用, ?skip_validation=true 跳过
+	if c.Query("skip_validation") != "true" {
+		probe := h.probeKey(c.Request.Context(), k, k.Key, completionModel(c))
+		if !probe.OK {
+			msg := probe.Error
+			if probe.Completion != nil && probe.Completion.Error != "" {
+				msg = probe.Completion.Error
+			}
 			c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
-				"message": "Invalid Key Name",
-			}})
+				"message": "key validation failed: " + msg,
+			}, "probe": probe})
 			return
 		}
-		k := &store.Key{
-			ApiType:      "azure_openai",
-			Name:         body.Name,
-			Key:          body.Key,
-			ResourceNmae: keynames[1],
-			EndPoint:     body.Endpoint,
+	}
+	if err := h.store.CreateKey(c.Request.Context(), k); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrKeyExists) {
+			status = http.StatusConflict
 		}
-		if err := store.CreateKey(k); err != nil {
+		c.JSON(status, gin.H{"error": gin.H{
+			"message": err.Error(),
+		}})
+		return
+	}
+
+	// enabled 列默认为 true, 创建时写入 false 会被忽略, 因此单独更新
+	if body.Enabled != nil && !*body.Enabled {
+		if err := h.store.UpdateKey(c.Request.Context(), k.ID, store.KeyPatch{Enabled: body.Enabled}); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{
 				"message": err.Error(),
 			}})
 			return
 		}
-	} else {
-		if body.ApiType == "" {
-			if err := store.AddKey("openai", body.Key, body.Name); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{
-					"message": err.Error(),
-				}})
-				return
-			}
-		} else {
-			k := &store.Key{
-				ApiType:      body.ApiType,
-				Name:         body.Name,
-				Key:          body.Key,
-				ResourceNmae: azureopenai.GetResourceName(body.Endpoint),
-				EndPoint:     body.Endpoint,
-			}
-			if err := store.CreateKey(k); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{
-					"message": err.Error(),
-				}})
-				return
-			}
-		}
-
 	}
 
-	k, err := store.GetKeyrByName(body.Name)
+	k, err = h.store.GetKeyByID(c.Request.Context(), k.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": gin.H{
 			"message": err.Error(),
 		}})
 		return
 	}
+	h.audit(c, AuditKeyCreate, "key", k.ID, nil, k)
 	c.JSON(http.StatusOK, k)
 }
 
-func HandleDelKey(c *gin.Context) {
+func (h *Handler) HandleDelKey(c *gin.Context) {
 	id := to.Int(c.Param("id"))
 	if id < 1 {
 		c.JSON(http.StatusOK, gin.H{"error": "invalid key id"})
 		return
 	}
-	if err := store.DeleteKey(uint(id)); err != nil {
+	k, err := h.store.GetKeyByID(c.Request.Context(), uint(id))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": "invalid key id"})
+		return
+	}
+	if err := h.store.DeleteKey(c.Request.Context(), uint(id)); err != nil {
 		c.JSON(http.StatusOK, gin.H{"error": "invalid key id"})
 		return
 	}
+	h.pruneTransports(c.Request.Context())
+	h.audit(c, AuditKeyDelete, "key", k.ID, k, nil)
 	c.JSON(http.StatusOK, gin.H{"message": "ok"})
 }
 
-func HandleAddUser(c *gin.Context) {
+func (h *Handler) HandleAddUser(c *gin.Context) {
 	var body User
 	if err := c.BindJSON(&body); err != nil {
 		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
@@ -349,76 +502,156 @@ func HandleAddUser(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"error": "invalid user name"})
 		return
 	}
+	role := store.Role(body.Role)
+	if role == "" {
+		role = store.RoleMember
+	}
+	if !role.Valid() {
+		c.JSON(http.StatusOK, gin.H{"error": "invalid role"})
+		return
+	}
+	if role == store.RoleOwner && !currentUser(c).Role.Can(store.PermOwnersWrite) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
 
-	if err := store.AddUser(body.Name, uuid.NewString()); err != nil {
+	token := uuid.NewString()
+	if err := h.store.AddUser(c.Request.Context(), body.Name, token, role); err != nil {
 		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
 		return
 	}
-	u, err := store.GetUserByName(body.Name)
+	u, err := h.store.GetUserByName(c.Request.Context(), body.Name)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, u)
+	h.audit(c, AuditUserCreate, "user", u.ID, nil, toUser(u))
+	c.JSON(http.StatusOK, withToken(u, token))
 }
 
-func HandleDelUser(c *gin.Context) {
+func (h *Handler) HandleDelUser(c *gin.Context) {
 	id := to.Int(c.Param("id"))
-	if id <= 1 {
-		c.JSON(http.StatusOK, gin.H{"error": "invalid user id"})
+	target, err := h.store.GetUserByID(c.Request.Context(), uint(id))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
+	if !canManageUser(currentUser(c), target) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
 		return
 	}
-	if err := store.DeleteUser(uint(id)); err != nil {
+	if err := h.store.DeleteUser(c.Request.Context(), uint(id)); err != nil {
 		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
 		return
 	}
+	h.audit(c, AuditUserDelete, "user", target.ID, toUser(target), nil)
 
 	c.JSON(http.StatusOK, gin.H{"message": "ok"})
 }
 
-func HandleResetUserToken(c *gin.Context) {
+func (h *Handler) HandleResetUserToken(c *gin.Context) {
 	id := to.Int(c.Param("id"))
+	target, err := h.store.GetUserByID(c.Request.Context(), uint(id))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if !canManageUser(currentUser(c), target) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
 
-	if err := store.UpdateUser(uint(id), uuid.NewString()); err != nil {
+	token := uuid.NewString()
+	if err := h.store.UpdateUser(c.Request.Context(), uint(id), token); err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
 	}
-	u, err := store.GetUserByID(uint(id))
+	u, err := h.store.GetUserByID(c.Request.Context(), uint(id))
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
 	}
-	if u.ID == uint(1) {
-		rootToken = u.Token
+	h.audit(c, AuditUserResetToken, "user", u.ID, toUser(target), toUser(u))
+	c.JSON(http.StatusOK, withToken(u, token))
+}
+
+func (h *Handler) HandleSetUserRole(c *gin.Context) {
+	id := to.Int(c.Param("id"))
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
+	role := store.Role(body.Role)
+	if !role.Valid() {
+		c.JSON(http.StatusOK, gin.H{"error": "invalid role"})
+		return
+	}
+	target, err := h.store.GetUserByID(c.Request.Context(), uint(id))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
+	actor := currentUser(c)
+	if !canManageUser(actor, target) || (role == store.RoleOwner && !actor.Role.Can(store.PermOwnersWrite)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+	if err := h.store.UpdateUserRole(c.Request.Context(), target.ID, role); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := h.store.GetUserByID(c.Request.Context(), target.ID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
 	}
+	h.audit(c, AuditUserSetRole, "user", u.ID, toUser(target), toUser(u))
 	c.JSON(http.StatusOK, u)
 }
 
-func GenerateToken() string {
-	token := uuid.New()
-	return token.String()
+func (h *Handler) HandleDisableUser(c *gin.Context) {
+	h.setUserDisabled(c, true)
 }
 
-func getHttpClient() *http.Client {
-	tr := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+func (h *Handler) HandleEnableUser(c *gin.Context) {
+	h.setUserDisabled(c, false)
+}
+
+// setUserDisabled 禁用后用户的所有 token 立即失效, 历史用量仍归属该用户
+func (h *Handler) setUserDisabled(c *gin.Context, disabled bool) {
+	target, ok := h.manageableUser(c)
+	if !ok {
+		return
+	}
+	if err := h.store.SetUserDisabled(c.Request.Context(), target.ID, disabled); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
 	}
-	return &http.Client{Transport: tr}
+	u, err := h.store.GetUserByID(c.Request.Context(), target.ID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
+	action := AuditUserEnable
+	if disabled {
+		action = AuditUserDisable
+	}
+	h.audit(c, action, "user", u.ID, toUser(target), toUser(u))
+	c.JSON(http.StatusOK, toUser(u))
+}
+
+func GenerateToken() string {
+	token := uuid.New()
+	return token.String()
 }
 
-func HandleProy(c *gin.Context) {
+func (h *Handler) HandleProy(c *gin.Context) {
 	var (
 		localuser  bool
+		cred       *store.Credential
 		isStream   bool
 		chatreq    = openai.ChatCompletionRequest{}
 		chatres    = openai.ChatCompletionResponse{}
@@ -428,83 +661,235 @@ func HandleProy(c *gin.Context) {
 		err        error
 		// wg         sync.WaitGroup
 	)
+	h.inflight.Add(1)
+	defer h.inflight.Done()
+	rt := h.current()
+	route := proxyRoute(c.Request.URL.Path)
+	m := h.metrics.StartRequest(route)
+	defer m.Done()
+	ctx, span := tracing.Start(tracing.Extract(c.Request.Context(), c.Request.Header), "proxy "+route,
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attribute.String("http.route", route)))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+	lg := logger.FromContext(ctx)
+
+	_, authSpan := tracing.Start(ctx, "authenticate")
 	auth := c.Request.Header.Get("Authorization")
 	if len(auth) > 7 && auth[:7] == "Bearer " {
-		localuser = store.IsExistAuthCache(auth[7:])
+		cred, _ = h.store.Authenticate(ctx, auth[7:])
+		localuser = cred != nil
+	}
+	authSpan.SetAttributes(attribute.Bool("opencatd.local_user", localuser))
+	authSpan.End()
+
+	if localuser {
+		if scope := requiredScope(c.Request.URL.Path); scope != "" && !cred.Allows(scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": gin.H{
+				"message": fmt.Sprintf("token lacks the %q scope", scope),
+			}})
+			return
+		}
 	}
 
-	if c.Request.URL.Path == "/v1/chat/completions" && localuser {
-		if store.KeysCache.ItemCount() == 0 {
+	// 本地用户的对话与 embeddings 请求使用站点的 Key 转发, 不能把用户自己的 token 发往上游;
+	// 其他路径不支持本地 token, 直接拒绝而不是透传
+	isChat := c.Request.URL.Path == "/v1/chat/completions"
+	if localuser && !isChat && c.Request.URL.Path != "/v1/embeddings" {
+		c.JSON(http.StatusNotFound, gin.H{"error": gin.H{
+			"message": fmt.Sprintf("%s is not supported with an opencatd token", c.Request.URL.Path),
+		}})
+		return
+	}
+	if localuser {
+		if h.store.KeyCount() == 0 {
 			c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{
 				"message": "No Api-Key Available",
 			}})
 			return
 		}
-		onekey := store.FromKeyCacheRandomItemKey()
+		var body bytes.Buffer
+		if isChat {
+			if err := c.BindJSON(&chatreq); err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			json.NewEncoder(&body).Encode(chatreq)
+		} else {
+			// embeddings 原样转发请求体, 只读取模型名
+			raw, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			var embreq struct {
+				Model string `json:"model"`
+			}
+			if err := json.Unmarshal(raw, &embreq); err != nil {
+				c.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			chatreq.Model = embreq.Model
+			body.Write(raw)
+		}
+		if !cred.AllowsModel(chatreq.Model) {
+			c.JSON(http.StatusForbidden, gin.H{"error": gin.H{
+				"message": fmt.Sprintf("model %s is not allowed for this token", chatreq.Model),
+			}})
+			return
+		}
+		if limit := rt.cfg.RateLimit.PerUser; limit > 0 && !h.userLimits.allow(cred.UserID, limit) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{
+				"message": "user rate limit exceeded",
+			}})
+			return
+		}
+		// 组的模型、预算与限流对组及其所有上级组生效
+		chain := h.store.GroupChain(cred.GroupID)
+		if status, msg := h.checkGroupPolicy(ctx, chain, chatreq.Model); status != 0 {
+			c.JSON(status, gin.H{"error": gin.H{
+				"message": msg,
+			}})
+			return
+		}
 
-		if err := c.BindJSON(&chatreq); err != nil {
-			c.AbortWithError(http.StatusBadRequest, err)
+		_, keySpan := tracing.Start(ctx, "select_key")
+		onekey, ok := h.store.SelectKey(chain, rt.cfg.Routing.Strategy == config.RoutingRoundRobin)
+		keySpan.SetAttributes(attribute.String("opencatd.key", onekey.Name), attribute.String("opencatd.api_type", onekey.ApiType))
+		keySpan.End()
+		if !ok {
+			c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{
+				"message": "No Api-Key Available",
+			}})
 			return
 		}
 		chatlog.Model = chatreq.Model
-		for _, m := range chatreq.Messages {
-			pre_prompt += m.Content + "\n"
+		m.Model = rt.cfg.MetricModel(chatreq.Model)
+		m.Key = onekey.Name
+		if isChat {
+			for _, m := range chatreq.Messages {
+				pre_prompt += m.Content + "\n"
+			}
+			chatlog.PromptHash = cryptor.Md5String(pre_prompt)
+			chatlog.PromptCount = NumTokensFromMessages(ctx, chatreq.Messages, chatreq.Model)
+			isStream = chatreq.Stream
+		}
+		chatlog.UserID = int(cred.UserID)
+		span.SetAttributes(
+			attribute.String("opencatd.model", chatreq.Model),
+			attribute.String("opencatd.key", onekey.Name),
+			attribute.Int("opencatd.user_id", chatlog.UserID),
+			attribute.Bool("opencatd.stream", isStream),
+		)
+
+		apikey, err := h.store.KeySecret(onekey)
+		if err != nil {
+			lg.Error("decrypt api key", "key", onekey.Name, "err", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{
+				"message": "Api-Key unavailable",
+			}})
+			return
 		}
-		chatlog.PromptHash = cryptor.Md5String(pre_prompt)
-		chatlog.PromptCount = NumTokensFromMessages(chatreq.Messages, chatreq.Model)
-		isStream = chatreq.Stream
-		chatlog.UserID, _ = store.GetUserID(auth[7:])
 
-		var body bytes.Buffer
-		json.NewEncoder(&body).Encode(chatreq)
 		// 创建 API 请求
 		switch onekey.ApiType {
 		case "azure_openai":
 			var buildurl string
-			var apiVersion = "2023-05-15"
+			deployment, ok := onekey.Deployment(chatreq.Model)
+			if !ok {
+				deployment = modelmap(chatreq.Model)
+			}
+			apiVersion := rt.cfg.Upstream.AzureAPIVersion
+			op := strings.TrimPrefix(c.Request.URL.Path, "/v1")
 			if onekey.EndPoint != "" {
-				buildurl = fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", onekey.EndPoint, modelmap(chatreq.Model), apiVersion)
+				buildurl = fmt.Sprintf("%s/openai/deployments/%s%s?api-version=%s", onekey.EndPoint, deployment, op, apiVersion)
 			} else {
-				buildurl = fmt.Sprintf("https://%s.openai.azure.com/openai/deployments/%s/chat/completions?api-version=%s", onekey.ResourceNmae, modelmap(chatreq.Model), apiVersion)
+				buildurl = fmt.Sprintf("https://%s.openai.azure.com/openai/deployments/%s%s?api-version=%s", onekey.ResourceName, deployment, op, apiVersion)
+			}
+			req, err = http.NewRequestWithContext(ctx, c.Request.Method, buildurl, &body)
+			if err == nil {
+				req.Header = siteKeyHeader(c.Request.Header)
+				req.Header.Set("api-key", apikey)
 			}
-			req, err = http.NewRequest(c.Request.Method, buildurl, &body)
-			req.Header = c.Request.Header
-			req.Header.Set("api-key", onekey.Key)
 		case "openai":
 			fallthrough
 		default:
 			if onekey.EndPoint != "" {
-				req, err = http.NewRequest(c.Request.Method, onekey.EndPoint+c.Request.RequestURI, &body)
+				req, err = http.NewRequestWithContext(ctx, c.Request.Method, onekey.EndPoint+c.Request.RequestURI, &body)
 			} else {
-				req, err = http.NewRequest(c.Request.Method, baseUrl+c.Request.RequestURI, &body)
+				req, err = http.NewRequestWithContext(ctx, c.Request.Method, rt.cfg.Upstream.BaseURL+c.Request.RequestURI, &body)
+			}
+			if err == nil {
+				req.Header = siteKeyHeader(c.Request.Header)
+				req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apikey))
 			}
-
-			req.Header = c.Request.Header
-			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", onekey.Key))
 		}
 		if err != nil {
-			log.Println(err)
+			lg.Error("build upstream request", "err", err)
 			c.JSON(http.StatusOK, gin.H{"error": err.Error()})
 			return
 		}
+		req = req.WithContext(withKeyTransport(req.Context(), &onekey))
 
 	} else {
-		req, err = http.NewRequest(c.Request.Method, baseUrl+c.Request.RequestURI, c.Request.Body)
+		req, err = http.NewRequestWithContext(ctx, c.Request.Method, rt.cfg.Upstream.BaseURL+c.Request.RequestURI, c.Request.Body)
 		if err != nil {
-			log.Println(err)
+			lg.Error("build upstream request", "err", err)
 			c.JSON(http.StatusOK, gin.H{"error": err.Error()})
 			return
 		}
-		req.Header = c.Request.Header
+		// 透传调用方自己的上游 Key, 但不转发 opencatd 的会话 cookie
+		req.Header = c.Request.Header.Clone()
+		req.Header.Del("Cookie")
 	}
 
-	resp, err := client.Do(req)
+	// 上游请求随客户端断开而取消, 首字节或读取间隔超时时以对应的 cause 取消
+	reqCtx, cancelReq := context.WithCancelCause(req.Context())
+	defer cancelReq(nil)
+	upCtx, upSpan := tracing.Start(ctx, "upstream", trace.WithSpanKind(trace.SpanKindClient))
+	upStart := time.Now()
+	req = req.WithContext(httptrace.WithClientTrace(trace.ContextWithSpan(reqCtx, upSpan), &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			upSpan.AddEvent("first_byte", trace.WithAttributes(attribute.Int64("opencatd.ttfb_ms", time.Since(upStart).Milliseconds())))
+		},
+	}))
+	upSpan.SetAttributes(attribute.String("http.method", req.Method), attribute.String("http.url", req.URL.Redacted()))
+	tracing.Inject(upCtx, req.Header)
+	stopFirstByte := startFirstByteTimer(rt.cfg.Upstream.FirstByteTimeout.Std(), cancelReq)
+	resp, err := rt.client.Do(req)
+	stopFirstByte()
 	if err != nil {
-		log.Println(err)
-		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		upSpan.RecordError(err)
+		upSpan.SetStatus(codes.Error, err.Error())
+		upSpan.End()
+		span.SetStatus(codes.Error, err.Error())
+		switch reason := upstreamAbortReason(ctx, reqCtx); {
+		case errors.Is(context.Cause(reqCtx), errFirstByteTimeout):
+			lg.Error("upstream request failed", "url", req.URL.Redacted(), "err", reason)
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": gin.H{
+				"message": reason,
+			}})
+		case reason != "":
+			lg.Info("upstream request aborted", "url", req.URL.Redacted(), "reason", reason)
+		default:
+			lg.Error("upstream request failed", "url", req.URL.Redacted(), "err", err)
+			c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		}
 		return
 	}
+	upSpan.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	upSpan.End()
+	resp.Body = withChunkIdleTimeout(resp.Body, rt.cfg.Upstream.ChunkIdleTimeout.Std(), cancelReq)
 	defer resp.Body.Close()
+	m.Status = resp.StatusCode
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	upstreamID := resp.Header.Get(RequestIDHeader)
+	if upstreamID != "" {
+		lg = lg.With("upstream_request_id", upstreamID)
+		ctx = logger.WithContext(ctx, lg)
+		c.Request = c.Request.WithContext(ctx)
+		span.SetAttributes(attribute.String("opencatd.upstream_request_id", upstreamID))
+	}
+	lg.Debug("upstream responded", "status", resp.StatusCode, "model", chatreq.Model, "user_id", chatlog.UserID)
 
 	// 复制 API 响应头部
 	for name, values := range resp.Header {
@@ -512,6 +897,11 @@ func HandleProy(c *gin.Context) {
 			c.Writer.Header().Add(name, value)
 		}
 	}
+	// 上游的 x-request-id 改为 X-Upstream-Request-ID 返回, 避免与本地请求 ID 混淆
+	c.Writer.Header().Set(RequestIDHeader, c.GetString(requestIDKey))
+	if upstreamID != "" {
+		c.Writer.Header().Set("X-Upstream-Request-ID", upstreamID)
+	}
 	head := map[string]string{
 		"Cache-Control":                    "no-store",
 		"access-control-allow-origin":      "*",
@@ -534,20 +924,25 @@ func HandleProy(c *gin.Context) {
 
 	if resp.StatusCode == 200 && localuser {
 		if isStream {
+			m.StreamStarted()
+			_, relaySpan := tracing.Start(ctx, "stream_relay")
 			contentCh := fetchResponseContent(c, reader)
 			var buffer bytes.Buffer
 			for content := range contentCh {
 				buffer.WriteString(content)
 			}
-			chatlog.CompletionCount = NumTokensFromStr(buffer.String(), chatreq.Model)
-			chatlog.TotalTokens = chatlog.PromptCount + chatlog.CompletionCount
-			chatlog.Cost = fmt.Sprintf("%.6f", Cost(chatlog.Model, chatlog.PromptCount, chatlog.CompletionCount))
-			if err := store.Record(&chatlog); err != nil {
-				log.Println(err)
-			}
-			if err := store.SumDaily(chatlog.UserID); err != nil {
-				log.Println(err)
+			chatlog.CompletionCount = NumTokensFromStr(ctx, buffer.String(), chatreq.Model)
+			// 客户端断开或上游超时时按已转发的内容记录用量
+			if reason := upstreamAbortReason(ctx, reqCtx); reason != "" {
+				relaySpan.SetStatus(codes.Error, reason)
+				lg.Warn("stream aborted, recording partial usage", "reason", reason, "completion_tokens", chatlog.CompletionCount)
 			}
+			relaySpan.End()
+			chatlog.TotalTokens = chatlog.PromptCount + chatlog.CompletionCount
+			cost := rt.cfg.Cost(chatlog.Model, chatlog.PromptCount, chatlog.CompletionCount)
+			chatlog.Cost = fmt.Sprintf("%.6f", cost)
+			h.metrics.RecordUsage(chatlog.UserID, rt.cfg.MetricModel(chatlog.Model), chatlog.PromptCount, chatlog.CompletionCount, cost)
+			h.recordUsage(ctx, &chatlog)
 			return
 		}
 		res, err := io.ReadAll(reader)
@@ -562,18 +957,15 @@ func HandleProy(c *gin.Context) {
 		chatlog.PromptCount = chatres.Usage.PromptTokens
 		chatlog.CompletionCount = chatres.Usage.CompletionTokens
 		chatlog.TotalTokens = chatres.Usage.TotalTokens
-		chatlog.Cost = fmt.Sprintf("%.6f", Cost(chatlog.Model, chatlog.PromptCount, chatlog.CompletionCount))
-		if err := store.Record(&chatlog); err != nil {
-			log.Println(err)
-		}
-		if err := store.SumDaily(chatlog.UserID); err != nil {
-			log.Println(err)
-		}
+		cost := rt.cfg.Cost(chatlog.Model, chatlog.PromptCount, chatlog.CompletionCount)
+		chatlog.Cost = fmt.Sprintf("%.6f", cost)
+		h.metrics.RecordUsage(chatlog.UserID, rt.cfg.MetricModel(chatlog.Model), chatlog.PromptCount, chatlog.CompletionCount, cost)
+		h.recordUsage(ctx, &chatlog)
 
 	}
 	// 返回 API 响应主体
 	if _, err := io.Copy(writer, reader); err != nil {
-		log.Println(err)
+		lg.Error("copy upstream response", "err", err)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": gin.H{
 			"message": err.Error(),
 		}})
@@ -581,70 +973,134 @@ func HandleProy(c *gin.Context) {
 	}
 }
 
-func HandleReverseProxy(c *gin.Context) {
+// otherRoute 为未知代理路径在指标与 span 名中的 route
+const otherRoute = "other"
+
+// proxyRoutes 为指标与 span 名中单独区分的代理路径, 其余路径记为 otherRoute, 避免任意路径产生新的时间序列或 span 名
+var proxyRoutes = map[string]bool{
+	"/v1/chat/completions":               true,
+	"/v1/completions":                    true,
+	"/v1/embeddings":                     true,
+	"/v1/models":                         true,
+	"/v1/moderations":                    true,
+	"/v1/images/generations":             true,
+	"/v1/audio/transcriptions":           true,
+	"/v1/audio/translations":             true,
+	"/v1/dashboard/billing/subscription": true,
+	"/v1/dashboard/billing/usage":        true,
+}
+
+func proxyRoute(path string) string {
+	if proxyRoutes[path] {
+		return path
+	}
+	return otherRoute
+}
+
+// siteKeyHeader 为使用站点 Key 的上游请求构造新的请求头, 请求体总是 JSON, 只保留 Accept;
+// 调用方的 Authorization 与 Cookie 等本地凭据不会发往上游
+func siteKeyHeader(in http.Header) http.Header {
+	out := http.Header{}
+	out.Set("Content-Type", "application/json")
+	if v := in.Values("Accept"); len(v) > 0 {
+		out["Accept"] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// requiredScope 返回访问 path 所需的 token scope, 空字符串表示不限制
+func requiredScope(path string) string {
+	switch path {
+	case "/v1/chat/completions":
+		return store.ScopeChat
+	case "/v1/embeddings":
+		return store.ScopeEmbeddings
+	}
+	return ""
+}
+
+// recordUsage 写入单次用量并更新当日汇总, 即使客户端已断开或服务正在退出也要写完
+func (h *Handler) recordUsage(ctx context.Context, chatlog *store.Tokens) {
+	ctx = context.WithoutCancel(ctx)
+	_, span := tracing.Start(ctx, "store.Record")
+	if err := h.store.Record(ctx, chatlog); err != nil {
+		logger.FromContext(ctx).Error("record usage", "user_id", chatlog.UserID, "model", chatlog.Model, "err", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	_, span = tracing.Start(ctx, "store.SumDaily")
+	if err := h.store.SumDaily(ctx, chatlog.UserID); err != nil {
+		logger.FromContext(ctx).Error("sum daily usage", "user_id", chatlog.UserID, "err", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// WaitInflight 等待所有进行中的 HandleProy 结束, ctx 到期则返回 ctx.Err()
+func (h *Handler) WaitInflight(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Handler) HandleReverseProxy(c *gin.Context) {
+	rt := h.current()
+	upstream, err := url.Parse(rt.cfg.Upstream.BaseURL)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
 	proxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			req.URL.Scheme = "https"
-			req.URL.Host = "api.openai.com"
+			req.URL.Scheme = upstream.Scheme
+			req.URL.Host = upstream.Host
 			// req.Header.Set("Authorization", "Bearer YOUR_API_KEY_HERE")
 		},
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-		},
+		Transport: rt.client.Transport,
 	}
 
 	var localuser bool
 	auth := c.Request.Header.Get("Authorization")
 	if len(auth) > 7 && auth[:7] == "Bearer " {
-		log.Println(store.IsExistAuthCache(auth[7:]))
-		localuser = store.IsExistAuthCache(auth[7:])
+		localuser = h.store.IsExistAuthCache(c.Request.Context(), auth[7:])
 	}
 
-	req, err := http.NewRequest(c.Request.Method, c.Request.URL.Path, c.Request.Body)
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, c.Request.URL.Path, c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
 		return
 	}
 	req.Header = c.Request.Header
 	if localuser {
-		if store.KeysCache.ItemCount() == 0 {
+		if h.store.KeyCount() == 0 {
 			c.JSON(http.StatusOK, gin.H{"error": "No Api-Key Available"})
 			return
 		}
-		onekey := store.FromKeyCacheRandomItemKey()
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", onekey.Key))
+		onekey := h.store.FromKeyCacheRandomItemKey()
+		apikey, err := h.store.KeySecret(onekey)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+			return
+		}
+		req = req.WithContext(withKeyTransport(req.Context(), &onekey))
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apikey))
 	}
 
 	proxy.ServeHTTP(c.Writer, req)
 
 }
-func Cost(model string, promptCount, completionCount int) float64 {
-	var cost, prompt, completion float64
-	prompt = float64(promptCount)
-	completion = float64(completionCount)
-
-	switch model {
-	case "gpt-3.5-turbo", "gpt-3.5-turbo-0301":
-		cost = 0.002 * float64((prompt+completion)/1000)
-	case "gpt-4", "gpt-4-0314":
-		cost = 0.03*float64(prompt/1000) + 0.06*float64(completion/1000)
-	case "gpt-4-32k", "gpt-4-32k-0314":
-		cost = 0.06*float64(prompt/1000) + 0.12*float64(completion/1000)
-	}
-	return cost
-}
-
-func HandleUsage(c *gin.Context) {
+func (h *Handler) HandleUsage(c *gin.Context) {
 	fromStr := c.Query("from")
 	toStr := c.Query("to")
 	getMonthStartAndEnd := func() (start, end string) {
@@ -664,11 +1120,35 @@ func HandleUsage(c *gin.Context) {
 		fromStr, toStr = getMonthStartAndEnd()
 	}
 
-	usage, err := store.QueryUsage(fromStr, toStr)
+	if c.Query("group_by") == "group" {
+		usage, err := h.store.QueryGroupUsage(c.Request.Context(), fromStr, toStr)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, usage)
+		return
+	}
+
+	usage, err := h.store.QueryUsage(c.Request.Context(), fromStr, toStr)
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 		return
 	}
+	ids := make([]uint, 0, len(usage))
+	for _, u := range usage {
+		ids = append(ids, uint(u.UserID))
+	}
+	if len(ids) > 0 {
+		names, err := h.store.GetUserNames(c.Request.Context(), ids)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		for i := range usage {
+			usage[i].Name = names[uint(usage[i].UserID)]
+		}
+	}
 
 	c.JSON(200, usage)
 }
@@ -699,10 +1179,10 @@ func fetchResponseContent(ctx *gin.Context, responseBody *bufio.Reader) <-chan s
 				dec := json.NewDecoder(strings.NewReader(line))
 				var data map[string]interface{}
 				if err := dec.Decode(&data); err == io.EOF {
-					log.Println("EOF:", err)
+					logger.FromContext(ctx.Request.Context()).Debug("stream EOF", "err", err)
 					break
 				} else if err != nil {
-					fmt.Println("Error decoding response:", err)
+					logger.FromContext(ctx.Request.Context()).Error("decode stream chunk", "err", err)
 					return
 				}
 				if choices, ok := data["choices"].([]interface{}); ok {
@@ -721,11 +1201,10 @@ func fetchResponseContent(ctx *gin.Context, responseBody *bufio.Reader) <-chan s
 	return contentCh
 }
 
-func NumTokensFromMessages(messages []openai.ChatCompletionMessage, model string) (num_tokens int) {
+func NumTokensFromMessages(ctx context.Context, messages []openai.ChatCompletionMessage, model string) (num_tokens int) {
 	tkm, err := tiktoken.EncodingForModel(model)
 	if err != nil {
-		err = fmt.Errorf("EncodingForModel: %v", err)
-		fmt.Println(err)
+		logger.FromContext(ctx).Warn("EncodingForModel", "model", model, "err", err)
 		return
 	}
 
@@ -738,7 +1217,7 @@ func NumTokensFromMessages(messages []openai.ChatCompletionMessage, model string
 		tokens_per_message = 3
 		tokens_per_name = 1
 	} else {
-		fmt.Println("Warning: model not found. Using cl100k_base encoding.")
+		logger.FromContext(ctx).Debug("model not found, using cl100k_base encoding", "model", model)
 		tokens_per_message = 3
 		tokens_per_name = 1
 	}
@@ -755,11 +1234,10 @@ func NumTokensFromMessages(messages []openai.ChatCompletionMessage, model string
 	return num_tokens
 }
 
-func NumTokensFromStr(messages string, model string) (num_tokens int) {
+func NumTokensFromStr(ctx context.Context, messages string, model string) (num_tokens int) {
 	tkm, err := tiktoken.EncodingForModel(model)
 	if err != nil {
-		err = fmt.Errorf("EncodingForModel: %v", err)
-		fmt.Println(err)
+		logger.FromContext(ctx).Warn("EncodingForModel", "model", model, "err", err)
 		return
 	}
 
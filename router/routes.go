@@ -0,0 +1,99 @@
+package router
+
+import (
+	"opencatd-open/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Register 注册管理 API、SSO、代理与健康检查路由
+func (h *Handler) Register(r gin.IRouter) {
+	group := r.Group("/1")
+	{
+		group.Use(h.AuthMiddleware())
+
+		// 获取当前用户信息
+		group.GET("/me", HandleMe)
+
+		group.GET("/me/usages", h.HandleMeUsage)
+
+		// 当前用户的命名 token, 只有主 token 或带 admin scope 的 token 可以创建与吊销
+		group.GET("/me/tokens", h.HandleMeTokens)
+		group.POST("/me/tokens", RequireScope(store.ScopeAdmin), h.HandleAddMeToken)
+		group.DELETE("/me/tokens/:tid", RequireScope(store.ScopeAdmin), h.HandleDelMeToken)
+
+		// 注销 SSO 会话
+		group.POST("/auth/logout", h.HandleLogout)
+
+		read := RequirePermission(store.PermAdminRead)
+		keysWrite := RequirePermission(store.PermKeysWrite)
+		usersWrite := RequirePermission(store.PermUsersWrite)
+
+		// 获取所有Key
+		group.GET("/keys", read, h.HandleKeys)
+
+		// 获取所有用户信息
+		group.GET("/users", read, h.HandleUsers)
+
+		group.GET("/usages", read, h.HandleUsage)
+
+		// 审计日志
+		group.GET("/audit", read, h.HandleAudit)
+
+		// 下载数据库备份
+		group.POST("/backup", RequirePermission(store.PermBackup), h.HandleBackup)
+
+		// 添加Key
+		group.POST("/keys", keysWrite, h.HandleAddKey)
+
+		// 修改Key
+		group.PATCH("/keys/:id", keysWrite, h.HandleUpdateKey)
+
+		// 探测Key可用性
+		group.POST("/keys/:id/test", keysWrite, h.HandleTestKey)
+
+		// 删除Key
+		group.DELETE("/keys/:id", keysWrite, h.HandleDelKey)
+
+		// 添加用户
+		group.POST("/users", usersWrite, h.HandleAddUser)
+
+		// 修改用户
+		group.PATCH("/users/:id", usersWrite, h.HandleUpdateUser)
+
+		// 删除用户
+		group.DELETE("/users/:id", usersWrite, h.HandleDelUser)
+
+		// 重置用户Token
+		group.POST("/users/:id/reset", usersWrite, h.HandleResetUserToken)
+
+		// 修改用户角色
+		group.PUT("/users/:id/role", usersWrite, h.HandleSetUserRole)
+
+		// 禁用/启用用户
+		group.POST("/users/:id/disable", usersWrite, h.HandleDisableUser)
+		group.POST("/users/:id/enable", usersWrite, h.HandleEnableUser)
+
+		// 用户组
+		group.GET("/groups", read, h.HandleGroups)
+		group.POST("/groups", usersWrite, h.HandleAddGroup)
+		group.PATCH("/groups/:id", usersWrite, h.HandleUpdateGroup)
+		group.DELETE("/groups/:id", usersWrite, h.HandleDelGroup)
+
+		// 查看/吊销用户的命名 token
+		group.GET("/users/:id/tokens", read, h.HandleUserTokens)
+		group.DELETE("/users/:id/tokens/:tid", usersWrite, h.HandleDelUserToken)
+	}
+
+	// 初始化用户
+	r.POST("/1/users/init", h.Handleinit)
+
+	// OIDC 单点登录
+	r.GET("/1/auth/oidc/login", h.HandleOIDCLogin)
+	r.GET("/1/auth/oidc/callback", h.HandleOIDCCallback)
+
+	r.Any("/v1/*proxypath", h.HandleProy)
+
+	r.GET("/healthz", HandleHealthz)
+	r.GET("/readyz", h.HandleReadyz)
+}
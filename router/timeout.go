@@ -0,0 +1,68 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	errFirstByteTimeout = errors.New("upstream first byte timeout")
+	errChunkIdleTimeout = errors.New("upstream chunk idle timeout")
+)
+
+// startFirstByteTimer 在 d 后以 errFirstByteTimeout 取消上游请求, 收到响应头后需调用返回的 stop; d 为 0 时不限制
+func startFirstByteTimer(d time.Duration, cancel context.CancelCauseFunc) (stop func()) {
+	if d <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(d, func() { cancel(errFirstByteTimeout) })
+	return func() { t.Stop() }
+}
+
+// idleTimeoutBody 在两次读到数据之间超过 d 时以 errChunkIdleTimeout 取消上游请求, 使阻塞的 Read 返回
+type idleTimeoutBody struct {
+	io.ReadCloser
+	d     time.Duration
+	timer *time.Timer
+}
+
+// withChunkIdleTimeout 为 body 加上读取间隔超时, d 为 0 时原样返回
+func withChunkIdleTimeout(body io.ReadCloser, d time.Duration, cancel context.CancelCauseFunc) io.ReadCloser {
+	if d <= 0 {
+		return body
+	}
+	return &idleTimeoutBody{
+		ReadCloser: body,
+		d:          d,
+		timer:      time.AfterFunc(d, func() { cancel(errChunkIdleTimeout) }),
+	}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.d)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// upstreamAbortReason 说明上游请求为何被中止, 未中止时为空
+func upstreamAbortReason(clientCtx, upstreamCtx context.Context) string {
+	switch cause := context.Cause(upstreamCtx); {
+	case cause == nil:
+		return ""
+	case errors.Is(cause, errFirstByteTimeout), errors.Is(cause, errChunkIdleTimeout):
+		return cause.Error()
+	case clientCtx.Err() != nil:
+		return "client disconnected"
+	default:
+		return cause.Error()
+	}
+}
@@ -0,0 +1,133 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"opencatd-open/pkg/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStallingUpstream 先执行 before (可写出部分响应), 然后阻塞到请求被取消, 取消时向 aborted 发送一次
+func newStallingUpstream(t *testing.T, before func(w http.ResponseWriter)) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	aborted := make(chan struct{}, 10)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if before != nil {
+			before(w)
+		}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-done:
+		}
+	}))
+	t.Cleanup(func() {
+		close(done)
+		srv.Close()
+	})
+	return srv, aborted
+}
+
+func newTimeoutTestServer(t *testing.T, upstream string, firstByte, chunkIdle time.Duration) (*testServer, string) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Upstream.BaseURL = upstream
+	cfg.Upstream.FirstByteTimeout = config.Duration(firstByte)
+	cfg.Upstream.ChunkIdleTimeout = config.Duration(chunkIdle)
+	s := newTestServer(t, cfg, Options{})
+	root := s.initRoot(t)
+	body := map[string]any{"key": "sk-site", "name": "k1", "endpoint": upstream}
+	if code := s.do(t, http.MethodPost, "/1/keys?skip_validation=true", root, body, nil); code != http.StatusOK {
+		t.Fatalf("add key: status %d", code)
+	}
+	return s, root
+}
+
+func waitAborted(t *testing.T, aborted <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	up, aborted := newStallingUpstream(t, nil)
+	s, root := newTimeoutTestServer(t, up.URL, 50*time.Millisecond, 0)
+	var res map[string]any
+	if code := s.do(t, http.MethodPost, "/v1/chat/completions", root, chatBody("gpt-4"), &res); code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, body %v, want 504", code, res)
+	}
+	waitAborted(t, aborted)
+}
+
+func TestChunkIdleTimeoutRecordsPartialStream(t *testing.T) {
+	up, aborted := newStallingUpstream(t, func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, `data: {"choices":[{"index":0,"delta":{"content":"hello there"}}]}`+"\n\n")
+		w.(http.Flusher).Flush()
+	})
+	s, root := newTimeoutTestServer(t, up.URL, time.Minute, 100*time.Millisecond)
+	var me User
+	s.do(t, http.MethodGet, "/1/me", root, nil, &me)
+
+	body := chatBody("gpt-4")
+	body["stream"] = true
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+root)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	s.engine.ServeHTTP(w, req)
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("stalled stream took %v", time.Since(start))
+	}
+	if !strings.Contains(w.Body.String(), "hello there") {
+		t.Errorf("relayed body = %q, want the first chunk", w.Body.String())
+	}
+	waitAborted(t, aborted)
+
+	// 中止的流同样记录用量 (token 数依赖编码表, 这里只检查有记录)
+	s.inflight.Wait()
+	today := time.Now().UTC()
+	usages, err := s.store.QueryUsage(context.Background(), today.Format("2006-01-02"), today.AddDate(0, 0, 1).Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || usages[0].UserID != me.ID {
+		t.Errorf("usage after aborted stream = %+v", usages)
+	}
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	up, aborted := newStallingUpstream(t, nil)
+	s, root := newTimeoutTestServer(t, up.URL, time.Minute, time.Minute)
+	b, _ := json.Marshal(chatBody("gpt-4"))
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(b)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+root)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.engine.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	waitAborted(t, aborted)
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the client disconnected")
+	}
+}
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"opencatd-open/store"
+	"strings"
+	"time"
+
+	"github.com/Sakurasan/to"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type ApiTokenReq struct {
+	Name string `json:"name"`
+	// ExpiresAt 与 ExpiresInDays 二选一, 都为空表示永不过期
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	ExpiresInDays int        `json:"expiresInDays,omitempty"`
+	Scopes        []string   `json:"scopes,omitempty"`
+	Models        []string   `json:"models,omitempty"`
+}
+
+type ApiTokenResp struct {
+	store.ApiToken
+	// Token 明文只在创建时返回一次
+	Token string `json:"token,omitempty"`
+}
+
+func (h *Handler) HandleMeTokens(c *gin.Context) {
+	h.listTokens(c, currentUser(c).ID)
+}
+
+func (h *Handler) HandleAddMeToken(c *gin.Context) {
+	var body ApiTokenReq
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid token name"})
+		return
+	}
+	scopes, err := store.NormalizeScopes(body.Scopes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// 命名 token 不能超出创建它的 token 的 scope
+	cred := currentCredential(c)
+	for _, s := range scopes {
+		if !cred.Allows(s) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant scope " + s})
+			return
+		}
+	}
+	t := &store.ApiToken{UserID: currentUser(c).ID, Name: body.Name, ExpiresAt: body.ExpiresAt}
+	if body.ExpiresInDays > 0 {
+		exp := time.Now().AddDate(0, 0, body.ExpiresInDays)
+		t.ExpiresAt = &exp
+	}
+	if t.ExpiresAt != nil && t.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt is in the past"})
+		return
+	}
+	// 也不能比创建它的命名 token 更晚过期; 主 token 与 SSO 会话代表用户本身, 不受此限制
+	if cred.TokenID != 0 && cred.ExpiresAt != nil && (t.ExpiresAt == nil || t.ExpiresAt.After(*cred.ExpiresAt)) {
+		exp := *cred.ExpiresAt
+		t.ExpiresAt = &exp
+	}
+	var models []string
+	for _, m := range body.Models {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
+	}
+	// 模型只能是创建它的 token 允许的子集, 未指定时继承其限制
+	if len(models) == 0 {
+		models = cred.Models
+	}
+	for _, m := range models {
+		if !cred.AllowsModel(m) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant model " + m})
+			return
+		}
+	}
+
+	token := uuid.NewString()
+	if err := h.store.CreateApiToken(c.Request.Context(), t, token, scopes, models); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, AuditTokenCreate, "token", t.ID, nil, t)
+	c.JSON(http.StatusOK, ApiTokenResp{ApiToken: *t, Token: token})
+}
+
+func (h *Handler) HandleDelMeToken(c *gin.Context) {
+	h.revokeToken(c, currentUser(c).ID, uint(to.Int(c.Param("tid"))))
+}
+
+func (h *Handler) HandleUserTokens(c *gin.Context) {
+	target, err := h.store.GetUserByID(c.Request.Context(), uint(to.Int(c.Param("id"))))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	h.listTokens(c, target.ID)
+}
+
+func (h *Handler) HandleDelUserToken(c *gin.Context) {
+	target, ok := h.manageableUser(c)
+	if !ok {
+		return
+	}
+	h.revokeToken(c, target.ID, uint(to.Int(c.Param("tid"))))
+}
+
+// manageableUser 读取 :id 对应的用户并确认当前用户有权管理
+func (h *Handler) manageableUser(c *gin.Context) (*store.User, bool) {
+	target, err := h.store.GetUserByID(c.Request.Context(), uint(to.Int(c.Param("id"))))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if !canManageUser(currentUser(c), target) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return nil, false
+	}
+	return target, true
+}
+
+func (h *Handler) listTokens(c *gin.Context, userID uint) {
+	tokens, err := h.store.ListApiTokens(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (h *Handler) revokeToken(c *gin.Context, userID, id uint) {
+	t, err := h.store.GetApiToken(c.Request.Context(), userID, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid token id"})
+		return
+	}
+	if err := h.store.RevokeApiToken(c.Request.Context(), userID, id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "invalid token id"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, AuditTokenRevoke, "token", t.ID, t, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// addToken 用 parent 创建命名 token, 返回状态码与响应
+func (s *testServer) addToken(t *testing.T, parent string, body map[string]any) (int, ApiTokenResp) {
+	t.Helper()
+	var res ApiTokenResp
+	code := s.do(t, http.MethodPost, "/1/me/tokens", parent, body, &res)
+	return code, res
+}
+
+func TestChildTokenCannotManageTokens(t *testing.T) {
+	s := newTestServer(t, nil, Options{})
+	root := s.initRoot(t)
+	code, chat := s.addToken(t, root, map[string]any{"name": "chat", "scopes": []string{"chat"}})
+	if code != http.StatusOK {
+		t.Fatalf("create chat token: status %d", code)
+	}
+	if code, _ := s.addToken(t, chat.Token, map[string]any{"name": "grandchild", "scopes": []string{"chat"}}); code != http.StatusForbidden {
+		t.Errorf("chat token creating a token: status %d, want 403", code)
+	}
+	if code := s.do(t, http.MethodDelete, fmt.Sprintf("/1/me/tokens/%d", chat.ID), chat.Token, nil, nil); code != http.StatusForbidden {
+		t.Errorf("chat token revoking a token: status %d, want 403", code)
+	}
+
+	code, admin := s.addToken(t, root, map[string]any{"name": "admin", "scopes": []string{"admin", "chat"}})
+	if code != http.StatusOK {
+		t.Fatalf("create admin token: status %d", code)
+	}
+	if code, _ := s.addToken(t, admin.Token, map[string]any{"name": "from-admin", "scopes": []string{"chat"}}); code != http.StatusOK {
+		t.Errorf("admin token creating a token: status %d, want 200", code)
+	}
+	if code := s.do(t, http.MethodDelete, fmt.Sprintf("/1/me/tokens/%d", chat.ID), admin.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("admin token revoking a token: status %d, want 200", code)
+	}
+}
+
+func TestChildTokenModelsAreSubset(t *testing.T) {
+	s := newTestServer(t, nil, Options{})
+	root := s.initRoot(t)
+	_, parent := s.addToken(t, root, map[string]any{"name": "p", "scopes": []string{"admin", "chat"}, "models": []string{"gpt-3.5-turbo", "gpt-4"}})
+
+	if code, _ := s.addToken(t, parent.Token, map[string]any{"name": "wider", "models": []string{"gpt-4", "gpt-4-32k"}}); code != http.StatusForbidden {
+		t.Errorf("model outside the parent's set: status %d, want 403", code)
+	}
+	code, narrow := s.addToken(t, parent.Token, map[string]any{"name": "narrow", "scopes": []string{"chat"}, "models": []string{"gpt-4"}})
+	if code != http.StatusOK || narrow.Models != "gpt-4" {
+		t.Errorf("subset: status %d, models %q", code, narrow.Models)
+	}
+	code, inherit := s.addToken(t, parent.Token, map[string]any{"name": "inherit", "scopes": []string{"chat"}})
+	if code != http.StatusOK || inherit.Models != "gpt-3.5-turbo,gpt-4" {
+		t.Errorf("omitted models: status %d, models %q, want the parent's", code, inherit.Models)
+	}
+	// 主 token 不限模型
+	if code, _ := s.addToken(t, root, map[string]any{"name": "any", "models": []string{"gpt-4-32k"}}); code != http.StatusOK {
+		t.Errorf("primary token: status %d, want 200", code)
+	}
+}
+
+func TestChildTokenExpiryIsCapped(t *testing.T) {
+	s := newTestServer(t, nil, Options{})
+	root := s.initRoot(t)
+	_, parent := s.addToken(t, root, map[string]any{"name": "p", "scopes": []string{"admin", "chat"}, "expiresInDays": 1})
+	if parent.ExpiresAt == nil {
+		t.Fatal("parent has no expiry")
+	}
+
+	for name, body := range map[string]map[string]any{
+		"never":  {"name": "never", "scopes": []string{"chat"}},
+		"later":  {"name": "later", "scopes": []string{"chat"}, "expiresInDays": 30},
+		"sooner": {"name": "sooner", "scopes": []string{"chat"}, "expiresAt": time.Now().Add(time.Hour)},
+	} {
+		code, child := s.addToken(t, parent.Token, body)
+		if code != http.StatusOK || child.ExpiresAt == nil {
+			t.Errorf("%s: status %d, expiresAt %v", name, code, child.ExpiresAt)
+			continue
+		}
+		if child.ExpiresAt.After(*parent.ExpiresAt) {
+			t.Errorf("%s: expires %v, after the parent's %v", name, child.ExpiresAt, parent.ExpiresAt)
+		}
+		if name == "sooner" && !child.ExpiresAt.Before(parent.ExpiresAt.Add(-time.Hour)) {
+			t.Errorf("sooner: expires %v, want the requested earlier time kept", child.ExpiresAt)
+		}
+	}
+}
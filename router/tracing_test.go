@@ -0,0 +1,81 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"opencatd-open/pkg/config"
+	"opencatd-open/pkg/tracing"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useInMemoryTracer 安装同步导出到内存的全局 TracerProvider, 测试结束后恢复
+func useInMemoryTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	prev := otel.GetTracerProvider()
+	exp := tracetest.NewInMemoryExporter()
+	shutdown := tracing.InitWithProcessor(sdktrace.NewSimpleSpanProcessor(exp))
+	t.Cleanup(func() {
+		shutdown(context.Background())
+		otel.SetTracerProvider(prev)
+	})
+	return exp
+}
+
+func TestProxySpanUsesRouteAndPropagatesContext(t *testing.T) {
+	exp := useInMemoryTracer(t)
+	var upstreamParent string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		upstreamParent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"x","object":"chat.completion","model":"m","choices":[],"usage":{}}`)
+	}))
+	defer up.Close()
+	cfg := config.Default()
+	cfg.Upstream.BaseURL = up.URL
+	s := newTestServer(t, cfg, Options{})
+	token := s.initRoot(t)
+	s.addTestKey(t, token, "k1", up.URL)
+	exp.Reset()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/v1/no-such-route/123", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	s.engine.ServeHTTP(httptest.NewRecorder(), req)
+	if code := s.do(t, http.MethodPost, "/v1/chat/completions", token, chatBody("gpt-4"), nil); code != http.StatusOK {
+		t.Fatalf("chat: status %d", code)
+	}
+
+	servers := map[string]tracetest.SpanStub{}
+	for _, sp := range exp.GetSpans() {
+		if sp.SpanKind == trace.SpanKindServer {
+			servers[sp.Name] = sp
+		}
+	}
+	if len(servers) != 2 {
+		t.Fatalf("server spans = %v, want proxy other and proxy /v1/chat/completions", servers)
+	}
+	other, ok := servers["proxy other"]
+	if !ok {
+		t.Fatalf("unknown path must be named %q, got %v", "proxy other", servers)
+	}
+	if got := other.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("span trace id = %s, want the incoming %s", got, traceID)
+	}
+	chat, ok := servers["proxy /v1/chat/completions"]
+	if !ok {
+		t.Fatalf("chat span missing, got %v", servers)
+	}
+	if !strings.HasPrefix(upstreamParent, "00-"+chat.SpanContext.TraceID().String()) {
+		t.Errorf("upstream traceparent = %q, want trace %s", upstreamParent, chat.SpanContext.TraceID())
+	}
+}
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"opencatd-open/pkg/config"
+	"opencatd-open/store"
+	"strings"
+	"sync"
+	"time"
+)
+
+type keyTransportKey struct{}
+
+// keyTransport 为一个 Key 影响连接的设置
+type keyTransport struct {
+	insecure bool
+	store.KeyTransport
+}
+
+// withKeyTransport 把 k 的连接设置放入 ctx, 使用该 ctx 的上游请求按其选择 Transport
+func withKeyTransport(ctx context.Context, k *store.Key) context.Context {
+	return context.WithValue(ctx, keyTransportKey{}, keyTransport{insecure: k.InsecureSkipVerify, KeyTransport: k.Transport})
+}
+
+// transportKey 区分设置不同的连接池: host 为 upstream.hosts 中的主机, 其余主机共用 ""
+type transportKey struct {
+	host string
+	keyTransport
+}
+
+// upstreamTransport 按上游主机的证书设置与 Key 的连接设置 (代理、超时、HTTP/2、是否跳过校验)
+// 选择 http.Transport, 各 Transport 首次使用时创建并保留各自的连接池
+type upstreamTransport struct {
+	u    config.Upstream
+	mu   sync.Mutex
+	pool map[transportKey]*http.Transport
+}
+
+// newHTTPClient 按配置创建访问上游的客户端
+func newHTTPClient(u config.Upstream) *http.Client {
+	return &http.Client{Transport: &upstreamTransport{u: u, pool: map[transportKey]*http.Transport{}}}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	kt, _ := req.Context().Value(keyTransportKey{}).(keyTransport)
+	tr, err := t.transport(req.URL.Hostname(), kt)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return tr.RoundTrip(req)
+}
+
+func (t *upstreamTransport) transport(host string, kt keyTransport) (*http.Transport, error) {
+	key := transportKey{keyTransport: kt}
+	if _, ok := t.u.Hosts[strings.ToLower(host)]; ok {
+		key.host = strings.ToLower(host)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tr, ok := t.pool[key]; ok {
+		return tr, nil
+	}
+	tlsConfig, err := t.u.TLSConfig(key.host)
+	if err != nil {
+		return nil, err
+	}
+	if kt.insecure {
+		slog.Warn("upstream certificate verification disabled", "host", host)
+		tlsConfig.InsecureSkipVerify = true
+	}
+	proxy := http.ProxyFromEnvironment
+	switch kt.Proxy {
+	case "":
+	case store.ProxyDirect:
+		proxy = nil
+	default:
+		u, err := url.Parse(kt.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+	dialTimeout, headerTimeout := t.u.DialTimeout, t.u.ResponseHeaderTimeout
+	if kt.DialTimeout > 0 {
+		dialTimeout = config.Duration(kt.DialTimeout)
+	}
+	if kt.ResponseHeaderTimeout > 0 {
+		headerTimeout = config.Duration(kt.ResponseHeaderTimeout)
+	}
+	tr := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout.Std(),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     !kt.DisableHTTP2,
+		MaxIdleConns:          t.u.MaxIdleConns,
+		IdleConnTimeout:       t.u.IdleConnTimeout.Std(),
+		TLSHandshakeTimeout:   t.u.TLSHandshakeTimeout.Std(),
+		ResponseHeaderTimeout: headerTimeout.Std(),
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	if kt.DisableHTTP2 {
+		// 非 nil 的空 TLSNextProto 关闭 HTTP/2
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	t.pool[key] = tr
+	return tr, nil
+}
+
+// prune 移除不在 live 中的连接设置对应的 Transport 并关闭其空闲连接, 默认设置始终保留.
+// 进行中的请求继续使用原 Transport, 之后再用到被移除的设置时重新创建
+func (t *upstreamTransport) prune(live map[keyTransport]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, tr := range t.pool {
+		if key.keyTransport == (keyTransport{}) || live[key.keyTransport] {
+			continue
+		}
+		tr.CloseIdleConnections()
+		delete(t.pool, key)
+	}
+}
+
+// pruneTransports 在 Key 修改或删除后丢弃不再被任何 Key 使用的连接池
+func (h *Handler) pruneTransports(ctx context.Context) {
+	t, ok := h.current().client.Transport.(*upstreamTransport)
+	if !ok {
+		return
+	}
+	keys, err := h.store.GetAllKeys(ctx)
+	if err != nil {
+		slog.Warn("prune upstream transports", "err", err)
+		return
+	}
+	live := map[keyTransport]bool{}
+	for i := range keys {
+		live[keyTransport{insecure: keys[i].InsecureSkipVerify, KeyTransport: keys[i].Transport}] = true
+	}
+	t.prune(live)
+}
+
+// CloseIdleConnections 关闭所有连接池中的空闲连接, 供 http.Client.CloseIdleConnections 调用
+func (t *upstreamTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.pool {
+		tr.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,68 @@
+package router
+
+import (
+	"net/http"
+	"opencatd-open/pkg/config"
+	"opencatd-open/store"
+	"strconv"
+	"testing"
+)
+
+// pooled 返回连接池中各 Key 连接设置的 Transport 数量
+func (s *testServer) pooled() map[keyTransport]int {
+	t := s.current().client.Transport.(*upstreamTransport)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	got := map[keyTransport]int{}
+	for key := range t.pool {
+		got[key.keyTransport]++
+	}
+	return got
+}
+
+func TestTransportsOfChangedKeysAreDropped(t *testing.T) {
+	up := newRecordingUpstream(t)
+	cfg := config.Default()
+	cfg.Upstream.BaseURL = up.URL
+	s := newTestServer(t, cfg, Options{})
+	root := s.initRoot(t)
+	var k store.Key
+	body := map[string]any{"key": "sk-site", "name": "k1", "endpoint": up.URL}
+	if code := s.do(t, http.MethodPost, "/1/keys?skip_validation=true", root, body, &k); code != http.StatusOK {
+		t.Fatalf("add key: status %d", code)
+	}
+	path := "/1/keys/" + strconv.Itoa(int(k.ID))
+	chat := func() {
+		t.Helper()
+		if code := s.do(t, http.MethodPost, "/v1/chat/completions", root, chatBody("gpt-4"), nil); code != http.StatusOK {
+			t.Fatalf("chat: status %d", code)
+		}
+	}
+	noH2 := keyTransport{KeyTransport: store.KeyTransport{DisableHTTP2: true}}
+	direct := keyTransport{KeyTransport: store.KeyTransport{Proxy: store.ProxyDirect}}
+
+	if code := s.do(t, http.MethodPatch, path, root, map[string]any{"transport": map[string]any{"disableHttp2": true}}, nil); code != http.StatusOK {
+		t.Fatalf("patch: status %d", code)
+	}
+	chat()
+	if got := s.pooled(); got[noH2] != 1 {
+		t.Fatalf("pool = %v, want the key's transport", got)
+	}
+
+	// 修改连接设置后旧的 Transport 被移除
+	if code := s.do(t, http.MethodPatch, path, root, map[string]any{"transport": map[string]any{"proxy": store.ProxyDirect}}, nil); code != http.StatusOK {
+		t.Fatalf("patch: status %d", code)
+	}
+	chat()
+	if got := s.pooled(); got[noH2] != 0 || got[direct] != 1 {
+		t.Fatalf("pool after update = %v", got)
+	}
+
+	// 删除 Key 后其 Transport 被移除
+	if code := s.do(t, http.MethodDelete, path, root, nil, nil); code != http.StatusOK {
+		t.Fatalf("delete: status %d", code)
+	}
+	if got := s.pooled(); got[direct] != 0 {
+		t.Errorf("pool after delete = %v", got)
+	}
+}
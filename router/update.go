@@ -0,0 +1,211 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"opencatd-open/pkg/azureopenai"
+	"opencatd-open/pkg/logger"
+	"opencatd-open/store"
+	"strings"
+
+	"github.com/Sakurasan/to"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var keyApiTypes = map[string]bool{"openai": true, "azure_openai": true}
+
+// KeyPatchReq 为 PATCH /1/keys/:id 的请求体, 省略的字段保持不变
+type KeyPatchReq struct {
+	Key         *string            `json:"key,omitempty"`
+	Name        *string            `json:"name,omitempty"`
+	ApiType     *string            `json:"api_type,omitempty"`
+	Endpoint    *string            `json:"endpoint,omitempty"`
+	Deployments *map[string]string `json:"deployments,omitempty"`
+	Enabled     *bool              `json:"enabled,omitempty"`
+	Weight      *int               `json:"weight,omitempty"`
+	Notes       *string            `json:"notes,omitempty"`
+	// InsecureSkipVerify 为 true 时不校验该 Key 上游的证书, 会记录警告
+	InsecureSkipVerify *bool `json:"insecureSkipVerify,omitempty"`
+	// Transport 整体替换该 Key 的连接设置, {} 为恢复默认
+	Transport *store.KeyTransport `json:"transport,omitempty"`
+}
+
+// UserPatchReq 为 PATCH /1/users/:id 的请求体, 角色通过 PUT /1/users/:id/role 修改
+type UserPatchReq struct {
+	Name     *string `json:"name,omitempty"`
+	Disabled *bool   `json:"disabled,omitempty"`
+	// GroupID 为 0 表示移出组
+	GroupID *uint `json:"groupId,omitempty"`
+}
+
+func (h *Handler) HandleUpdateKey(c *gin.Context) {
+	before, err := h.store.GetKeyByID(c.Request.Context(), uint(to.Int(c.Param("id"))))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invalid key id"})
+		return
+	}
+	var body KeyPatchReq
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	patch, err := body.toPatch(before)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.store.UpdateKey(c.Request.Context(), before.ID, patch); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrKeyExists) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	after, err := h.store.GetKeyByID(c.Request.Context(), before.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if after.InsecureSkipVerify && !before.InsecureSkipVerify {
+		logger.FromContext(c.Request.Context()).Warn("upstream certificate verification disabled for key", "key", after.Name)
+	}
+	h.pruneTransports(c.Request.Context())
+	h.audit(c, AuditKeyUpdate, "key", after.ID, before, after)
+	c.JSON(http.StatusOK, after)
+}
+
+// toPatch 校验请求并转换为 store.KeyPatch, 修改 endpoint 时同步 Azure 资源名
+func (r KeyPatchReq) toPatch(current *store.Key) (store.KeyPatch, error) {
+	p := store.KeyPatch{Enabled: r.Enabled, Notes: r.Notes, InsecureSkipVerify: r.InsecureSkipVerify}
+	if r.Key != nil {
+		k := strings.TrimSpace(*r.Key)
+		if k == "" {
+			return p, errors.New("key must not be empty")
+		}
+		p.Key = &k
+	}
+	if r.Name != nil {
+		name := strings.ToLower(strings.TrimSpace(*r.Name))
+		if name == "" {
+			return p, errors.New("name must not be empty")
+		}
+		p.Name = &name
+	}
+	apiType := current.ApiType
+	if r.ApiType != nil {
+		if !keyApiTypes[*r.ApiType] {
+			return p, errors.New("invalid api_type")
+		}
+		apiType = *r.ApiType
+		p.ApiType = r.ApiType
+	}
+	endpoint := current.EndPoint
+	if r.Endpoint != nil {
+		endpoint = strings.TrimSuffix(strings.TrimSpace(*r.Endpoint), "/")
+		if endpoint != "" {
+			u, err := url.Parse(endpoint)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return p, errors.New("invalid endpoint")
+			}
+		}
+		p.EndPoint = &endpoint
+	}
+	if apiType == "azure_openai" && (r.Endpoint != nil || r.ApiType != nil) {
+		if rn := azureopenai.GetResourceName(endpoint); rn != "" {
+			p.ResourceName = &rn
+		}
+	}
+	if r.Deployments != nil {
+		m := store.DeploymentMap{}
+		for model, dep := range *r.Deployments {
+			model, dep = strings.TrimSpace(model), strings.TrimSpace(dep)
+			if model == "" || dep == "" {
+				return p, errors.New("invalid deployments mapping")
+			}
+			m[model] = dep
+		}
+		p.Deployments = &m
+	}
+	if r.Weight != nil {
+		if *r.Weight < 1 {
+			return p, errors.New("weight must be at least 1")
+		}
+		p.Weight = r.Weight
+	}
+	if r.Transport != nil {
+		if err := r.Transport.Validate(); err != nil {
+			return p, err
+		}
+		p.Transport = r.Transport
+	}
+	return p, nil
+}
+
+// newKey 由 toPatch 校验后的字段构造新 Key, 未设置的字段使用默认值
+func newKey(p store.KeyPatch) *store.Key {
+	k := &store.Key{Key: *p.Key, Name: *p.Name, ApiType: *p.ApiType}
+	if p.EndPoint != nil {
+		k.EndPoint = *p.EndPoint
+	}
+	if p.ResourceName != nil {
+		k.ResourceName = *p.ResourceName
+	}
+	if p.Deployments != nil {
+		k.Deployments = *p.Deployments
+	}
+	k.Enabled = p.Enabled == nil || *p.Enabled
+	if p.Weight != nil {
+		k.Weight = *p.Weight
+	}
+	if p.Notes != nil {
+		k.Notes = *p.Notes
+	}
+	if p.InsecureSkipVerify != nil {
+		k.InsecureSkipVerify = *p.InsecureSkipVerify
+	}
+	if p.Transport != nil {
+		k.Transport = *p.Transport
+	}
+	return k
+}
+
+func (h *Handler) HandleUpdateUser(c *gin.Context) {
+	target, ok := h.manageableUser(c)
+	if !ok {
+		return
+	}
+	var body UserPatchReq
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	patch := store.UserPatch{Disabled: body.Disabled, GroupID: body.GroupID}
+	if body.Name != nil {
+		name := strings.TrimSpace(*body.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user name"})
+			return
+		}
+		patch.Name = &name
+	}
+	if err := h.store.UpdateUserFields(c.Request.Context(), target.ID, patch); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, store.ErrLastOwner) || errors.Is(err, store.ErrUserNameTaken) {
+			status = http.StatusConflict
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := h.store.GetUserByID(c.Request.Context(), target.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.audit(c, AuditUserUpdate, "user", u.ID, toUser(target), toUser(u))
+	c.JSON(http.StatusOK, toUser(u))
+}
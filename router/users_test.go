@@ -0,0 +1,84 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"opencatd-open/store"
+	"strings"
+	"testing"
+)
+
+func TestRootIsFoundByRoleNotID(t *testing.T) {
+	up := newFakeUpstream(t)
+	s := newTestServer(t, nil, Options{})
+	rootToken := s.initRoot(t)
+	s.addTestKey(t, rootToken, "k1", up.URL)
+
+	var root, second User
+	s.do(t, http.MethodGet, "/1/me", rootToken, nil, &root)
+	if code := s.do(t, http.MethodPost, "/1/users", rootToken, map[string]string{"name": "second", "role": "owner"}, &second); code != http.StatusOK || second.Token == "" {
+		t.Fatalf("add owner: status %d, user %+v", code, second)
+	}
+
+	// 另有 owner 时可以删除 root
+	var res map[string]any
+	s.do(t, http.MethodDelete, fmt.Sprintf("/1/users/%d", root.ID), second.Token, nil, &res)
+	if res["message"] != "ok" {
+		t.Fatalf("delete root while another owner exists: %v", res)
+	}
+	if code := s.do(t, http.MethodGet, "/readyz", "", nil, nil); code != http.StatusOK {
+		t.Fatalf("readyz after deleting root: status %d, want 200", code)
+	}
+	// 已有 owner 时不能再初始化
+	if code := s.do(t, http.MethodPost, "/1/users/init", "", nil, nil); code != http.StatusForbidden {
+		t.Fatalf("init with an owner present: status %d, want 403", code)
+	}
+
+	// 最后一个 owner 由 guardLastOwner 保护
+	res = nil
+	s.do(t, http.MethodDelete, fmt.Sprintf("/1/users/%d", second.ID), second.Token, nil, &res)
+	if res["error"] == nil {
+		t.Fatalf("delete last owner: %v, want an error", res)
+	}
+}
+
+// 完整 token 只在创建与重置时返回, 列表与 /1/me 只显示前缀
+func TestUserTokenIsRevealedOnce(t *testing.T) {
+	s := newTestServer(t, nil, Options{})
+	root := s.initRoot(t)
+	var alice User
+	if code := s.do(t, http.MethodPost, "/1/users", root, map[string]string{"name": "alice"}, &alice); code != http.StatusOK || alice.Token == "" {
+		t.Fatalf("add user: status %d, user %+v", code, alice)
+	}
+	if alice.TokenPrefix != store.TokenPrefix(alice.Token) {
+		t.Errorf("tokenPrefix = %q, want %q", alice.TokenPrefix, store.TokenPrefix(alice.Token))
+	}
+
+	var raw []map[string]any
+	if code := s.do(t, http.MethodGet, "/1/users", root, nil, &raw); code != http.StatusOK {
+		t.Fatalf("list users: status %d", code)
+	}
+	for _, u := range raw {
+		for k, v := range u {
+			if str, ok := v.(string); k == "token" || (ok && strings.Contains(str, alice.Token)) {
+				t.Errorf("GET /1/users exposes %s = %v", k, v)
+			}
+		}
+	}
+	var me User
+	s.do(t, http.MethodGet, "/1/me", alice.Token, nil, &me)
+	if me.ID != alice.ID || me.Token != "" || me.TokenPrefix == "" {
+		t.Errorf("/1/me = %+v", me)
+	}
+
+	var reset User
+	if code := s.do(t, http.MethodPost, fmt.Sprintf("/1/users/%d/reset", alice.ID), root, nil, &reset); code != http.StatusOK || reset.Token == "" || reset.Token == alice.Token {
+		t.Fatalf("reset: status %d, user %+v", code, reset)
+	}
+	if code := s.do(t, http.MethodGet, "/1/me", alice.Token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("old token after reset: status %d, want 401", code)
+	}
+	if code := s.do(t, http.MethodGet, "/1/me", reset.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("new token: status %d", code)
+	}
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"gorm.io/gorm"
+)
+
+const (
+	// ScopeChat 允许 /v1/chat/completions 与 /v1/completions
+	ScopeChat = "chat"
+	// ScopeEmbeddings 允许 /v1/embeddings
+	ScopeEmbeddings = "embeddings"
+	// ScopeAdmin 允许在角色权限范围内访问 /1/* 管理接口
+	ScopeAdmin = "admin"
+)
+
+var (
+	ErrTokenExpired = errors.New("token expired")
+	ErrUserDisabled = errors.New("user disabled")
+	ErrInvalidScope = errors.New("invalid scope")
+
+	validScopes = map[string]bool{ScopeChat: true, ScopeEmbeddings: true, ScopeAdmin: true}
+)
+
+// lastUsedInterval 限制 last_used_at 的写入频率
+const lastUsedInterval = time.Minute
+
+// ApiToken 是用户名下可单独吊销的命名 token
+type ApiToken struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	UserID     uint       `gorm:"index;not null" json:"userId"`
+	Name       string     `gorm:"not null" json:"name"`
+	Hash       string     `gorm:"size:255;unique;not null" json:"-"`
+	Prefix     string     `gorm:"size:64;index" json:"tokenPrefix"`
+	Scopes     string     `json:"scopes"`
+	Models     string     `json:"models,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+}
+
+func (ApiToken) TableName() string {
+	return "api_tokens"
+}
+
+// Credential 是一次认证的结果, 缓存在 Store 的认证缓存中
+type Credential struct {
+	UserID uint
+	// TokenID 为 0 表示用户主 token, 拥有全部 scope 且不限模型
+	TokenID uint
+	// GroupID 为用户所属组, 0 表示未分组
+	GroupID   uint
+	Scopes    []string
+	Models    []string
+	ExpiresAt *time.Time
+
+	touchedAt atomic.Int64
+}
+
+func (c *Credential) Allows(scope string) bool {
+	if c.TokenID == 0 {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Credential) AllowsModel(model string) bool {
+	if len(c.Models) == 0 {
+		return true
+	}
+	for _, m := range c.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Credential) expired() bool {
+	return c.ExpiresAt != nil && time.Now().After(*c.ExpiresAt)
+}
+
+// NormalizeScopes 校验并去重 scope, 为空时默认 chat 与 embeddings
+func NormalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return []string{ScopeChat, ScopeEmbeddings}, nil
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range scopes {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !validScopes[s] {
+			return nil, ErrInvalidScope
+		}
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// CreateApiToken 为用户创建命名 token, token 为明文, 只保存哈希
+func (s *Store) CreateApiToken(ctx context.Context, t *ApiToken, token string, scopes, models []string) error {
+	t.Hash = HashToken(token)
+	t.Prefix = TokenPrefix(token)
+	t.Scopes = strings.Join(scopes, ",")
+	t.Models = strings.Join(models, ",")
+	return s.db.WithContext(ctx).Create(t).Error
+}
+
+func (s *Store) ListApiTokens(ctx context.Context, userID uint) ([]ApiToken, error) {
+	var tokens []ApiToken
+	if err := s.db.WithContext(ctx).Where("user_id = ?", userID).Order("id").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *Store) GetApiToken(ctx context.Context, userID, id uint) (*ApiToken, error) {
+	var t ApiToken
+	if err := s.db.WithContext(ctx).Where("user_id = ? AND id = ?", userID, id).First(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RevokeApiToken 删除用户名下的 token 并清空认证缓存
+func (s *Store) RevokeApiToken(ctx context.Context, userID, id uint) error {
+	result := s.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&ApiToken{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	s.LoadAuthCache()
+	return nil
+}
+
+// Authenticate 解析 bearer token: 先查缓存, 再依次匹配用户主 token 与命名 token
+func (s *Store) Authenticate(ctx context.Context, token string) (*Credential, error) {
+	key := tokenCacheKey(token)
+	// 查库期间缓存可能被 LoadAuthCache 替换, 结果只写回查询前的缓存, 避免把失效的凭据写入新缓存
+	ac := s.authCache.Load()
+	if v, ok := ac.Get(key); ok {
+		cred := v.(*Credential)
+		if cred.expired() {
+			ac.Delete(key)
+			return nil, ErrTokenExpired
+		}
+		s.touchApiToken(ctx, cred)
+		return cred, nil
+	}
+
+	var cred *Credential
+	if u, err := s.GetUserByToken(ctx, token); err == nil {
+		if u.Disabled {
+			return nil, ErrUserDisabled
+		}
+		cred = &Credential{UserID: u.ID, GroupID: u.groupID()}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	} else {
+		t, err := s.getApiTokenByToken(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		// 用户已删除或禁用时其命名 token 一并失效
+		u, err := s.GetUserByID(ctx, t.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if u.Disabled {
+			return nil, ErrUserDisabled
+		}
+		cred = &Credential{
+			UserID:    t.UserID,
+			TokenID:   t.ID,
+			GroupID:   u.groupID(),
+			Scopes:    splitList(t.Scopes),
+			Models:    splitList(t.Models),
+			ExpiresAt: t.ExpiresAt,
+		}
+		if cred.expired() {
+			return nil, ErrTokenExpired
+		}
+		s.touchApiToken(ctx, cred)
+	}
+	ac.Set(key, cred, cache.NoExpiration)
+	return cred, nil
+}
+
+func (s *Store) getApiTokenByToken(ctx context.Context, token string) (*ApiToken, error) {
+	var tokens []ApiToken
+	if err := s.db.WithContext(ctx).Where("prefix = ?", TokenPrefix(token)).Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		if VerifyToken(token, tokens[i].Hash) {
+			return &tokens[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+// touchApiToken 更新命名 token 的 last_used_at, 每个 token 每分钟最多写一次
+func (s *Store) touchApiToken(ctx context.Context, cred *Credential) {
+	if cred.TokenID == 0 {
+		return
+	}
+	now := time.Now()
+	last := cred.touchedAt.Load()
+	if now.Sub(time.Unix(0, last)) < lastUsedInterval || !cred.touchedAt.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	s.db.WithContext(ctx).Model(&ApiToken{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", cred.TokenID, now.Add(-lastUsedInterval)).
+		Update("last_used_at", now)
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrAuditImmutable = errors.New("audit events are append-only")
+
+// AuditEvent 记录一次管理操作, 只追加不修改
+type AuditEvent struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	ActorID    uint      `gorm:"index" json:"actorId"`
+	ActorName  string    `json:"actorName"`
+	Action     string    `gorm:"size:64;index" json:"action"`
+	TargetType string    `gorm:"size:64;index:idx_audit_target" json:"targetType"`
+	TargetID   uint      `gorm:"index:idx_audit_target" json:"targetId"`
+	Diff       RawJSON   `json:"diff,omitempty"`
+	ClientIP   string    `json:"clientIp"`
+	RequestID  string    `json:"requestId,omitempty"`
+	CreatedAt  time.Time `gorm:"index" json:"createdAt"`
+}
+
+func (AuditEvent) TableName() string {
+	return "audit_events"
+}
+
+func (AuditEvent) BeforeUpdate(*gorm.DB) error { return ErrAuditImmutable }
+
+func (AuditEvent) BeforeDelete(*gorm.DB) error { return ErrAuditImmutable }
+
+// RawJSON 以 TEXT 存储, 序列化时原样输出为 JSON
+type RawJSON string
+
+func (r RawJSON) MarshalJSON() ([]byte, error) {
+	if r == "" {
+		return []byte("null"), nil
+	}
+	return []byte(r), nil
+}
+
+type FieldChange struct {
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// 不计入 diff 的字段, 密文与 token 哈希本身已通过 json:"-" 排除
+var diffIgnored = map[string]bool{
+	"createdAt": true, "updatedAt": true, "CreatedAt": true, "UpdatedAt": true, "DeletedAt": true, "ID": true,
+}
+
+// Diff 按 JSON 字段比较 before 与 after, 任一为 nil 表示创建或删除
+func Diff(before, after interface{}) map[string]FieldChange {
+	b, a := toFieldMap(before), toFieldMap(after)
+	changes := map[string]FieldChange{}
+	for k, v := range a {
+		if diffIgnored[k] {
+			continue
+		}
+		if old, ok := b[k]; !ok || !reflect.DeepEqual(old, v) {
+			changes[k] = FieldChange{Old: b[k], New: v}
+		}
+	}
+	for k, v := range b {
+		if diffIgnored[k] {
+			continue
+		}
+		if _, ok := a[k]; !ok {
+			changes[k] = FieldChange{Old: v}
+		}
+	}
+	return changes
+}
+
+func toFieldMap(v interface{}) map[string]interface{} {
+	m := map[string]interface{}{}
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return m
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return m
+	}
+	json.Unmarshal(b, &m)
+	return m
+}
+
+func (s *Store) RecordAudit(ctx context.Context, e *AuditEvent, changes map[string]FieldChange) error {
+	if len(changes) > 0 {
+		b, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		e.Diff = RawJSON(b)
+	}
+	return s.db.WithContext(ctx).Create(e).Error
+}
+
+type AuditFilter struct {
+	ActorID    uint
+	Action     string
+	TargetType string
+	TargetID   uint
+	From       *time.Time
+	To         *time.Time
+	Page       int
+	PageSize   int
+}
+
+// QueryAuditEvents 按条件倒序分页查询, 返回当前页与总数
+func (s *Store) QueryAuditEvents(ctx context.Context, f AuditFilter) ([]AuditEvent, int64, error) {
+	q := s.db.WithContext(ctx).Model(&AuditEvent{})
+	if f.ActorID > 0 {
+		q = q.Where("actor_id = ?", f.ActorID)
+	}
+	if f.Action != "" {
+		q = q.Where("action = ?", f.Action)
+	}
+	if f.TargetType != "" {
+		q = q.Where("target_type = ?", f.TargetType)
+	}
+	if f.TargetID > 0 {
+		q = q.Where("target_id = ?", f.TargetID)
+	}
+	if f.From != nil {
+		q = q.Where("created_at >= ?", *f.From)
+	}
+	if f.To != nil {
+		q = q.Where("created_at < ?", *f.To)
+	}
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var events []AuditEvent
+	err := q.Order("id DESC").Limit(f.PageSize).Offset((f.Page - 1) * f.PageSize).Find(&events).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuditEventsAreAppendOnly(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	e := &AuditEvent{ActorID: 1, ActorName: "root", Action: "key.update", TargetType: "key", TargetID: 7}
+	if err := s.RecordAudit(ctx, e, map[string]FieldChange{"weight": {Old: 1, New: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Model(e).Update("actor_name", "mallory").Error; !errors.Is(err, ErrAuditImmutable) {
+		t.Errorf("update: err = %v, want ErrAuditImmutable", err)
+	}
+	if err := s.db.Delete(e).Error; !errors.Is(err, ErrAuditImmutable) {
+		t.Errorf("delete: err = %v, want ErrAuditImmutable", err)
+	}
+	var got AuditEvent
+	if err := s.db.First(&got, e.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.ActorName != "root" || got.Diff != `{"weight":{"old":1,"new":2}}` {
+		t.Errorf("event after update and delete = %+v", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	before := &Key{ID: 1, Name: "k1", Key: "enc:old", KeyHint: "sk-...1234", Weight: 1, Enabled: true, UpdatedAt: time.Unix(1, 0)}
+	after := *before
+	after.Key, after.Weight, after.UpdatedAt = "enc:new", 3, time.Unix(2, 0)
+
+	// 只记录变化的字段, 密文与更新时间不计入
+	got := Diff(before, &after)
+	if len(got) != 1 || got["weight"].Old != float64(1) || got["weight"].New != float64(3) {
+		t.Errorf("update diff = %v, want only weight 1 -> 3", got)
+	}
+	if got := Diff(before, before); len(got) != 0 {
+		t.Errorf("unchanged diff = %v", got)
+	}
+
+	created := Diff((*Key)(nil), &Key{Name: "k2", KeyHint: "sk-...5678"})
+	if c := created["name"]; c.Old != nil || c.New != "k2" {
+		t.Errorf("create diff name = %+v", c)
+	}
+	if c := created["key"]; c.New != "sk-...5678" {
+		t.Errorf("create diff key = %+v, want the hint", c)
+	}
+
+	deleted := Diff(&User{Name: "alice", Token: "sha256$salt$hash", Role: RoleMember}, nil)
+	if c := deleted["name"]; c.Old != "alice" || c.New != nil {
+		t.Errorf("delete diff name = %+v", c)
+	}
+	for k, c := range deleted {
+		if c.Old == "sha256$salt$hash" {
+			t.Errorf("delete diff records the token hash as %s", k)
+		}
+	}
+}
+
+func TestQueryAuditEventsPages(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		e := &AuditEvent{ActorID: 1, Action: "user.update", TargetType: "user", TargetID: uint(i % 2)}
+		if err := s.RecordAudit(ctx, e, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, total, err := s.QueryAuditEvents(ctx, AuditFilter{Action: "user.update", Page: 2, PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 || len(events) != 2 || events[0].ID != 3 || events[1].ID != 2 {
+		t.Errorf("page 2: total %d, events %+v", total, events)
+	}
+	events, total, err = s.QueryAuditEvents(ctx, AuditFilter{TargetType: "user", TargetID: 1, Page: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(events) != 3 || events[0].ID != 5 {
+		t.Errorf("target user 1: total %d, events %+v", total, events)
+	}
+}
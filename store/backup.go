@@ -0,0 +1,233 @@
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrBackupUnsupported = errors.New("backup and restore only support sqlite, use the database's own tools instead")
+
+const (
+	backupManifest = "manifest.json"
+	backupMainDB   = "cat.db"
+	backupUsageDB  = "usage.db"
+)
+
+// BackupManifest 记录备份包的内容. 备份不包含主密钥, 恢复后需使用备份时的主密钥才能解密上游 Key
+type BackupManifest struct {
+	Format           int               `json:"format"`
+	CreatedAt        time.Time         `json:"createdAt"`
+	MasterKeyVersion uint32            `json:"masterKeyVersion"`
+	Files            map[string]string `json:"files"` // 文件名 -> sha256
+}
+
+// Backup 通过 VACUUM INTO 为主库与用量库各生成一致的快照, 打包为 tar.gz 写入 w.
+// 快照期间不阻塞写入
+func (s *Store) Backup(ctx context.Context, w io.Writer) error {
+	if dialect(s.db) != DriverSQLite || dialect(s.usage) != DriverSQLite {
+		return ErrBackupUnsupported
+	}
+	dir, err := os.MkdirTemp("", "opencatd-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	m := BackupManifest{
+		Format:           1,
+		CreatedAt:        time.Now().UTC(),
+		MasterKeyVersion: s.ActiveMasterKey().Version,
+		Files:            map[string]string{},
+	}
+	for name, d := range map[string]*gorm.DB{backupMainDB: s.db, backupUsageDB: s.usage} {
+		path := filepath.Join(dir, name)
+		if err := d.WithContext(ctx).Exec("VACUUM INTO ?", path).Error; err != nil {
+			return fmt.Errorf("snapshot %s: %w", name, err)
+		}
+		if m.Files[name], err = fileSHA256(path); err != nil {
+			return err
+		}
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: backupManifest, Mode: 0600, Size: int64(len(manifest)), ModTime: m.CreatedAt}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	for _, name := range []string{backupMainDB, backupUsageDB} {
+		if err := addTarFile(tw, filepath.Join(dir, name), name, m.CreatedAt); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addTarFile(tw *tar.Writer, path, name string, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: fi.Size(), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Restore 用 Backup 生成的备份包替换 cfg 指向的 sqlite 库, 必须在服务停止时执行.
+// 校验摘要与 PRAGMA integrity_check 全部通过后才替换, 原文件保留为 .bak
+func Restore(cfg Config, r io.Reader) (*BackupManifest, error) {
+	if cfg.Driver != DriverSQLite || cfg.DSN == ":memory:" || cfg.UsageDSN == ":memory:" {
+		return nil, ErrBackupUnsupported
+	}
+	targets := map[string]string{backupMainDB: cfg.DSN, backupUsageDB: cfg.UsageDSN}
+	// 解包到目标目录下的临时文件, 保证最后的 rename 不跨文件系统
+	staged := map[string]string{}
+	defer func() {
+		for _, p := range staged {
+			os.Remove(p)
+		}
+	}()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("read backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	var m *BackupManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read backup: %w", err)
+		}
+		if hdr.Name == backupManifest {
+			m = &BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("read manifest: %w", err)
+			}
+			continue
+		}
+		target, ok := targets[hdr.Name]
+		if !ok || staged[hdr.Name] != "" {
+			return nil, fmt.Errorf("unexpected file %q in backup", hdr.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".restore-")
+		if err != nil {
+			return nil, err
+		}
+		staged[hdr.Name] = f.Name()
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read backup: %w", err)
+		}
+	}
+	if m == nil {
+		return nil, errors.New("backup has no manifest")
+	}
+
+	for name := range targets {
+		path, ok := staged[name]
+		if !ok {
+			return nil, fmt.Errorf("backup is missing %s", name)
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return nil, err
+		}
+		if sum != m.Files[name] {
+			return nil, fmt.Errorf("%s: checksum mismatch", name)
+		}
+		if err := checkSnapshot(path, name); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	for name, target := range targets {
+		for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+			os.Remove(target + suffix)
+		}
+		if err := os.Rename(target, target+".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err := os.Rename(staged[name], target); err != nil {
+			return nil, err
+		}
+		delete(staged, name)
+	}
+	return m, nil
+}
+
+// checkSnapshot 对快照执行 integrity_check, 并确认其中有对应库的表
+func checkSnapshot(path, name string) error {
+	d, err := openDB(DriverSQLite, path)
+	if err != nil {
+		return err
+	}
+	if sqlDB, err := d.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	var result string
+	if err := d.Raw("PRAGMA integrity_check").Scan(&result).Error; err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	var table interface{} = &User{}
+	if name == backupUsageDB {
+		table = &Usage{}
+	}
+	if !d.Migrator().HasTable(table) {
+		return errors.New("not an opencatd database")
+	}
+	return nil
+}
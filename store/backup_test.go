@@ -0,0 +1,205 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"opencatd-open/pkg/secret"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newFileStore(t *testing.T, kr *secret.Keyring) (*Store, Config) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := Config{
+		Driver:   DriverSQLite,
+		DSN:      filepath.Join(dir, "cat.db"),
+		UsageDSN: filepath.Join(dir, "usage.db"),
+		Keyring:  kr,
+	}
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, cfg
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	kr := secret.NewKeyring(secret.GenerateMasterKey(1))
+	s, cfg := newFileStore(t, kr)
+	ctx := context.Background()
+	if err := s.CreateUser(ctx, &User{Name: "alice", Token: "sk-alice", Role: RoleOwner}); err != nil {
+		t.Fatal(err)
+	}
+	k := &Key{Name: "k1", Key: "sk-upstream", ApiType: "openai"}
+	if err := s.CreateKey(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Record(ctx, &Tokens{UserID: 1, TotalTokens: 3, Cost: "0.5", Model: "gpt-4"}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.Backup(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// 备份之后的修改在恢复后消失
+	if err := s.CreateUser(ctx, &User{Name: "bob", Token: "sk-bob", Role: RoleMember}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	m, err := Restore(cfg, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MasterKeyVersion != 1 {
+		t.Errorf("manifest master key version = %d, want 1", m.MasterKeyVersion)
+	}
+	for _, path := range []string{cfg.DSN, cfg.UsageDSN} {
+		if _, err := os.Stat(path + ".bak"); err != nil {
+			t.Errorf("previous database not kept: %v", err)
+		}
+	}
+
+	restored, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { restored.Close() })
+	if _, err := restored.GetUserByToken(ctx, "sk-alice"); err != nil {
+		t.Errorf("alice after restore: %v", err)
+	}
+	if _, err := restored.GetUserByName(ctx, "bob"); err == nil {
+		t.Error("user created after the backup survived the restore")
+	}
+	got, err := restored.GetKeyByID(ctx, k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := restored.KeySecret(*got); err != nil || plain != "sk-upstream" {
+		t.Errorf("restored key = %q, %v", plain, err)
+	}
+	var n int64
+	if err := restored.usage.Model(&Usage{}).Count(&n).Error; err != nil || n != 1 {
+		t.Errorf("restored usages = %d, %v, want 1", n, err)
+	}
+}
+
+type tarFile struct {
+	name string
+	data []byte
+}
+
+func readBackup(t *testing.T, backup []byte) []tarFile {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var files []tarFile
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, tarFile{hdr.Name, data})
+	}
+}
+
+func writeBackup(t *testing.T, files []tarFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRestoreRejectsDamagedBackups(t *testing.T) {
+	s, cfg := newFileStore(t, secret.NewKeyring(secret.GenerateMasterKey(1)))
+	ctx := context.Background()
+	if err := s.CreateUser(ctx, &User{Name: "alice", Token: "sk-alice", Role: RoleOwner}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.Backup(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	before, err := os.ReadFile(cfg.DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// edit 修改备份包中的文件列表
+	tests := map[string]func(files []tarFile) []tarFile{
+		"checksum": func(files []tarFile) []tarFile {
+			for _, f := range files {
+				if f.name == backupUsageDB {
+					f.data[len(f.data)/2] ^= 0xff
+				}
+			}
+			return files
+		},
+		"missing file": func(files []tarFile) []tarFile {
+			var out []tarFile
+			for _, f := range files {
+				if f.name != backupUsageDB {
+					out = append(out, f)
+				}
+			}
+			return out
+		},
+		"no manifest": func(files []tarFile) []tarFile {
+			return files[1:]
+		},
+		"unexpected file": func(files []tarFile) []tarFile {
+			return append(files, tarFile{"../escape.db", []byte("x")})
+		},
+	}
+	damaged := map[string][]byte{"not gzip": []byte("not a backup")}
+	for name, edit := range tests {
+		damaged[name] = writeBackup(t, edit(readBackup(t, buf.Bytes())))
+	}
+	for name, b := range damaged {
+		if _, err := Restore(cfg, bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: restore succeeded", name)
+		}
+	}
+	after, err := os.ReadFile(cfg.DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("a rejected restore modified the database")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(cfg.DSN), "*.restore-*")); len(matches) > 0 {
+		t.Errorf("staged files left behind: %v", matches)
+	}
+}
@@ -1,59 +1,114 @@
 package store
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"math/rand"
+	"sort"
 
 	"github.com/Sakurasan/to"
 	"github.com/patrickmn/go-cache"
 )
 
-var (
-	KeysCache *cache.Cache
-	AuthCache *cache.Cache
-)
-
-func init() {
-	KeysCache = cache.New(cache.NoExpiration, cache.NoExpiration)
-	AuthCache = cache.New(cache.NoExpiration, cache.NoExpiration)
-}
-
-func LoadKeysCache() {
-	KeysCache = cache.New(cache.NoExpiration, cache.NoExpiration)
-	keys, err := GetAllKeys()
+// LoadKeysCache 从数据库重建可用 Key 的缓存, 构建完成后整体替换, 请求不会看到空缓存
+func (s *Store) LoadKeysCache(ctx context.Context) {
+	keys, err := s.GetAllKeys(ctx)
 	if err != nil {
-		log.Println(err)
+		slog.Error("load keys cache", "err", err)
 		return
 	}
-	for idx, key := range keys {
-		KeysCache.Set(to.String(idx), key, cache.NoExpiration)
+	c := cache.New(cache.NoExpiration, cache.NoExpiration)
+	idx := 0
+	for _, key := range keys {
+		if !key.Enabled {
+			continue
+		}
+		if key.InsecureSkipVerify {
+			slog.Warn("upstream certificate verification disabled for key", "key", key.Name)
+		}
+		c.Set(to.String(idx), key, cache.NoExpiration)
+		idx++
 	}
+	s.keysCache.Store(c)
+}
+
+// KeyCount 返回参与调度的 Key 数量
+func (s *Store) KeyCount() int {
+	return s.keysCache.Load().ItemCount()
 }
 
-func FromKeyCacheRandomItemKey() Key {
-	items := KeysCache.Items()
-	if len(items) == 1 {
-		return items[to.String(0)].Object.(Key)
+// FromKeyCacheRandomItemKey 按权重随机选取一个 Key
+func (s *Store) FromKeyCacheRandomItemKey() Key {
+	items := s.keysCache.Load().Items()
+	keys := make([]Key, 0, len(items))
+	for i := 0; i < len(items); i++ {
+		keys = append(keys, items[to.String(i)].Object.(Key))
 	}
-	idx := rand.Intn(len(items))
-	item := items[to.String(idx)]
-	return item.Object.(Key)
+	return pickWeighted(keys)
 }
 
-func LoadAuthCache() {
-	AuthCache = cache.New(cache.NoExpiration, cache.NoExpiration)
-	users, err := GetAllUsers()
-	if err != nil {
-		log.Println(err)
-		return
+// SelectKey 为组链 (自下而上) 选取 Key: 最近的设置了专用 Key 的组从其专用 Key 中选取,
+// 否则从未被任何组独占的 Key 中选取. roundRobin 为 true 时轮询, 否则按权重随机
+func (s *Store) SelectKey(chain []Group, roundRobin bool) (Key, bool) {
+	var allowed map[uint]bool
+	for _, g := range chain {
+		if ids := g.KeyIDList(); len(ids) > 0 {
+			allowed = map[uint]bool{}
+			for _, id := range ids {
+				allowed[id] = true
+			}
+			break
+		}
+	}
+	reserved := s.reservedKeyIDs()
+	var keys []Key
+	for _, item := range s.keysCache.Load().Items() {
+		k := item.Object.(Key)
+		if (allowed != nil && allowed[k.ID]) || (allowed == nil && !reserved[k.ID]) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return Key{}, false
 	}
-	for _, user := range users {
-		AuthCache.Set(user.Token, true, cache.NoExpiration)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	if roundRobin {
+		return keys[(s.roundRobin.Add(1)-1)%uint64(len(keys))], true
 	}
+	return pickWeighted(keys), true
+}
+
+func pickWeighted(keys []Key) Key {
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	total := 0
+	for _, k := range keys {
+		total += keyWeight(k)
+	}
+	n := rand.Intn(total)
+	for _, k := range keys {
+		if n -= keyWeight(k); n < 0 {
+			return k
+		}
+	}
+	return keys[0]
+}
+
+func keyWeight(k Key) int {
+	if k.Weight < 1 {
+		return 1
+	}
+	return k.Weight
+}
+
+// LoadAuthCache 清空已验证 token 的缓存, 用户或 token 变更后调用.
+// token 只以哈希保存在库中, 缓存在 Authenticate 首次验证通过时按需填充
+func (s *Store) LoadAuthCache() {
+	s.authCache.Store(cache.New(cache.NoExpiration, cache.NoExpiration))
 }
 
-func IsExistAuthCache(auth string) bool {
-	items := AuthCache.Items()
-	_, ok := items[auth]
-	return ok
+func (s *Store) IsExistAuthCache(ctx context.Context, auth string) bool {
+	_, err := s.GetUserID(ctx, auth)
+	return err == nil
 }
@@ -1,45 +1,178 @@
 package store
 
 import (
-	"log"
-	"os"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"opencatd-open/pkg/secret"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	// "gorm.io/driver/sqlite"
-	"github.com/glebarez/sqlite"
+	"github.com/patrickmn/go-cache"
 	"gorm.io/gorm"
 )
 
-var db *gorm.DB
+// Store 持有主库、用量库、主密钥与各类缓存, 由 Open 创建
+type Store struct {
+	db    *gorm.DB
+	usage *gorm.DB
 
-var usage *gorm.DB
+	// keyring 用于加解密上游 API Key, 主密钥文件被轮换后整体替换
+	keyring atomic.Pointer[secret.Keyring]
 
-func init() {
-	if _, err := os.Stat("db"); os.IsNotExist(err) {
-		errDir := os.MkdirAll("db", 0755)
-		if errDir != nil {
-			log.Fatalln("Error creating directory:", err)
+	// 缓存由 Load*Cache 整体替换, 与请求中的读取并发, 因此使用原子指针
+	keysCache   atomic.Pointer[cache.Cache]
+	authCache   atomic.Pointer[cache.Cache]
+	groupsCache atomic.Pointer[cache.Cache]
+	// spendCache 缓存 GroupSpend 的结果 groupSpendTTL, 预算检查不必每个请求都汇总用量
+	spendCache *cache.Cache
+
+	// roundRobin 为轮换选取 Key 的计数
+	roundRobin atomic.Uint64
+}
+
+// Open 连接数据库, 完成表结构迁移并加载缓存
+func Open(cfg Config) (*Store, error) {
+	s := &Store{spendCache: cache.New(groupSpendTTL, time.Minute)}
+	s.keysCache.Store(cache.New(cache.NoExpiration, cache.NoExpiration))
+	s.authCache.Store(cache.New(cache.NoExpiration, cache.NoExpiration))
+	s.groupsCache.Store(cache.New(cache.NoExpiration, cache.NoExpiration))
+	kr := cfg.Keyring
+	if kr == nil {
+		if err := checkKeyFileLocation(cfg, secret.KeyFile(cfg.MasterKeyFile)); err != nil {
+			return nil, err
+		}
+		var generated bool
+		var err error
+		if kr, generated, err = secret.LoadKeyring(cfg.MasterKeyFile); err != nil {
+			return nil, fmt.Errorf("load master key: %w", err)
+		}
+		if generated {
+			slog.Warn("generated master key " + kr.File + "; keep a copy, upstream keys cannot be decrypted without it")
 		}
 	}
+	s.keyring.Store(kr)
+
 	var err error
-	db, err = gorm.Open(sqlite.Open("./db/cat.db"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect database")
+	if s.db, err = openDB(cfg.Driver, cfg.DSN); err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	if s.usage, err = openDB(cfg.Driver, cfg.UsageDSN); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("open usage database: %w", err)
+	}
+	if err := s.migrate(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	if !cfg.SkipMigrations {
+		if _, err := s.MigrateUp(); err != nil {
+			s.Close()
+			return nil, err
+		}
 	}
+	s.LoadKeysCache(context.Background())
+	s.LoadGroupsCache(context.Background())
+	s.LoadAuthCache()
+	return s, nil
+}
 
-	// 自动迁移 User 结构体
-	err = db.AutoMigrate(&User{}, &Key{})
-	if err != nil {
-		panic(err)
+// migrate 建表与加列; 修复约束与历史数据的版本化迁移见 MigrateUp
+func (s *Store) migrate() error {
+	if err := s.db.AutoMigrate(&User{}, &Key{}, &ApiToken{}, &AuditEvent{}, &Session{}, &Group{}); err != nil {
+		return err
 	}
-	LoadKeysCache()
-	LoadAuthCache()
+	return s.usage.AutoMigrate(&DailyUsage{}, &Usage{})
+}
 
-	usage, err = gorm.Open(sqlite.Open("./db/usage.db"), &gorm.Config{})
-	if err != nil {
-		panic(err)
+// checkKeyFileLocation 拒绝与 sqlite 数据库放在同一目录的主密钥文件, 否则拿到数据卷即可解密全部 Key;
+// 开发模式下不检查
+func checkKeyFileLocation(cfg Config, file string) error {
+	if file == "" || cfg.Driver != DriverSQLite || secret.DevMode() {
+		return nil
+	}
+	for _, dsn := range []string{cfg.DSN, cfg.UsageDSN} {
+		if dsn == "" || dsn == ":memory:" || strings.HasPrefix(dsn, "file:") {
+			continue
+		}
+		dataDir, err := filepath.Abs(filepath.Dir(dsn))
+		if err != nil {
+			return err
+		}
+		keyDir, err := filepath.Abs(filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(dataDir, keyDir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("master key file %s is inside the data directory %s, move it to another volume (OPENCATD_MASTER_KEY_DEV=true allows this for development)", file, dataDir)
+		}
 	}
-	err = usage.AutoMigrate(&DailyUsage{}, &Usage{})
+	return nil
+}
+
+// KeyringFile 返回主密钥文件路径, 主密钥来自环境变量时为空
+func (s *Store) KeyringFile() string {
+	return s.keyring.Load().File
+}
+
+// ActiveMasterKey 返回当前主密钥
+func (s *Store) ActiveMasterKey() secret.MasterKey {
+	return s.keyring.Load().Active()
+}
+
+// currentKeyring 返回最新的 Keyring: 主密钥文件被 rotate_master_key 修改后, 运行中的服务无需重启即可使用新主密钥
+func (s *Store) currentKeyring() *secret.Keyring {
+	kr := s.keyring.Load()
+	next, err := kr.Refresh()
 	if err != nil {
-		panic(err)
+		slog.Warn("reload master key file", "file", kr.File, "err", err)
+		return kr
+	}
+	if next != kr && s.keyring.CompareAndSwap(kr, next) {
+		slog.Info("master key file changed, reloaded", "file", kr.File, "version", next.Active().Version)
+	}
+	return s.keyring.Load()
+}
+
+func (s *Store) conns() map[string]*gorm.DB {
+	conns := map[string]*gorm.DB{}
+	if s.db != nil {
+		conns["db"] = s.db
+	}
+	if s.usage != nil {
+		conns["usage"] = s.usage
+	}
+	return conns
+}
+
+// Ping 检查主库与用量库是否可用
+func (s *Store) Ping(ctx context.Context) error {
+	for name, d := range s.conns() {
+		sqlDB, err := d.DB()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := sqlDB.PingContext(ctx); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Close 关闭主库与用量库
+func (s *Store) Close() error {
+	var errs []error
+	for name, d := range s.conns() {
+		sqlDB, err := d.DB()
+		if err == nil {
+			err = sqlDB.Close()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
 	}
+	return errors.Join(errs...)
 }
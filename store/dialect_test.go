@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"opencatd-open/pkg/secret"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dryRunDBs 返回各驱动的 DryRun 连接, 只生成 SQL 不连接数据库, 用于检查方言相关的引号
+func dryRunDBs(t *testing.T) map[string]*gorm.DB {
+	t.Helper()
+	dialectors := map[string]gorm.Dialector{
+		DriverSQLite:   sqlite.Open(":memory:"),
+		DriverMySQL:    mysql.New(mysql.Config{DSN: "cat:cat@tcp(127.0.0.1:3306)/cat", SkipInitializeWithVersion: true}),
+		DriverPostgres: postgres.New(postgres.Config{DSN: "host=127.0.0.1 user=cat dbname=cat"}),
+	}
+	dbs := map[string]*gorm.DB{}
+	for name, d := range dialectors {
+		db, err := gorm.Open(d, &gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: newGormLogger()})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		dbs[name] = db
+	}
+	return dbs
+}
+
+// quoted 按方言给标识符加引号
+func quoted(driver, name string) string {
+	if driver == DriverMySQL || driver == DriverSQLite {
+		return "`" + name + "`"
+	}
+	return `"` + name + `"`
+}
+
+func TestFingerprintIndexIsQuoted(t *testing.T) {
+	for driver, db := range dryRunDBs(t) {
+		// keys 是 MySQL 的保留字, 建索引时表名必须加引号
+		sql := db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+			return createUniqueIndex(tx, keyFingerprintIndex, "keys", "key_fingerprint")
+		})
+		want := "CREATE UNIQUE INDEX " + quoted(driver, keyFingerprintIndex) + " ON " + quoted(driver, "keys") + " (" + quoted(driver, "key_fingerprint") + ")"
+		if sql != want {
+			t.Errorf("%s: fingerprint index = %s, want %s", driver, sql, want)
+		}
+	}
+}
+
+func TestKeyColumnIsQuoted(t *testing.T) {
+	for driver, db := range dryRunDBs(t) {
+		// key 列与 keys 表都是 MySQL 的保留字, 查询时必须经由 clause.Column 加引号
+		sql := db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("? NOT LIKE ?", clause.Column{Name: "key"}, "enc:%").Find(&[]Key{})
+		})
+		for _, want := range []string{quoted(driver, "key") + " NOT LIKE", "FROM " + quoted(driver, "keys")} {
+			if !strings.Contains(sql, want) {
+				t.Errorf("%s: sql = %s, want %s", driver, sql, want)
+			}
+		}
+	}
+}
+
+// TestRealDatabases 在 OPENCATD_TEST_MYSQL_DSN 或 OPENCATD_TEST_POSTGRES_DSN 指定的数据库上
+// 执行迁移与常用查询, 未设置时跳过. 测试结束会删除所有表, 只能指向测试专用的库
+func TestRealDatabases(t *testing.T) {
+	for driver, env := range map[string]string{
+		DriverMySQL:    "OPENCATD_TEST_MYSQL_DSN",
+		DriverPostgres: "OPENCATD_TEST_POSTGRES_DSN",
+	} {
+		t.Run(driver, func(t *testing.T) {
+			dsn := os.Getenv(env)
+			if dsn == "" {
+				t.Skip(env + " not set")
+			}
+			s, err := Open(Config{
+				Driver:   driver,
+				DSN:      dsn,
+				UsageDSN: dsn,
+				Keyring:  secret.NewKeyring(secret.GenerateMasterKey(1)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				s.db.Migrator().DropTable(&User{}, &Key{}, &ApiToken{}, &AuditEvent{}, &Session{}, &Group{}, &SchemaMigration{}, &DailyUsage{}, &Usage{})
+				s.Close()
+			})
+			ctx := context.Background()
+
+			if err := s.CreateKey(ctx, &Key{Name: "k1", Key: "sk-1", ApiType: "openai"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CreateKey(ctx, &Key{Name: "k2", Key: "sk-1", ApiType: "openai"}); !errors.Is(err, ErrKeyExists) {
+				t.Errorf("duplicate key: err = %v, want ErrKeyExists", err)
+			}
+			if err := s.migrateKeyEncryption(s.db); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Record(ctx, &Tokens{UserID: 1, PromptCount: 1, CompletionCount: 2, TotalTokens: 3, Cost: "0.5", Model: "gpt-4"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SumDaily(ctx, 1); err != nil {
+				t.Fatal(err)
+			}
+			today := time.Now().UTC()
+			got, err := s.QueryUserUsage(ctx, "1", today.AddDate(0, 0, -1).Format("2006-01-02"), today.AddDate(0, 0, 1).Format("2006-01-02"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.TotalUnit != 3 {
+				t.Errorf("QueryUserUsage total = %d, want 3", got.TotalUnit)
+			}
+			if _, err := s.MigrateDown(len(s.migrations())); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.MigrateUp(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
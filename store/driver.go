@@ -0,0 +1,78 @@
+package store
+
+import (
+	"fmt"
+	"opencatd-open/pkg/secret"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// 支持的数据库驱动
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMySQL    = "mysql"
+)
+
+// Config 描述两个逻辑库 (主库与用量库) 的连接方式与主密钥来源
+type Config struct {
+	Driver string
+	// DSN 为主库 (用户, Key, 令牌等) 的连接串, sqlite 时为文件路径, ":memory:" 为内存库
+	DSN string
+	// UsageDSN 为用量库的连接串; 两者可指向同一个库, 表名互不冲突
+	UsageDSN string
+	// MasterKeyFile 为开发模式 (OPENCATD_MASTER_KEY_DEV=true) 下未配置主密钥时使用的文件, 不存在则生成
+	MasterKeyFile string
+	// Keyring 非空时直接使用, 不再读取 MasterKeyFile
+	Keyring *secret.Keyring
+	// SkipMigrations 为 true 时 Open 不执行待执行的版本化迁移, 由 migrate 子命令手动执行
+	SkipMigrations bool
+}
+
+func openDB(driver, dsn string) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case DriverSQLite:
+		if dsn == ":memory:" {
+			return openMemoryDB()
+		}
+		if !strings.HasPrefix(dsn, "file:") {
+			if err := os.MkdirAll(filepath.Dir(dsn), 0755); err != nil {
+				return nil, err
+			}
+		}
+		dialector = sqlite.Open(dsn)
+	case DriverPostgres:
+		dialector = postgres.Open(dsn)
+	case DriverMySQL:
+		dialector = mysql.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unsupported DB_DRIVER %q", driver)
+	}
+	return gorm.Open(dialector, &gorm.Config{Logger: newGormLogger()})
+}
+
+// openMemoryDB 打开 sqlite 内存库. 每个连接各自独立, 因此只保留一个连接
+func openMemoryDB() (*gorm.DB, error) {
+	d, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: newGormLogger()})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := d.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(1)
+	return d, nil
+}
+
+// dialect 返回连接使用的驱动名: sqlite, postgres 或 mysql
+func dialect(d *gorm.DB) string {
+	return d.Dialector.Name()
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sakurasan/to"
+	"github.com/patrickmn/go-cache"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrGroupInUse = errors.New("group still has members or subgroups")
+	ErrGroupCycle = errors.New("group cannot be its own ancestor")
+)
+
+// Group 是共享预算、限流、模型与 Key 池的用户组, 可通过 ParentID 组成层级.
+// 限制对组及其所有上级组同时生效
+type Group struct {
+	ID       uint   `gorm:"primarykey" json:"id"`
+	Name     string `gorm:"size:255;unique;not null" json:"name"`
+	ParentID *uint  `gorm:"index" json:"parentId,omitempty"`
+	// MonthlyBudget 为当月费用上限 (美元), 由组及下级组的成员共享, 0 表示不限
+	MonthlyBudget float64 `json:"monthlyBudget"`
+	// RateLimit 为组及下级组成员共享的每分钟请求数上限, 0 表示不限
+	RateLimit int `json:"rateLimit"`
+	// Models 为逗号分隔的允许模型, 为空不限
+	Models string `json:"models,omitempty"`
+	// KeyIDs 为逗号分隔的专用 Key, 这些 Key 只供本组及下级组使用
+	KeyIDs    string    `gorm:"column:key_ids" json:"keyIds,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (g Group) AllowsModel(model string) bool {
+	models := splitList(g.Models)
+	if len(models) == 0 {
+		return true
+	}
+	for _, m := range models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (g Group) KeyIDList() []uint {
+	var ids []uint
+	for _, s := range splitList(g.KeyIDs) {
+		if id := uint(to.Int(s)); id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// LoadGroupsCache 重建组缓存, 构建完成后整体替换
+func (s *Store) LoadGroupsCache(ctx context.Context) {
+	groups, err := s.GetAllGroups(ctx)
+	if err != nil {
+		slog.Error("load groups cache", "err", err)
+		return
+	}
+	c := cache.New(cache.NoExpiration, cache.NoExpiration)
+	for _, g := range groups {
+		c.Set(to.String(g.ID), g, cache.NoExpiration)
+	}
+	s.groupsCache.Store(c)
+	// 组结构变化后成员可能不同, 已缓存的组费用作废
+	s.spendCache.Flush()
+}
+
+func (s *Store) cachedGroup(id uint) (Group, bool) {
+	return groupFrom(s.groupsCache.Load(), id)
+}
+
+func groupFrom(c *cache.Cache, id uint) (Group, bool) {
+	v, ok := c.Get(to.String(id))
+	if !ok {
+		return Group{}, false
+	}
+	return v.(Group), true
+}
+
+// GroupChain 返回组及其所有上级组, 自下而上; id 为 0 时返回空.
+// 整条链取自同一份缓存, 不会混入并发重建前后的组
+func (s *Store) GroupChain(id uint) []Group {
+	gc := s.groupsCache.Load()
+	var chain []Group
+	seen := map[uint]bool{}
+	for id != 0 && !seen[id] {
+		g, ok := groupFrom(gc, id)
+		if !ok {
+			break
+		}
+		seen[id] = true
+		chain = append(chain, g)
+		if g.ParentID == nil {
+			break
+		}
+		id = *g.ParentID
+	}
+	return chain
+}
+
+// groupSubtree 返回组及其所有下级组的 id
+func (s *Store) groupSubtree(id uint) []uint {
+	children := map[uint][]uint{}
+	for _, item := range s.groupsCache.Load().Items() {
+		g := item.Object.(Group)
+		if g.ParentID != nil {
+			children[*g.ParentID] = append(children[*g.ParentID], g.ID)
+		}
+	}
+	ids := []uint{id}
+	for i := 0; i < len(ids); i++ {
+		ids = append(ids, children[ids[i]]...)
+	}
+	return ids
+}
+
+// reservedKeyIDs 返回已被某个组独占的 Key
+func (s *Store) reservedKeyIDs() map[uint]bool {
+	reserved := map[uint]bool{}
+	for _, item := range s.groupsCache.Load().Items() {
+		for _, id := range item.Object.(Group).KeyIDList() {
+			reserved[id] = true
+		}
+	}
+	return reserved
+}
+
+func (s *Store) GetGroup(ctx context.Context, id uint) (*Group, error) {
+	var g Group
+	if err := s.db.WithContext(ctx).First(&g, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *Store) GetAllGroups(ctx context.Context) ([]Group, error) {
+	var groups []Group
+	if err := s.db.WithContext(ctx).Order("id").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// CreateGroup 创建组并在同一事务内应用 p 中的其余字段
+func (s *Store) CreateGroup(ctx context.Context, g *Group, p GroupPatch) error {
+	if g.ParentID != nil {
+		if _, err := s.GetGroup(ctx, *g.ParentID); err != nil {
+			return fmt.Errorf("parent group: %w", err)
+		}
+	}
+	updates := groupUpdates(p)
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(g).Error; err != nil {
+			return err
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Model(g).Updates(updates).Error
+	})
+	if err != nil {
+		return err
+	}
+	s.LoadGroupsCache(ctx)
+	return nil
+}
+
+// GroupPatch 描述对组的部分修改, nil 字段保持不变; ParentID 指向 0 表示设为顶级组
+type GroupPatch struct {
+	Name          *string
+	ParentID      *uint
+	MonthlyBudget *float64
+	RateLimit     *int
+	Models        *[]string
+	KeyIDs        *[]uint
+	Notes         *string
+}
+
+// groupUpdates 把 p 中除 ParentID 外的字段转为列更新
+func groupUpdates(p GroupPatch) map[string]interface{} {
+	updates := map[string]interface{}{}
+	if p.Name != nil {
+		updates["name"] = *p.Name
+	}
+	if p.MonthlyBudget != nil {
+		updates["monthly_budget"] = *p.MonthlyBudget
+	}
+	if p.RateLimit != nil {
+		updates["rate_limit"] = *p.RateLimit
+	}
+	if p.Models != nil {
+		updates["models"] = strings.Join(*p.Models, ",")
+	}
+	if p.KeyIDs != nil {
+		ids := make([]string, 0, len(*p.KeyIDs))
+		for _, id := range *p.KeyIDs {
+			ids = append(ids, to.String(id))
+		}
+		updates["key_ids"] = strings.Join(ids, ",")
+	}
+	if p.Notes != nil {
+		updates["notes"] = *p.Notes
+	}
+	return updates
+}
+
+func (s *Store) UpdateGroup(ctx context.Context, id uint, p GroupPatch) error {
+	updates := groupUpdates(p)
+	if p.ParentID != nil {
+		if *p.ParentID == 0 {
+			updates["parent_id"] = nil
+		} else {
+			if _, err := s.GetGroup(ctx, *p.ParentID); err != nil {
+				return fmt.Errorf("parent group: %w", err)
+			}
+			for _, g := range s.GroupChain(*p.ParentID) {
+				if g.ID == id {
+					return ErrGroupCycle
+				}
+			}
+			updates["parent_id"] = *p.ParentID
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	result := s.db.WithContext(ctx).Model(&Group{}).Where("id = ?", id).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	s.LoadGroupsCache(ctx)
+	return nil
+}
+
+// DeleteGroup 只允许删除没有成员和下级组的组
+func (s *Store) DeleteGroup(ctx context.Context, id uint) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var n int64
+		if err := tx.Model(&User{}).Where("group_id = ?", id).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			if err := tx.Model(&Group{}).Where("parent_id = ?", id).Count(&n).Error; err != nil {
+				return err
+			}
+		}
+		if n > 0 {
+			return ErrGroupInUse
+		}
+		result := tx.Delete(&Group{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.LoadGroupsCache(ctx)
+	return nil
+}
+
+// groupMembers 返回组及下级组的全部成员 (含已删除用户, 其历史用量仍计入组)
+func (s *Store) groupMembers(ctx context.Context, id uint) ([]uint, error) {
+	var ids []uint
+	err := s.db.WithContext(ctx).Unscoped().Model(&User{}).Where("group_id IN ?", s.groupSubtree(id)).Pluck("id", &ids).Error
+	return ids, err
+}
+
+// groupSpendTTL 为组费用的缓存时间, 预算最多因此晚这么久生效
+const groupSpendTTL = 10 * time.Second
+
+// GroupSpend 返回组及下级组成员自 since 起的费用, 结果缓存 groupSpendTTL
+func (s *Store) GroupSpend(ctx context.Context, id uint, since time.Time) (float64, error) {
+	ck := fmt.Sprintf("%d:%d", id, since.Unix())
+	if v, ok := s.spendCache.Get(ck); ok {
+		return v.(float64), nil
+	}
+	members, err := s.groupMembers(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	var spend float64
+	if len(members) > 0 {
+		err = s.usage.WithContext(ctx).Model(&DailyUsage{}).
+			Select("COALESCE("+sumCost+", 0)").
+			Where("user_id IN ? AND date >= ?", members, since).
+			Scan(&spend).Error
+		if err != nil {
+			return 0, err
+		}
+	}
+	s.spendCache.Set(ck, spend, cache.DefaultExpiration)
+	return spend, nil
+}
+
+type GroupUsage struct {
+	// GroupID 为 0 表示未分组的用户
+	GroupID   uint   `json:"groupId"`
+	Name      string `json:"name,omitempty"`
+	TotalUnit int    `json:"totalUnit"`
+	Cost      string `json:"cost"`
+}
+
+// QueryGroupUsage 按组汇总用量, 下级组的用量同时计入所有上级组
+func (s *Store) QueryGroupUsage(ctx context.Context, from, end string) ([]GroupUsage, error) {
+	perUser, err := s.QueryUsage(ctx, from, end)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := s.db.WithContext(ctx).Unscoped().Select("id", "group_id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	userGroup := map[int]uint{}
+	for _, u := range users {
+		if u.GroupID != nil {
+			userGroup[int(u.ID)] = *u.GroupID
+		}
+	}
+
+	units := map[uint]int{}
+	costs := map[uint]float64{}
+	for _, u := range perUser {
+		cost := to.Float64(u.Cost)
+		chain := s.GroupChain(userGroup[u.UserID])
+		if len(chain) == 0 {
+			units[0] += u.TotalUnit
+			costs[0] += cost
+			continue
+		}
+		for _, g := range chain {
+			units[g.ID] += u.TotalUnit
+			costs[g.ID] += cost
+		}
+	}
+	results := make([]GroupUsage, 0, len(units))
+	for id, n := range units {
+		r := GroupUsage{GroupID: id, TotalUnit: n, Cost: fmt.Sprintf("%.6f", costs[id])}
+		if g, ok := s.cachedGroup(id); ok {
+			r.Name = g.Name
+		}
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].GroupID < results[j].GroupID })
+	return results, nil
+}
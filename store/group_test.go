@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGroupSpendIsCached(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	g := &Group{Name: "eng"}
+	if err := s.CreateGroup(ctx, g, GroupPatch{}); err != nil {
+		t.Fatal(err)
+	}
+	u := &User{Name: "alice", Token: "sk-alice", Role: RoleMember}
+	if err := s.CreateUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUserFields(ctx, u.ID, UserPatch{GroupID: &g.ID}); err != nil {
+		t.Fatal(err)
+	}
+	today := usageDay(time.Now())
+	since := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+	addSpend := func(cost string) {
+		t.Helper()
+		if err := s.usage.Create(&DailyUsage{UserID: int(u.ID), Date: today, TotalUnit: 1, Cost: cost}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	spend := func() float64 {
+		t.Helper()
+		v, err := s.GroupSpend(ctx, g.ID, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	addSpend("1.5")
+	if got := spend(); got != 1.5 {
+		t.Fatalf("spend = %v, want 1.5", got)
+	}
+	// 缓存期内不再汇总用量
+	s.usage.Where("1 = 1").Delete(&DailyUsage{})
+	addSpend("4")
+	if got := spend(); got != 1.5 {
+		t.Errorf("cached spend = %v, want 1.5", got)
+	}
+	// 组成员变化后缓存作废
+	none := uint(0)
+	if err := s.UpdateUserFields(ctx, u.ID, UserPatch{GroupID: &none}); err != nil {
+		t.Fatal(err)
+	}
+	if got := spend(); got != 0 {
+		t.Errorf("spend after alice left = %v, want 0", got)
+	}
+}
+
+func TestGroupHierarchy(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	parent := &Group{Name: "eng"}
+	if err := s.CreateGroup(ctx, parent, GroupPatch{}); err != nil {
+		t.Fatal(err)
+	}
+	child := &Group{Name: "eng-ml", ParentID: &parent.ID}
+	if err := s.CreateGroup(ctx, child, GroupPatch{}); err != nil {
+		t.Fatal(err)
+	}
+	chain := s.GroupChain(child.ID)
+	if len(chain) != 2 || chain[0].ID != child.ID || chain[1].ID != parent.ID {
+		t.Fatalf("chain = %+v, want child then parent", chain)
+	}
+	if err := s.UpdateGroup(ctx, parent.ID, GroupPatch{ParentID: &child.ID}); !errors.Is(err, ErrGroupCycle) {
+		t.Errorf("parent under its child: err = %v, want ErrGroupCycle", err)
+	}
+	if err := s.UpdateGroup(ctx, parent.ID, GroupPatch{ParentID: &parent.ID}); !errors.Is(err, ErrGroupCycle) {
+		t.Errorf("group under itself: err = %v, want ErrGroupCycle", err)
+	}
+	if err := s.DeleteGroup(ctx, parent.ID); !errors.Is(err, ErrGroupInUse) {
+		t.Errorf("delete group with a subgroup: err = %v, want ErrGroupInUse", err)
+	}
+
+	// 下级组成员的费用计入上级组
+	u := &User{Name: "alice", Token: "sk-alice", Role: RoleMember}
+	if err := s.CreateUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUserFields(ctx, u.ID, UserPatch{GroupID: &child.ID}); err != nil {
+		t.Fatal(err)
+	}
+	today := usageDay(time.Now())
+	if err := s.usage.Create(&DailyUsage{UserID: int(u.ID), Date: today, Cost: "2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint{child.ID, parent.ID} {
+		if spend, err := s.GroupSpend(ctx, id, today); err != nil || spend != 2 {
+			t.Errorf("group %d spend = %v, %v, want 2", id, spend, err)
+		}
+	}
+}
+
+func TestSelectKeyUsesGroupKeyPools(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	var keys []*Key
+	for _, name := range []string{"shared", "reserved"} {
+		k := &Key{Name: name, Key: "sk-" + name, ApiType: "openai"}
+		if err := s.CreateKey(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	shared, reserved := keys[0], keys[1]
+	parent := &Group{Name: "eng"}
+	if err := s.CreateGroup(ctx, parent, GroupPatch{KeyIDs: &[]uint{reserved.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	child := &Group{Name: "eng-ml", ParentID: &parent.ID}
+	if err := s.CreateGroup(ctx, child, GroupPatch{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		// 专用 Key 不参与公共调度, 下级组沿用上级组的专用 Key
+		if k, ok := s.SelectKey(nil, i%2 == 0); !ok || k.ID != shared.ID {
+			t.Fatalf("ungrouped picked %v, %v", k.Name, ok)
+		}
+		if k, ok := s.SelectKey(s.GroupChain(child.ID), i%2 == 0); !ok || k.ID != reserved.ID {
+			t.Fatalf("child group picked %v, %v", k.Name, ok)
+		}
+	}
+}
@@ -1,21 +1,177 @@
 package store
 
 import (
+	"context"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"opencatd-open/pkg/secret"
 	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Key struct {
-	ID             uint      `gorm:"primarykey" json:"id,omitempty"`
-	Key            string    `gorm:"unique;not null" json:"key,omitempty"`
-	Name           string    `gorm:"unique;not null" json:"name,omitempty"`
-	UserId         string    `json:"-,omitempty"`
-	ApiType        string    `gorm:"column:api_type"`
-	EndPoint       string    `gorm:"column:endpoint"`
-	ResourceNmae   string    `gorm:"column:resource_name"`
-	DeploymentName string    `gorm:"column:deployment_name"`
-	CreatedAt      time.Time `json:"createdAt,omitempty"`
-	UpdatedAt      time.Time `json:"updatedAt,omitempty"`
+	ID uint `gorm:"primarykey" json:"id,omitempty"`
+	// Key 为信封加密后的密文, 只在构造上游请求时通过 Store.KeySecret 解密
+	Key            string `gorm:"size:512;not null" json:"-"`
+	KeyHint        string `gorm:"column:key_hint" json:"key,omitempty"`
+	Name           string `gorm:"size:255;unique;not null" json:"name,omitempty"`
+	UserId         string `json:"-,omitempty"`
+	ApiType        string `gorm:"column:api_type"`
+	EndPoint       string `gorm:"column:endpoint"`
+	ResourceName   string `gorm:"column:resource_name"`
+	DeploymentName string `gorm:"column:deployment_name"`
+	// Deployments 为 Azure 的模型到部署名映射, 未映射的模型按默认规则转换
+	Deployments DeploymentMap `gorm:"column:deployments;type:text" json:"deployments,omitempty"`
+	// Enabled 为 false 的 Key 不参与调度
+	Enabled bool `gorm:"not null;default:true" json:"enabled"`
+	// Weight 为调度权重, 越大被选中的概率越高
+	Weight    int       `gorm:"not null;default:1" json:"weight"`
+	Notes     string    `json:"notes,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+	// InsecureSkipVerify 为 true 时访问该 Key 的上游不校验证书, 仅用于无法配置 CA 的自签名上游
+	InsecureSkipVerify bool `gorm:"not null;default:false" json:"insecureSkipVerify"`
+	// Transport 为该 Key 单独的上游连接设置
+	Transport KeyTransport `gorm:"embedded" json:"transport"`
+	// KeyFingerprint 为明文 Key 的 HMAC 指纹, 密文每次加密都不同, 重复添加由指纹拒绝.
+	// 唯一索引由迁移 keys_key_fingerprint 在回填后创建 (sqlite 不能添加带 UNIQUE 的列)
+	KeyFingerprint *string `gorm:"column:key_fingerprint;size:64" json:"-"`
+}
+
+// KeyTransport 为 Key 的上游连接设置, 零值字段使用 upstream 配置
+type KeyTransport struct {
+	// Proxy 为 http/https/socks5 代理地址; 空为使用环境变量 HTTP(S)_PROXY, direct 为直连
+	Proxy                 string   `gorm:"column:proxy" json:"proxy,omitempty"`
+	DialTimeout           Duration `gorm:"column:dial_timeout" json:"dialTimeout,omitempty"`
+	ResponseHeaderTimeout Duration `gorm:"column:response_header_timeout" json:"responseHeaderTimeout,omitempty"`
+	// DisableHTTP2 为 true 时只使用 HTTP/1.1
+	DisableHTTP2 bool `gorm:"column:disable_http2;not null;default:false" json:"disableHttp2,omitempty"`
+}
+
+// Duration 在 JSON 中写作 "30s", "5m" 等, 库中按纳秒保存
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration { return time.Duration(d) }
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ProxyDirect 表示不使用代理, 忽略环境变量
+const ProxyDirect = "direct"
+
+// Validate 检查代理地址与超时
+func (t KeyTransport) Validate() error {
+	if t.Proxy != "" && t.Proxy != ProxyDirect {
+		u, err := url.Parse(t.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy %q", t.Proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", u.Scheme)
+		}
+	}
+	if t.DialTimeout < 0 || t.ResponseHeaderTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	return nil
+}
+
+// MarshalJSON 隐藏代理地址中的密码
+func (t KeyTransport) MarshalJSON() ([]byte, error) {
+	type plain KeyTransport
+	if u, err := url.Parse(t.Proxy); err == nil && u.User != nil {
+		t.Proxy = u.Redacted()
+	}
+	return json.Marshal(plain(t))
+}
+
+// DeploymentMap 以 JSON 文本存储
+type DeploymentMap map[string]string
+
+func (m DeploymentMap) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+func (m *DeploymentMap) Scan(v interface{}) error {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("unsupported deployments type %T", v)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, m)
+}
+
+// Deployment 返回模型对应的 Azure 部署名
+func (k Key) Deployment(model string) (string, bool) {
+	d, ok := k.Deployments[model]
+	return d, ok && d != ""
+}
+
+// KeySecret 解密得到上游 API Key. 密文使用了未知的主密钥版本时, 先重新读取主密钥文件再试一次
+func (s *Store) KeySecret(k Key) (string, error) {
+	plaintext, err := s.keyring.Load().Decrypt(k.Key)
+	if errors.Is(err, secret.ErrUnknownVersion) {
+		return s.currentKeyring().Decrypt(k.Key)
+	}
+	return plaintext, err
+}
+
+// encryptKey 加密 k.Key 并生成脱敏展示值与指纹, 总是使用最新的主密钥
+func (s *Store) encryptKey(k *Key) error {
+	kr := s.currentKeyring()
+	k.KeyHint = secret.Mask(k.Key)
+	fp := kr.Fingerprint(k.Key)
+	k.KeyFingerprint = &fp
+	ct, err := kr.Encrypt(k.Key)
+	if err != nil {
+		return err
+	}
+	k.Key = ct
+	return nil
+}
+
+var ErrKeyExists = errors.New("api key already exists")
+
+// checkKeyFingerprint 确认没有其他 Key 使用相同的明文, 唯一索引兜底并发写入
+func checkKeyFingerprint(tx *gorm.DB, fp string, exceptID uint) error {
+	var n int64
+	if err := tx.Model(&Key{}).Where("key_fingerprint = ? AND id <> ?", fp, exceptID).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrKeyExists
+	}
+	return nil
 }
 
 func (k Key) ToString() string {
@@ -23,63 +179,276 @@ func (k Key) ToString() string {
 	return string(bdate)
 }
 
-func GetKeyrByName(name string) (*Key, error) {
+func (s *Store) GetKeyrByName(ctx context.Context, name string) (*Key, error) {
 	var key Key
-	result := db.First(&key, "name = ?", name)
+	result := s.db.WithContext(ctx).First(&key, "name = ?", name)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return &key, nil
 }
 
-func GetAllKeys() ([]Key, error) {
+func (s *Store) GetKeyByID(ctx context.Context, id uint) (*Key, error) {
+	var key Key
+	result := s.db.WithContext(ctx).First(&key, "id = ?", id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &key, nil
+}
+
+func (s *Store) GetAllKeys(ctx context.Context) ([]Key, error) {
 	var keys []Key
-	if err := db.Find(&keys).Error; err != nil {
+	if err := s.db.WithContext(ctx).Find(&keys).Error; err != nil {
 		return nil, err
 	}
 	return keys, nil
 }
 
 // 添加记录
-func AddKey(apitype, apikey, name string) error {
-	key := Key{
+func (s *Store) AddKey(ctx context.Context, apitype, apikey, name string) error {
+	return s.CreateKey(ctx, &Key{
 		ApiType: apitype,
 		Key:     apikey,
 		Name:    name,
+	})
+}
+
+// CreateKey 创建 Key, k.Key 传入明文, 写库前替换为密文; 明文与已有 Key 相同时返回 ErrKeyExists
+func (s *Store) CreateKey(ctx context.Context, k *Key) error {
+	if err := s.encryptKey(k); err != nil {
+		return err
 	}
-	if err := db.Create(&key).Error; err != nil {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkKeyFingerprint(tx, *k.KeyFingerprint, 0); err != nil {
+			return err
+		}
+		return tx.Create(k).Error
+	})
+	if err != nil {
 		return err
 	}
-	LoadKeysCache()
+	s.LoadKeysCache(ctx)
 	return nil
 }
 
-func CreateKey(k *Key) error {
-	if err := db.Create(&k).Error; err != nil {
+// 删除记录
+func (s *Store) DeleteKey(ctx context.Context, id uint) error {
+	if err := s.db.WithContext(ctx).Delete(&Key{}, id).Error; err != nil {
 		return err
 	}
-	LoadKeysCache()
+	s.LoadKeysCache(ctx)
 	return nil
 }
 
-// 删除记录
-func DeleteKey(id uint) error {
-	if err := db.Delete(&Key{}, id).Error; err != nil {
+// KeyPatch 描述对 Key 的部分修改, nil 字段保持不变
+type KeyPatch struct {
+	Key                *string
+	Name               *string
+	ApiType            *string
+	EndPoint           *string
+	ResourceName       *string
+	DeploymentName     *string
+	Deployments        *DeploymentMap
+	Enabled            *bool
+	Weight             *int
+	Notes              *string
+	InsecureSkipVerify *bool
+	Transport          *KeyTransport
+}
+
+// 更新记录
+func (s *Store) UpdateKey(ctx context.Context, id uint, p KeyPatch) error {
+	updates := map[string]interface{}{}
+	var fingerprint string
+	if p.Key != nil {
+		k := Key{Key: *p.Key}
+		if err := s.encryptKey(&k); err != nil {
+			return err
+		}
+		fingerprint = *k.KeyFingerprint
+		updates["key"] = k.Key
+		updates["key_hint"] = k.KeyHint
+		updates["key_fingerprint"] = fingerprint
+	}
+	if p.Name != nil {
+		updates["name"] = *p.Name
+	}
+	if p.ApiType != nil {
+		updates["api_type"] = *p.ApiType
+	}
+	if p.EndPoint != nil {
+		updates["endpoint"] = *p.EndPoint
+	}
+	if p.ResourceName != nil {
+		updates["resource_name"] = *p.ResourceName
+	}
+	if p.DeploymentName != nil {
+		updates["deployment_name"] = *p.DeploymentName
+	}
+	if p.Deployments != nil {
+		updates["deployments"] = *p.Deployments
+	}
+	if p.Enabled != nil {
+		updates["enabled"] = *p.Enabled
+	}
+	if p.Weight != nil {
+		updates["weight"] = *p.Weight
+	}
+	if p.InsecureSkipVerify != nil {
+		updates["insecure_skip_verify"] = *p.InsecureSkipVerify
+	}
+	if p.Transport != nil {
+		updates["proxy"] = p.Transport.Proxy
+		updates["dial_timeout"] = p.Transport.DialTimeout
+		updates["response_header_timeout"] = p.Transport.ResponseHeaderTimeout
+		updates["disable_http2"] = p.Transport.DisableHTTP2
+	}
+	if p.Notes != nil {
+		updates["notes"] = *p.Notes
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if fingerprint != "" {
+			if err := checkKeyFingerprint(tx, fingerprint, id); err != nil {
+				return err
+			}
+		}
+		result := tx.Model(&Key{}).Where("id = ?", id).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
-	LoadKeysCache()
+	s.LoadKeysCache(ctx)
 	return nil
 }
 
-// 更新记录
-func UpdateKey(id uint, apikey string, userId string) error {
-	key := Key{
-		Key:    apikey,
-		UserId: userId,
-	}
-	if err := db.Model(&Key{}).Where("id = ?", id).Updates(key).Error; err != nil {
+// migrateKeyEncryption 加密升级前以明文保存的 Key
+func (s *Store) migrateKeyEncryption(tx *gorm.DB) error {
+	var keys []Key
+	if err := tx.Where("? NOT LIKE ?", clause.Column{Name: "key"}, "enc:%").Find(&keys).Error; err != nil {
 		return err
 	}
-	LoadKeysCache()
+	for _, k := range keys {
+		if err := s.encryptKey(&k); err != nil {
+			return err
+		}
+		if err := tx.Model(&Key{}).Where("id = ?", k.ID).Updates(map[string]interface{}{"key": k.Key, "key_hint": k.KeyHint}).Error; err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+var ErrMasterKeyFromEnv = errors.New("master key comes from OPENCATD_MASTER_KEY: set the new key there, move the old one to OPENCATD_MASTER_KEY_PREVIOUS, restart, then rotate again without OPENCATD_NEW_MASTER_KEY")
+
+// RotateMasterKey 把所有 Key 的数据密钥重新包裹到主密钥 next 下并重算指纹, 返回重新包裹的条数.
+// 主密钥来自文件时依次: 写入以 next 为当前主密钥并保留旧主密钥的文件, 重新包裹, 再从文件中移除旧主密钥,
+// 任一步中断都不会出现无法解密的 Key; 运行中的服务在加解密时发现文件变化后自动重新读取.
+// 主密钥来自环境变量时无法写回, next 必须已是当前主密钥 (旧主密钥在 OPENCATD_MASTER_KEY_PREVIOUS 中)
+func (s *Store) RotateMasterKey(ctx context.Context, next secret.MasterKey) (int, error) {
+	kr := s.currentKeyring()
+	if next.Version != kr.Active().Version {
+		if kr.File == "" {
+			return 0, ErrMasterKeyFromEnv
+		}
+		kr = kr.WithActive(next)
+		if err := secret.WriteKeyFile(kr.File, kr); err != nil {
+			return 0, fmt.Errorf("write master key file: %w", err)
+		}
+		s.keyring.Store(kr)
+	}
+	// 旧版本的服务可能在重新包裹期间仍以旧主密钥写入, 重复检查直到没有旧版本的 Key
+	var total int
+	for pass := 0; ; pass++ {
+		n, err := s.rewrapKeys(ctx, kr, next)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n == 0 || pass == 2 {
+			break
+		}
+	}
+	remaining, err := s.keysNotUnder(ctx, next.Version)
+	if err != nil {
+		return total, err
+	}
+	if remaining > 0 {
+		return total, fmt.Errorf("%d keys are still encrypted with an old master key, run rotate_master_key again", remaining)
+	}
+	if kr.File != "" {
+		retired := secret.NewKeyring(next)
+		retired.File = kr.File
+		if err := secret.WriteKeyFile(kr.File, retired); err != nil {
+			return total, fmt.Errorf("remove old master keys from %s: %w", kr.File, err)
+		}
+		s.keyring.Store(retired)
+	}
+	s.LoadKeysCache(ctx)
+	return total, nil
+}
+
+// rewrapKeys 重新包裹不在 next 下的 Key, 并按 next 重算所有 Key 的指纹
+func (s *Store) rewrapKeys(ctx context.Context, kr *secret.Keyring, next secret.MasterKey) (int, error) {
+	var n int
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var keys []Key
+		if err := tx.Find(&keys).Error; err != nil {
+			return err
+		}
+		for _, k := range keys {
+			updates := map[string]interface{}{}
+			if v, ok := secret.Version(k.Key); !ok || v != next.Version {
+				ct, err := kr.Rewrap(k.Key, next)
+				if err != nil {
+					return fmt.Errorf("key %s: %w", k.Name, err)
+				}
+				updates["key"] = ct
+				n++
+			}
+			// 重复的旧 Key 没有指纹, 轮换后仍保持为空
+			if k.KeyFingerprint != nil {
+				plaintext, err := kr.Decrypt(k.Key)
+				if err != nil {
+					return fmt.Errorf("key %s: %w", k.Name, err)
+				}
+				if fp := next.Fingerprint(plaintext); fp != *k.KeyFingerprint {
+					updates["key_fingerprint"] = fp
+				}
+			}
+			if len(updates) == 0 {
+				continue
+			}
+			if err := tx.Model(&Key{}).Where("id = ?", k.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// keysNotUnder 返回不是以主密钥 version 加密的 Key 数量
+func (s *Store) keysNotUnder(ctx context.Context, version uint32) (int, error) {
+	var cts []string
+	if err := s.db.WithContext(ctx).Model(&Key{}).Pluck("key", &cts).Error; err != nil {
+		return 0, err
+	}
+	var n int
+	for _, ct := range cts {
+		if v, ok := secret.Version(ct); !ok || v != version {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,231 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"opencatd-open/pkg/secret"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFingerprintRejectsDuplicates(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	a := &Key{Name: "a", Key: "sk-same", ApiType: "openai"}
+	if err := s.CreateKey(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Key == "sk-same" || !secret.IsEncrypted(a.Key) {
+		t.Fatalf("key stored as %q, want ciphertext", a.Key)
+	}
+	if err := s.CreateKey(ctx, &Key{Name: "b", Key: "sk-same", ApiType: "openai"}); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("create duplicate: err = %v, want ErrKeyExists", err)
+	}
+	c := &Key{Name: "c", Key: "sk-other", ApiType: "openai"}
+	if err := s.CreateKey(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	same := "sk-same"
+	if err := s.UpdateKey(ctx, c.ID, KeyPatch{Key: &same}); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("update to duplicate: err = %v, want ErrKeyExists", err)
+	}
+	// 重新写入自己的明文不算重复
+	if err := s.UpdateKey(ctx, a.ID, KeyPatch{Key: &same}); err != nil {
+		t.Fatalf("update to own key: %v", err)
+	}
+	// 绕过预检查时由唯一索引兜底
+	fp := *a.KeyFingerprint
+	if err := s.db.Create(&Key{Name: "d", Key: "enc:x", KeyFingerprint: &fp}).Error; err == nil {
+		t.Fatal("unique index on key_fingerprint missing")
+	}
+}
+
+// newKeyFileStore 打开 dir 中的 sqlite 库, 主密钥来自 dir/master.key (不存在则以版本 1 生成)
+func newKeyFileStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	file := filepath.Join(dir, "master.key")
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if err := secret.WriteKeyFile(file, secret.NewKeyring(secret.GenerateMasterKey(1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kr, err := secret.ReadKeyFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(Config{
+		Driver:   DriverSQLite,
+		DSN:      filepath.Join(dir, "cat.db"),
+		UsageDSN: filepath.Join(dir, "usage.db"),
+		Keyring:  kr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRotateMasterKeyRecomputesFingerprints(t *testing.T) {
+	s := newKeyFileStore(t, t.TempDir())
+	ctx := context.Background()
+	a := &Key{Name: "a", Key: "sk-a", ApiType: "openai"}
+	if err := s.CreateKey(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	next := secret.GenerateMasterKey(2)
+	if _, err := s.RotateMasterKey(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetKeyByID(ctx, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.KeyFingerprint == nil || *got.KeyFingerprint != next.Fingerprint("sk-a") {
+		t.Fatalf("fingerprint after rotation = %v, want one under the new master key", got.KeyFingerprint)
+	}
+	if err := s.CreateKey(ctx, &Key{Name: "b", Key: "sk-a", ApiType: "openai"}); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("create duplicate after rotation: err = %v, want ErrKeyExists", err)
+	}
+}
+
+func TestRotateMasterKeyWritesNewKeyFirst(t *testing.T) {
+	s := newKeyFileStore(t, t.TempDir())
+	ctx := context.Background()
+	if err := s.CreateKey(ctx, &Key{Name: "a", Key: "sk-a", ApiType: "openai"}); err != nil {
+		t.Fatal(err)
+	}
+	// 无法解密的行让重新包裹失败, 模拟轮换中途中断
+	if err := s.db.Create(&Key{Name: "broken", Key: "enc:v9:eA==:eA==", ApiType: "openai"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	next := secret.GenerateMasterKey(2)
+	if _, err := s.RotateMasterKey(ctx, next); err == nil {
+		t.Fatal("rotation with an undecryptable key succeeded")
+	}
+	// 中断后文件中同时有新旧主密钥, 已有的 Key 仍可解密
+	kr, err := secret.ReadKeyFile(s.KeyringFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := kr.Keys()
+	if len(keys) != 2 || keys[0].Version != 2 || keys[1].Version != 1 {
+		t.Fatalf("key file versions = %v, want [2 1]", keys)
+	}
+	a, err := s.GetKeyrByName(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := kr.Decrypt(a.Key); err != nil || pt != "sk-a" {
+		t.Fatalf("decrypt after interrupted rotation: %q, %v", pt, err)
+	}
+
+	// 修复后再次轮换完成, 文件中只剩新主密钥
+	if err := s.db.Where("name = ?", "broken").Delete(&Key{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RotateMasterKey(ctx, secret.GenerateMasterKey(3)); err != nil {
+		t.Fatal(err)
+	}
+	if kr, err = secret.ReadKeyFile(s.KeyringFile()); err != nil {
+		t.Fatal(err)
+	}
+	if keys := kr.Keys(); len(keys) != 1 || keys[0].Version != 3 {
+		t.Fatalf("key file versions = %v, want [3]", keys)
+	}
+	if pt, err := kr.Decrypt(mustKey(t, s, "a").Key); err != nil || pt != "sk-a" {
+		t.Fatalf("decrypt with retired keyring: %q, %v", pt, err)
+	}
+}
+
+func mustKey(t *testing.T, s *Store, name string) *Key {
+	t.Helper()
+	k, err := s.GetKeyrByName(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// 运行中的服务与执行 rotate_master_key 的命令行共用同一个库与主密钥文件
+func TestRunningStorePicksUpRotatedKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	server := newKeyFileStore(t, dir)
+	ctx := context.Background()
+	if err := server.CreateKey(ctx, &Key{Name: "a", Key: "sk-a", ApiType: "openai"}); err != nil {
+		t.Fatal(err)
+	}
+	cli := newKeyFileStore(t, dir)
+	if _, err := cli.RotateMasterKey(ctx, secret.GenerateMasterKey(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if pt, err := server.KeySecret(*mustKey(t, server, "a")); err != nil || pt != "sk-a" {
+		t.Fatalf("server decrypt after rotation: %q, %v", pt, err)
+	}
+	if err := server.CreateKey(ctx, &Key{Name: "b", Key: "sk-b", ApiType: "openai"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := secret.Version(mustKey(t, server, "b").Key); v != 2 {
+		t.Errorf("key created after rotation uses master key v%d, want v2", v)
+	}
+	if err := server.CreateKey(ctx, &Key{Name: "c", Key: "sk-a", ApiType: "openai"}); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("duplicate after rotation: err = %v, want ErrKeyExists", err)
+	}
+}
+
+// 主密钥来自环境变量时不能写回, 只能把旧数据重新包裹到已配置的新主密钥下
+func TestRotateMasterKeyFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	v1, v2 := secret.GenerateMasterKey(1), secret.GenerateMasterKey(2)
+	open := func(kr *secret.Keyring) *Store {
+		s, err := Open(Config{Driver: DriverSQLite, DSN: filepath.Join(dir, "cat.db"), UsageDSN: filepath.Join(dir, "usage.db"), Keyring: kr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	ctx := context.Background()
+	old := open(secret.NewKeyring(v1))
+	if err := old.CreateKey(ctx, &Key{Name: "a", Key: "sk-a", ApiType: "openai"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.RotateMasterKey(ctx, v2); !errors.Is(err, ErrMasterKeyFromEnv) {
+		t.Fatalf("rotate to an unconfigured key: err = %v, want ErrMasterKeyFromEnv", err)
+	}
+	old.Close()
+
+	s := open(secret.NewKeyring(v2, v1))
+	if n, err := s.RotateMasterKey(ctx, v2); err != nil || n != 1 {
+		t.Fatalf("rotate: n = %d, err = %v", n, err)
+	}
+	if pt, err := secret.NewKeyring(v2).Decrypt(mustKey(t, s, "a").Key); err != nil || pt != "sk-a" {
+		t.Errorf("decrypt with only the new key: %q, %v", pt, err)
+	}
+}
+
+func TestKeyFileMustLiveOutsideDataDir(t *testing.T) {
+	t.Setenv("OPENCATD_MASTER_KEY_DEV", "")
+	cfg := Config{Driver: DriverSQLite, DSN: "/data/db/cat.db", UsageDSN: "/data/db/usage.db"}
+	tests := []struct {
+		file string
+		ok   bool
+	}{
+		{"", true},
+		{"/run/secrets/master.key", true},
+		{"/data/dbx/master.key", true},
+		{"/data/db/master.key", false},
+		{"/data/db/keys/master.key", false},
+	}
+	for _, tt := range tests {
+		if err := checkKeyFileLocation(cfg, tt.file); (err == nil) != tt.ok {
+			t.Errorf("%q: err = %v, want ok = %v", tt.file, err, tt.ok)
+		}
+	}
+	t.Setenv("OPENCATD_MASTER_KEY_DEV", "true")
+	if err := checkKeyFileLocation(cfg, "/data/db/master.key"); err != nil {
+		t.Errorf("dev mode: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"opencatd-open/pkg/logger"
+	"time"
+
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const slowQueryThreshold = 200 * time.Millisecond
+
+// gormLogger 把 gorm 日志转到 slog, 并带上 ctx 中的 request_id
+type gormLogger struct {
+	level gormlogger.LogLevel
+}
+
+func newGormLogger() gormlogger.Interface {
+	return &gormLogger{level: gormlogger.Warn}
+}
+
+func (l *gormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	return &gormLogger{level: level}
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Info {
+		logger.FromContext(ctx).InfoContext(ctx, msg, "args", args)
+	}
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		logger.FromContext(ctx).WarnContext(ctx, msg, "args", args)
+	}
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Error {
+		logger.FromContext(ctx).ErrorContext(ctx, msg, "args", args)
+	}
+}
+
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	lg := logger.FromContext(ctx)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		sql, rows := fc()
+		lg.ErrorContext(ctx, "sql", "sql", sql, "rows", rows, "elapsed", elapsed, "err", err)
+	case elapsed > slowQueryThreshold && l.level >= gormlogger.Warn:
+		sql, rows := fc()
+		lg.WarnContext(ctx, "slow sql", "sql", sql, "rows", rows, "elapsed", elapsed)
+	case lg.Enabled(ctx, slog.LevelDebug):
+		sql, rows := fc()
+		lg.DebugContext(ctx, "sql", "sql", sql, "rows", rows, "elapsed", elapsed)
+	}
+}
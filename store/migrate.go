@@ -0,0 +1,356 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"opencatd-open/pkg/secret"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Migration 是一次版本化的表结构或数据变更. AutoMigrate 只负责建表与加列,
+// 改名、修复约束与回填数据通过 Migration 完成
+type Migration struct {
+	Version int
+	Name    string
+	// Usage 为 true 时在用量库上执行, 执行记录统一保存在主库的 schema_migrations 中
+	Usage bool
+	Up    func(tx *gorm.DB) error
+	// Down 为 nil 表示不可回滚
+	Down func(tx *gorm.DB) error
+}
+
+// SchemaMigration 为已执行的版本
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationStatus 为 migrate status 的一行, AppliedAt 为空表示待执行
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+var (
+	ErrIrreversible      = errors.New("migration cannot be reverted")
+	ErrPendingMigrations = errors.New("pending migrations, run `opencatd migrate up` first")
+)
+
+// migrations 按版本递增排列, 已发布的版本不能修改或删除, 版本号也不复用.
+// 部分迁移需要主密钥, 因此由 Store 构造
+func (s *Store) migrations() []Migration {
+	return []Migration{
+		{
+			Version: 1,
+			Name:    "daily_usages_unique_user_date",
+			Usage:   true,
+			Up:      migrateDailyUsageUnique,
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropIndex(&DailyUsage{}, dailyUsageUserDateIndex)
+			},
+		},
+		{
+			Version: 2,
+			Name:    "keys_key_fingerprint",
+			Up:      s.migrateKeyFingerprints,
+			Down: func(tx *gorm.DB) error {
+				return tx.Model(&Key{}).Where("key_fingerprint IS NOT NULL").Update("key_fingerprint", nil).Error
+			},
+		},
+		// 3-6 为升级前的数据修复, 可重复执行; 回滚只删除执行记录, 不还原数据
+		{
+			Version: 3,
+			Name:    "users_soft_delete_unique",
+			Up:      migrateUserSoftDelete,
+			Down:    noopMigration,
+		},
+		{
+			Version: 4,
+			Name:    "users_roles",
+			Up:      migrateRoles,
+			Down:    noopMigration,
+		},
+		{
+			Version: 5,
+			Name:    "users_token_hashes",
+			Up:      migrateTokenHashes,
+			Down:    noopMigration,
+		},
+		{
+			Version: 6,
+			Name:    "keys_encryption",
+			Up:      s.migrateKeyEncryption,
+			Down:    noopMigration,
+		},
+		{
+			Version: 7,
+			Name:    "usages_utc_dates",
+			Usage:   true,
+			Up:      migrateUsageDatesUTC,
+			Down:    noopMigration,
+		},
+	}
+}
+
+func noopMigration(tx *gorm.DB) error { return nil }
+
+// migrateUsageDatesUTC 把以本地时间记录的原始用量改写为 UTC. sqlite 以带时区的文本保存时间,
+// 按天查询与清理时做字符串比较, 时区不一致会把用量分到错误的日期; 其他数据库按时刻比较, 无需改写.
+// 已生成的日汇总保持不变, 清理时会按 UTC 日核对并补齐
+func migrateUsageDatesUTC(tx *gorm.DB) error {
+	if tx.Dialector.Name() != DriverSQLite {
+		return nil
+	}
+	var batch []Usage
+	return tx.Select("id", "date").Order("id").FindInBatches(&batch, 1000, func(b *gorm.DB, n int) error {
+		for _, u := range batch {
+			if _, off := u.Date.Zone(); off == 0 {
+				continue
+			}
+			if err := tx.Model(&Usage{}).Where("id = ?", u.ID).Update("date", u.Date.UTC()).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+const dailyUsageUserDateIndex = "idx_daily_usages_user_date"
+
+// migrateDailyUsageUnique 清理并发汇总产生的重复日汇总行 (保留用量最大的一行, 即最后一次汇总),
+// 再为 (user_id, date) 建唯一索引
+func migrateDailyUsageUnique(tx *gorm.DB) error {
+	if tx.Migrator().HasIndex(&DailyUsage{}, dailyUsageUserDateIndex) {
+		return nil
+	}
+	var rows []DailyUsage
+	err := tx.Select("id", "user_id", "date", "total_unit").
+		Order("user_id, date, total_unit DESC, id").
+		Find(&rows).Error
+	if err != nil {
+		return err
+	}
+	var dups []int
+	for i := 1; i < len(rows); i++ {
+		if rows[i].UserID == rows[i-1].UserID && rows[i].Date.Equal(rows[i-1].Date) {
+			dups = append(dups, rows[i].ID)
+		}
+	}
+	for len(dups) > 0 {
+		n := min(len(dups), 500)
+		if err := tx.Delete(&DailyUsage{}, dups[:n]).Error; err != nil {
+			return err
+		}
+		dups = dups[n:]
+	}
+	return createUniqueIndex(tx, dailyUsageUserDateIndex, "daily_usages", "user_id", "date").Error
+}
+
+// createUniqueIndex 建唯一索引, 表名与列名经由方言加引号 (keys 是 MySQL 的保留字)
+func createUniqueIndex(tx *gorm.DB, name, table string, columns ...string) *gorm.DB {
+	cols := make([]clause.Column, len(columns))
+	for i, c := range columns {
+		cols[i] = clause.Column{Name: c}
+	}
+	return tx.Exec("CREATE UNIQUE INDEX ? ON ? ?", clause.Column{Name: name}, clause.Table{Name: table}, cols)
+}
+
+const keyFingerprintIndex = "idx_keys_key_fingerprint"
+
+// migrateKeyFingerprints 去掉密文列上无意义的唯一约束 (sqlite 由 AutoMigrate 重建表时去掉),
+// 为已有 Key 回填指纹并建唯一索引. 已有的重复 Key 不回填指纹并记录警告, 由管理员删除
+func (s *Store) migrateKeyFingerprints(tx *gorm.DB) error {
+	switch dialect(tx) {
+	case DriverPostgres:
+		if err := tx.Exec("ALTER TABLE ? DROP CONSTRAINT IF EXISTS keys_key_key", clause.Table{Name: "keys"}).Error; err != nil {
+			return err
+		}
+	case DriverMySQL:
+		if tx.Migrator().HasIndex(&Key{}, "key") {
+			if err := tx.Migrator().DropIndex(&Key{}, "key"); err != nil {
+				return err
+			}
+		}
+	}
+	var keys []Key
+	if err := tx.Where("key_fingerprint IS NULL OR key_fingerprint = ''").Order("id").Find(&keys).Error; err != nil {
+		return err
+	}
+	kr := s.keyring.Load()
+	for _, k := range keys {
+		plaintext := k.Key
+		if secret.IsEncrypted(k.Key) {
+			var err error
+			if plaintext, err = kr.Decrypt(k.Key); err != nil {
+				return fmt.Errorf("key %s: %w", k.Name, err)
+			}
+		}
+		fp := kr.Fingerprint(plaintext)
+		var dup Key
+		if err := tx.Where("key_fingerprint = ?", fp).Limit(1).Find(&dup).Error; err != nil {
+			return err
+		}
+		if dup.ID != 0 {
+			slog.Warn("duplicate api key, fingerprint not set", "key", k.Name, "duplicate_of", dup.Name)
+			continue
+		}
+		if err := tx.Model(&Key{}).Where("id = ?", k.ID).Update("key_fingerprint", fp).Error; err != nil {
+			return err
+		}
+	}
+	if tx.Migrator().HasIndex(&Key{}, keyFingerprintIndex) {
+		return nil
+	}
+	return createUniqueIndex(tx, keyFingerprintIndex, "keys", "key_fingerprint").Error
+}
+
+func (s *Store) migrationDB(m Migration) *gorm.DB {
+	if m.Usage {
+		return s.usage
+	}
+	return s.db
+}
+
+// runMigration 执行 fn 并更新 schema_migrations. 主库上的迁移与执行记录在同一事务中提交,
+// 中途失败不会留下已执行却未记录的迁移; 用量库的迁移记录在主库, 无法放进同一事务,
+// 迁移成功而记录失败时下次会重新执行, 因此用量库的迁移必须可重复执行
+func (s *Store) runMigration(m Migration, fn, record func(tx *gorm.DB) error) error {
+	if !m.Usage {
+		return s.db.Transaction(func(tx *gorm.DB) error {
+			if err := fn(tx); err != nil {
+				return err
+			}
+			return record(tx)
+		})
+	}
+	if err := s.usage.Transaction(fn); err != nil {
+		return err
+	}
+	return s.db.Transaction(record)
+}
+
+func (s *Store) appliedMigrations() (map[int]SchemaMigration, error) {
+	if err := s.db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+	var rows []SchemaMigration
+	if err := s.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// MigrationStatus 返回所有迁移及其执行时间
+func (s *Store) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	migrations := s.migrations()
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st := MigrationStatus{Migration: m}
+		if r, ok := applied[m.Version]; ok {
+			st.AppliedAt = &r.AppliedAt
+		}
+		status = append(status, st)
+	}
+	return status, nil
+}
+
+// MigrateUp 依次执行所有待执行的迁移, 返回本次执行的迁移
+func (s *Store) MigrateUp() ([]Migration, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range s.migrations() {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		record := func(tx *gorm.DB) error {
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		}
+		if err := s.runMigration(m, m.Up, record); err != nil {
+			return done, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// PendingMigrations 返回尚未执行的迁移
+func (s *Store) PendingMigrations() ([]Migration, error) {
+	status, err := s.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, st := range status {
+		if st.AppliedAt == nil {
+			pending = append(pending, st.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// RequireMigrated 在有待执行的迁移时返回 ErrPendingMigrations. 迁移前旧数据中的 token 与 Key
+// 仍为明文, 认证与解密都会失败, 因此关闭自动迁移时服务启动前必须检查
+func (s *Store) RequireMigrated() error {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	names := make([]string, len(pending))
+	for i, m := range pending {
+		names[i] = fmt.Sprintf("%d %s", m.Version, m.Name)
+	}
+	return fmt.Errorf("%w: %s", ErrPendingMigrations, strings.Join(names, ", "))
+}
+
+// MigrateDown 按版本倒序回滚最近执行的 steps 个迁移, 返回本次回滚的迁移
+func (s *Store) MigrateDown(steps int) ([]Migration, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	migrations := s.migrations()
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return done, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, ErrIrreversible)
+		}
+		unrecord := func(tx *gorm.DB) error {
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		}
+		if err := s.runMigration(m, m.Down, unrecord); err != nil {
+			return done, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		slog.Info("reverted migration", "version", m.Version, "name", m.Name)
+		done = append(done, m)
+	}
+	return done, nil
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"opencatd-open/pkg/secret"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func TestLegacyFixupsAreVersionedMigrations(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		Driver:         DriverSQLite,
+		DSN:            filepath.Join(dir, "cat.db"),
+		UsageDSN:       filepath.Join(dir, "usage.db"),
+		Keyring:        secret.NewKeyring(secret.GenerateMasterKey(1)),
+		SkipMigrations: true,
+	}
+	s, err := Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	// 升级前的数据: 明文 token、没有角色、明文 Key
+	if err := s.db.Exec("INSERT INTO users (name, token, role, created_at, updated_at) VALUES ('root', 'plain-token', '', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Exec("INSERT INTO keys (name, ?, api_type, enabled, weight) VALUES ('k1', 'sk-plain', 'openai', true, 1)", clause.Column{Name: "key"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// SkipMigrations 时不修改数据, 只列为待执行
+	s.Close()
+	if s, err = Open(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var u User
+	if err := s.db.First(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+	if u.Token != "plain-token" || u.Role != "" {
+		t.Fatalf("user migrated with SkipMigrations: token %q, role %q", u.Token, u.Role)
+	}
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []int
+	for _, m := range pending {
+		versions = append(versions, m.Version)
+	}
+	if len(versions) != 7 || versions[0] != 1 || versions[6] != 7 {
+		t.Fatalf("pending versions = %v, want 1-7", versions)
+	}
+	if err := s.RequireMigrated(); !errors.Is(err, ErrPendingMigrations) {
+		t.Errorf("RequireMigrated with pending migrations: err = %v", err)
+	}
+
+	if _, err := s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.First(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(u.Token, tokenHashScheme+"$") || u.Role != RoleOwner {
+		t.Errorf("after migrate up: token %q, role %q", u.Token, u.Role)
+	}
+	var k Key
+	if err := s.db.First(&k).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !secret.IsEncrypted(k.Key) || k.KeyFingerprint == nil {
+		t.Errorf("after migrate up: key %q, fingerprint %v", k.Key, k.KeyFingerprint)
+	}
+	if err := s.RequireMigrated(); err != nil {
+		t.Errorf("after migrate up: %v", err)
+	}
+	// 回滚后可重新执行
+	if _, err := s.MigrateDown(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 主库上的迁移失败时连同执行记录一起回滚, 不会留下已记录但未完成的迁移
+func TestFailedMigrationIsNotRecorded(t *testing.T) {
+	s := newTestStore(t)
+	// 取最后一个在主库上执行的迁移, 回滚它及之后的版本
+	all := s.migrations()
+	i := len(all) - 1
+	for all[i].Usage {
+		i--
+	}
+	m := all[i]
+	if _, err := s.MigrateDown(len(all) - i); err != nil {
+		t.Fatal(err)
+	}
+	fail := errors.New("boom")
+	record := func(tx *gorm.DB) error {
+		return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name}).Error
+	}
+	err := s.runMigration(m, func(tx *gorm.DB) error { return fail }, record)
+	if !errors.Is(err, fail) {
+		t.Fatalf("runMigration: err = %v", err)
+	}
+	// 迁移成功但记录失败时, 迁移的修改同样回滚
+	if err := s.CreateUser(context.Background(), &User{Name: "alice", Token: "sk-alice", Role: RoleOwner}); err != nil {
+		t.Fatal(err)
+	}
+	err = s.runMigration(m, func(tx *gorm.DB) error {
+		return tx.Exec("UPDATE users SET name = 'changed'").Error
+	}, func(tx *gorm.DB) error { return fail })
+	if !errors.Is(err, fail) {
+		t.Fatalf("runMigration: err = %v", err)
+	}
+	if _, err := s.GetUserByName(context.Background(), "alice"); err != nil {
+		t.Errorf("migration change not rolled back: %v", err)
+	}
+	if pending, _ := s.PendingMigrations(); len(pending) != len(all)-i || pending[0].Version != m.Version {
+		t.Errorf("pending = %v, want versions from %d", pending, m.Version)
+	}
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Sakurasan/to"
+	"gorm.io/gorm"
+)
+
+// RetentionPolicy 描述原始用量 (usages) 的保留策略, 日汇总 (daily_usages) 永久保留
+type RetentionPolicy struct {
+	// Days 为原始用量保留的天数, 0 表示不清理
+	Days int
+	// ArchiveDir 非空时先把过期行写入该目录下按天划分的 usages-YYYY-MM-DD.jsonl.gz 再删除
+	ArchiveDir string
+	// Interval 为后台清理的间隔
+	Interval time.Duration
+}
+
+// PruneResult 为一次清理的统计, DryRun 时为将要执行的操作
+type PruneResult struct {
+	Days     int      `json:"days"`
+	Rows     int64    `json:"rows"`
+	Repaired int      `json:"repaired"`
+	Files    []string `json:"files,omitempty"`
+}
+
+// usageDay 返回 t 所在的 UTC 日, 即日汇总的日期键. 原始用量同样以 UTC 记录,
+// 按天查询与清理时的字符串比较 (sqlite) 与时间比较才一致
+func usageDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// PruneUsage 按天处理早于保留期的原始用量: 先用原始数据核对并补齐当天的日汇总,
+// 再按策略归档, 最后在同一事务内写入补齐的汇总并删除原始行. 当天的原始行始终保留
+func (s *Store) PruneUsage(ctx context.Context, p RetentionPolicy, dryRun bool) (PruneResult, error) {
+	var res PruneResult
+	if p.Days < 1 {
+		return res, fmt.Errorf("retention days must be at least 1")
+	}
+	cutoff := usageDay(time.Now()).AddDate(0, 0, -p.Days)
+	var oldest []Usage
+	err := s.usage.WithContext(ctx).Select("date").Where("date < ?", cutoff).Order("date").Limit(1).Find(&oldest).Error
+	if err != nil || len(oldest) == 0 {
+		return res, err
+	}
+	for day := usageDay(oldest[0].Date); day.Before(cutoff); day = day.AddDate(0, 0, 1) {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		if err := s.pruneUsageDay(ctx, day, p.ArchiveDir, dryRun, &res); err != nil {
+			return res, fmt.Errorf("prune %s: %w", day.Format("2006-01-02"), err)
+		}
+	}
+	return res, nil
+}
+
+func (s *Store) pruneUsageDay(ctx context.Context, day time.Time, archiveDir string, dryRun bool, res *PruneResult) error {
+	db := s.usage.WithContext(ctx)
+	inDay := func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("date >= ? AND date < ?", day, day.AddDate(0, 0, 1))
+	}
+	var rows int64
+	if err := inDay(db.Model(&Usage{})).Count(&rows).Error; err != nil {
+		return err
+	}
+	if rows == 0 {
+		return nil
+	}
+
+	var sums []Summary
+	err := inDay(db.Model(&Usage{})).Select(`user_id,
+		MAX(sku) AS sku,
+		SUM(prompt_units) AS sum_prompt_units,
+		SUM(completion_units) AS sum_completion_units,
+		SUM(total_unit) AS sum_total_unit,
+		` + sumCost + ` AS sum_cost`).
+		Group("user_id").
+		Find(&sums).Error
+	if err != nil {
+		return err
+	}
+	var dailies []DailyUsage
+	if err := inDay(db).Find(&dailies).Error; err != nil {
+		return err
+	}
+	existing := map[int]DailyUsage{}
+	for _, d := range dailies {
+		existing[d.UserID] = d
+	}
+	var repairs []DailyUsage
+	for _, sum := range sums {
+		d, ok := existing[sum.UserId]
+		if ok && d.TotalUnit == sum.SumTotalUnit && math.Abs(to.Float64(d.Cost)-sum.SumCost) < 1e-6 {
+			continue
+		}
+		if !ok {
+			d = DailyUsage{UserID: sum.UserId, Date: day}
+		}
+		d.SKU = sum.SKU
+		d.PromptUnits = sum.SumPromptUnits
+		d.CompletionUnits = sum.SumCompletionUnits
+		d.TotalUnit = sum.SumTotalUnit
+		d.Cost = strconv.FormatFloat(sum.SumCost, 'f', -1, 64)
+		repairs = append(repairs, d)
+	}
+
+	res.Days++
+	res.Rows += rows
+	res.Repaired += len(repairs)
+	if archiveDir != "" {
+		res.Files = append(res.Files, filepath.Join(archiveDir, "usages-"+day.Format("2006-01-02")+".jsonl.gz"))
+	}
+	if dryRun {
+		return nil
+	}
+	if archiveDir != "" {
+		if err := s.archiveUsageDay(ctx, day, res.Files[len(res.Files)-1], inDay); err != nil {
+			return err
+		}
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for i := range repairs {
+			if err := tx.Save(&repairs[i]).Error; err != nil {
+				return err
+			}
+		}
+		return inDay(tx).Delete(&Usage{}).Error
+	})
+}
+
+// archiveUsageDay 把一天的原始用量写为 gzip 压缩的 JSONL. 先写临时文件再改名,
+// 上次归档后删除失败时重跑会整体覆盖, 不会产生重复行
+func (s *Store) archiveUsageDay(ctx context.Context, day time.Time, path string, inDay func(*gorm.DB) *gorm.DB) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	var batch []Usage
+	err = inDay(s.usage.WithContext(ctx)).Order("id").FindInBatches(&batch, 1000, func(tx *gorm.DB, n int) error {
+		for _, u := range batch {
+			if err := enc.Encode(u); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// RunRetention 按 p.Interval 定期清理原始用量, 直到 ctx 结束; p.Days 为 0 时直接返回
+func (s *Store) RunRetention(ctx context.Context, p RetentionPolicy) {
+	if p.Days < 1 {
+		return
+	}
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		res, err := s.PruneUsage(ctx, p, false)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("prune usage", "err", err)
+		} else if res.Rows > 0 {
+			slog.Info("pruned usage", "days", res.Days, "rows", res.Rows, "repaired", res.Repaired, "archived", len(res.Files))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
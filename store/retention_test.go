@@ -0,0 +1,130 @@
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPruneUsage(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	today := usageDay(time.Now())
+	old := today.AddDate(0, 0, -10)
+	older := today.AddDate(0, 0, -11)
+	usages := []Usage{
+		// older 的日汇总缺失, old 的日汇总少算了一行
+		{UserID: 1, Date: older.Add(23 * time.Hour), TotalUnit: 5, Cost: "0.5"},
+		{UserID: 1, Date: old.Add(time.Hour), TotalUnit: 1, Cost: "0.1"},
+		{UserID: 1, Date: old.Add(23*time.Hour + 59*time.Minute), TotalUnit: 2, Cost: "0.2"},
+		{UserID: 2, Date: old.Add(12 * time.Hour), TotalUnit: 4, Cost: "1"},
+		// 保留期内的原始用量不动
+		{UserID: 1, Date: today.Add(-time.Hour), TotalUnit: 7, Cost: "0.7"},
+	}
+	if err := s.usage.Create(&usages).Error; err != nil {
+		t.Fatal(err)
+	}
+	dailies := []DailyUsage{
+		{UserID: 1, Date: old, TotalUnit: 1, Cost: "0.1"},
+		{UserID: 2, Date: old, TotalUnit: 4, Cost: "1"},
+	}
+	if err := s.usage.Create(&dailies).Error; err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	p := RetentionPolicy{Days: 3, ArchiveDir: dir}
+
+	// DryRun 只统计, 不修改
+	res, err := s.PruneUsage(ctx, p, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Days != 2 || res.Rows != 4 || res.Repaired != 2 || len(res.Files) != 2 {
+		t.Errorf("dry run = %+v, want 2 days, 4 rows, 2 repairs, 2 files", res)
+	}
+	var n int64
+	s.usage.Model(&Usage{}).Count(&n)
+	if entries, _ := os.ReadDir(dir); n != 5 || len(entries) != 0 {
+		t.Fatalf("dry run changed data: %d usages, %d archive files", n, len(entries))
+	}
+
+	res, err = s.PruneUsage(ctx, p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rows != 4 {
+		t.Errorf("pruned rows = %d, want 4", res.Rows)
+	}
+	var left []Usage
+	if err := s.usage.Find(&left).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].TotalUnit != 7 {
+		t.Errorf("usages left = %+v, want only today's", left)
+	}
+
+	// 日汇总按原始数据补齐
+	want := map[string]int{
+		older.Format("2006-01-02") + "/1": 5,
+		old.Format("2006-01-02") + "/1":   3,
+		old.Format("2006-01-02") + "/2":   4,
+	}
+	var rows []DailyUsage
+	if err := s.usage.Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(want) {
+		t.Errorf("daily rows = %+v", rows)
+	}
+	for _, d := range rows {
+		key := usageDay(d.Date).Format("2006-01-02") + "/" + strconv.Itoa(d.UserID)
+		if want[key] != d.TotalUnit {
+			t.Errorf("daily %s total = %d, want %d", key, d.TotalUnit, want[key])
+		}
+	}
+
+	// 每天一个归档文件, 内容为当天的原始行
+	for day, count := range map[time.Time]int{older: 1, old: 3} {
+		path := filepath.Join(dir, "usages-"+day.Format("2006-01-02")+".jsonl.gz")
+		if got := countArchived(t, path); got != count {
+			t.Errorf("%s: %d rows, want %d", filepath.Base(path), got, count)
+		}
+	}
+
+	// 重复执行没有可清理的数据
+	if res, err := s.PruneUsage(ctx, p, false); err != nil || res.Rows != 0 {
+		t.Errorf("second prune = %+v, %v", res, err)
+	}
+	if _, err := s.PruneUsage(ctx, RetentionPolicy{}, false); err == nil {
+		t.Error("prune with 0 days succeeded")
+	}
+}
+
+func countArchived(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	sc := bufio.NewScanner(gz)
+	for sc.Scan() {
+		var u Usage
+		if err := json.Unmarshal(sc.Bytes(), &u); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		n++
+	}
+	return n
+}
@@ -0,0 +1,58 @@
+package store
+
+import "errors"
+
+type Role string
+
+const (
+	RoleOwner   Role = "owner"
+	RoleAdmin   Role = "admin"
+	RoleMember  Role = "member"
+	RoleAuditor Role = "auditor"
+)
+
+type Permission string
+
+const (
+	// 查看 Key、用户与全员用量
+	PermAdminRead Permission = "admin:read"
+	// 增删改 Key
+	PermKeysWrite Permission = "keys:write"
+	// 增删用户、重置 Token、修改角色
+	PermUsersWrite Permission = "users:write"
+	// 授予/撤销 owner, 以及管理 owner 账号
+	PermOwnersWrite Permission = "owners:write"
+	// 下载包含全部数据的数据库备份
+	PermBackup Permission = "backup"
+)
+
+var ErrLastOwner = errors.New("cannot remove or demote the last owner")
+
+var rolePermissions = map[Role][]Permission{
+	RoleOwner:   {PermAdminRead, PermKeysWrite, PermUsersWrite, PermOwnersWrite, PermBackup},
+	RoleAdmin:   {PermAdminRead, PermKeysWrite, PermUsersWrite, PermBackup},
+	RoleAuditor: {PermAdminRead},
+	RoleMember:  {},
+}
+
+// roleRank 用于在多个角色中选出权限最高的一个
+var roleRank = map[Role]int{RoleMember: 1, RoleAuditor: 2, RoleAdmin: 3, RoleOwner: 4}
+
+// Outranks 判断 r 的权限是否高于 o
+func (r Role) Outranks(o Role) bool {
+	return roleRank[r] > roleRank[o]
+}
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Can(p Permission) bool {
+	for _, perm := range rolePermissions[r] {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/patrickmn/go-cache"
+)
+
+// Session 是 SSO 登录后签发的浏览器会话, 只保存 token 的哈希
+type Session struct {
+	ID        uint      `gorm:"primarykey"`
+	UserID    uint      `gorm:"index;not null"`
+	Hash      string    `gorm:"size:255;uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+// sessionCacheKey 与 token 的缓存键区分开, 会话不能当作 bearer token 使用
+func sessionCacheKey(token string) string {
+	return "session:" + tokenCacheKey(token)
+}
+
+// CreateSession 为用户签发会话并顺带清理已过期的会话, 返回明文 token
+func (s *Store) CreateSession(ctx context.Context, userID uint, ttl time.Duration) (string, error) {
+	token := uuid.NewString() + uuid.NewString()
+	sess := &Session{UserID: userID, Hash: tokenCacheKey(token), ExpiresAt: time.Now().Add(ttl)}
+	if err := s.db.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&Session{}).Error; err != nil {
+		return "", err
+	}
+	if err := s.db.WithContext(ctx).Create(sess).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// AuthenticateSession 校验会话 token, 用户被删除或禁用时会话同时失效
+func (s *Store) AuthenticateSession(ctx context.Context, token string) (*Credential, error) {
+	key := sessionCacheKey(token)
+	ac := s.authCache.Load()
+	if v, ok := ac.Get(key); ok {
+		cred := v.(*Credential)
+		if cred.expired() {
+			ac.Delete(key)
+			return nil, ErrTokenExpired
+		}
+		return cred, nil
+	}
+
+	var sess Session
+	if err := s.db.WithContext(ctx).Where("hash = ?", tokenCacheKey(token)).First(&sess).Error; err != nil {
+		return nil, err
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	u, err := s.GetUserByID(ctx, sess.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, ErrUserDisabled
+	}
+	cred := &Credential{UserID: sess.UserID, GroupID: u.groupID(), ExpiresAt: &sess.ExpiresAt}
+	ac.Set(key, cred, cache.NoExpiration)
+	return cred, nil
+}
+
+func (s *Store) DeleteSession(ctx context.Context, token string) error {
+	s.authCache.Load().Delete(sessionCacheKey(token))
+	return s.db.WithContext(ctx).Where("hash = ?", tokenCacheKey(token)).Delete(&Session{}).Error
+}
+
+// GetUserBySubject 按 IdP 的 subject 查找 SSO 用户
+func (s *Store) GetUserBySubject(ctx context.Context, sub string) (*User, error) {
+	var user User
+	if err := s.db.WithContext(ctx).Where("oidc_subject = ?", sub).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ProvisionSSOUser 首次 SSO 登录时创建用户. 用户只通过会话登录, 主 token 为随机值且不返回
+func (s *Store) ProvisionSSOUser(ctx context.Context, sub, name string, role Role) (*User, error) {
+	u := &User{Name: name, Token: uuid.NewString(), Role: role, OIDCSubject: sub}
+	if err := s.CreateUser(ctx, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// SyncSSORole 按 IdP 的组映射更新角色, 降级最后一个 owner 时返回 ErrLastOwner
+func (s *Store) SyncSSORole(ctx context.Context, u *User, role Role) error {
+	if u.Role == role {
+		return nil
+	}
+	if err := s.UpdateUserRole(ctx, u.ID, role); err != nil {
+		return err
+	}
+	u.Role = role
+	return nil
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"opencatd-open/pkg/secret"
+	"testing"
+)
+
+// newTestStore 打开内存 sqlite 上的 Store
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(Config{
+		Driver:   DriverSQLite,
+		DSN:      ":memory:",
+		UsageDSN: ":memory:",
+		Keyring:  secret.NewKeyring(secret.GenerateMasterKey(1)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestQueriesHonourContext(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	u := &User{Name: "alice", Token: "sk-alice", Role: RoleOwner}
+	if err := s.CreateUser(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUserByID(ctx, u.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.GetUserByID(cancelled, u.ID); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetUserByID with cancelled ctx: err = %v, want context.Canceled", err)
+	}
+	if _, err := s.Authenticate(cancelled, "sk-alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Authenticate with cancelled ctx: err = %v, want context.Canceled", err)
+	}
+	if err := s.CreateKey(cancelled, &Key{Name: "k", Key: "sk-k", ApiType: "openai"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("CreateKey with cancelled ctx: err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	tokenHashScheme = "sha256"
+	// TokenPrefixLen 为明文 token 保留用于展示与索引的前缀长度
+	TokenPrefixLen = 8
+)
+
+// HashToken 生成 "sha256$<salt>$<hex>" 形式的加盐哈希
+func HashToken(token string) string {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return hashTokenWithSalt(token, hex.EncodeToString(salt))
+}
+
+func hashTokenWithSalt(token, salt string) string {
+	sum := sha256.Sum256([]byte(salt + token))
+	return tokenHashScheme + "$" + salt + "$" + hex.EncodeToString(sum[:])
+}
+
+// VerifyToken 比较明文 token 与存储的哈希
+func VerifyToken(token, hashed string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 3 || parts[0] != tokenHashScheme {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashTokenWithSalt(token, parts[1])), []byte(hashed)) == 1
+}
+
+func isHashedToken(s string) bool {
+	return strings.HasPrefix(s, tokenHashScheme+"$")
+}
+
+func TokenPrefix(token string) string {
+	if len(token) <= TokenPrefixLen {
+		return token
+	}
+	return token[:TokenPrefixLen]
+}
+
+// tokenCacheKey 是认证缓存的键, 避免在内存中以明文保存 token
+func tokenCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// migrateTokenHashes 把升级前以明文保存的 token 转为加盐哈希
+func migrateTokenHashes(tx *gorm.DB) error {
+	var users []User
+	if err := tx.Unscoped().Where("token NOT LIKE ?", tokenHashScheme+"$%").Find(&users).Error; err != nil {
+		return err
+	}
+	for _, u := range users {
+		err := tx.Unscoped().Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+			"token":        HashToken(u.Token),
+			"token_prefix": TokenPrefix(u.Token),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestTokensAreStoredHashed(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	// 两个 token 的前缀相同, 查找时须按哈希区分
+	alice := &User{Name: "alice", Token: "sk-share-alice", Role: RoleMember}
+	bob := &User{Name: "bob", Token: "sk-share-bob", Role: RoleMember}
+	for _, u := range []*User{alice, bob} {
+		if err := s.CreateUser(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rows []User
+	if err := s.db.Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range rows {
+		if strings.Contains(u.Token, "sk-share") || !isHashedToken(u.Token) || u.TokenPrefix != "sk-share" {
+			t.Errorf("%s stored as token %q, prefix %q", u.Name, u.Token, u.TokenPrefix)
+		}
+	}
+	if HashToken("sk-share-alice") == HashToken("sk-share-alice") {
+		t.Error("HashToken is not salted")
+	}
+
+	for token, want := range map[string]uint{"sk-share-alice": alice.ID, "sk-share-bob": bob.ID} {
+		u, err := s.GetUserByToken(ctx, token)
+		if err != nil || u.ID != want {
+			t.Errorf("GetUserByToken(%s) = %v, %v, want user %d", token, u, err, want)
+		}
+	}
+	if _, err := s.GetUserByToken(ctx, "sk-share-carol"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("unknown token with a known prefix: err = %v", err)
+	}
+
+	// 重置后旧 token 即使已在认证缓存中也不再可用
+	if _, err := s.Authenticate(ctx, "sk-share-alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUser(ctx, alice.ID, "sk-new-alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, "sk-share-alice"); err == nil {
+		t.Error("old token still authenticates after reset")
+	}
+	if cred, err := s.Authenticate(ctx, "sk-new-alice"); err != nil || cred.UserID != alice.ID {
+		t.Errorf("new token: %v, %v", cred, err)
+	}
+}
@@ -1,16 +1,20 @@
 package store
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/Sakurasan/to"
 	"gorm.io/gorm"
 )
 
+// DailyUsage 为按用户按天的用量汇总, (user_id, date) 的唯一索引由迁移 2 创建
 type DailyUsage struct {
 	ID              int       `gorm:"column:id"`
-	UserID          int       `gorm:"column:user_id";primaryKey`
+	UserID          int       `gorm:"column:user_id"`
 	Date            time.Time `gorm:"column:date"`
 	SKU             string    `gorm:"column:sku"`
 	PromptUnits     int       `gorm:"column:prompt_units"`
@@ -23,16 +27,17 @@ func (DailyUsage) TableName() string {
 	return "daily_usages"
 }
 
+// Usage 为每次请求的原始用量, 超过保留期后按 PruneUsage 归档或删除, json 标签即归档格式
 type Usage struct {
-	ID              int       `gorm:"column:id"`
-	PromptHash      string    `gorm:"column:prompt_hash"`
-	UserID          int       `gorm:"column:user_id"`
-	SKU             string    `gorm:"column:sku"`
-	PromptUnits     int       `gorm:"column:prompt_units"`
-	CompletionUnits int       `gorm:"column:completion_units"`
-	TotalUnit       int       `gorm:"column:total_unit"`
-	Cost            string    `gorm:"column:cost"`
-	Date            time.Time `gorm:"column:date"`
+	ID              int       `gorm:"column:id" json:"id"`
+	PromptHash      string    `gorm:"column:prompt_hash" json:"promptHash"`
+	UserID          int       `gorm:"column:user_id" json:"userId"`
+	SKU             string    `gorm:"column:sku" json:"sku"`
+	PromptUnits     int       `gorm:"column:prompt_units" json:"promptUnits"`
+	CompletionUnits int       `gorm:"column:completion_units" json:"completionUnits"`
+	TotalUnit       int       `gorm:"column:total_unit" json:"totalUnit"`
+	Cost            string    `gorm:"column:cost" json:"cost"`
+	Date            time.Time `gorm:"column:date" json:"date"`
 }
 
 func (Usage) TableName() string {
@@ -41,46 +46,61 @@ func (Usage) TableName() string {
 
 type Summary struct {
 	UserId             int     `gorm:"column:user_id"`
+	SKU                string  `gorm:"column:sku"`
 	SumPromptUnits     int     `gorm:"column:sum_prompt_units"`
 	SumCompletionUnits int     `gorm:"column:sum_completion_units"`
 	SumTotalUnit       int     `gorm:"column:sum_total_unit"`
 	SumCost            float64 `gorm:"column:sum_cost"`
 }
 type CalcUsage struct {
-	UserID    int    `json:"userId,omitempty"`
+	UserID int `json:"userId,omitempty"`
+	// Name 由调用方补齐, 已删除用户同样保留名称
+	Name      string `gorm:"-" json:"name,omitempty"`
 	TotalUnit int    `json:"totalUnit,omitempty"`
 	Cost      string `json:"cost,omitempty"`
 }
 
-func QueryUsage(from, to string) ([]CalcUsage, error) {
-	var results = []CalcUsage{}
-	err := usage.Model(&DailyUsage{}).Select(`user_id, 
-	--SUM(prompt_units) AS prompt_units,
-	-- SUM(completion_units) AS completion_units,
-	SUM(total_unit) AS total_unit,
-	printf('%.6f', SUM(cost)) AS cost`).
+// sumCost 汇总以文本保存的 cost 列, 在 sqlite, postgres 与 mysql 上都可用
+const sumCost = "SUM(CAST(NULLIF(cost, '') AS DECIMAL(20,10)))"
+
+// usageSum 为聚合查询的结果行, 费用在 Go 中统一格式化, 避免依赖各数据库的格式化函数
+type usageSum struct {
+	UserID    int
+	TotalUnit int
+	Cost      float64
+}
+
+func (r usageSum) calc() CalcUsage {
+	return CalcUsage{UserID: r.UserID, TotalUnit: r.TotalUnit, Cost: fmt.Sprintf("%.6f", r.Cost)}
+}
+
+func (s *Store) QueryUsage(ctx context.Context, from, to string) ([]CalcUsage, error) {
+	var rows []usageSum
+	err := s.usage.WithContext(ctx).Model(&DailyUsage{}).Select("user_id, SUM(total_unit) AS total_unit, "+sumCost+" AS cost").
 		Group("user_id").
 		Where("date >= ? AND date < ?", from, to).
-		Find(&results).Error
+		Find(&rows).Error
 	if err != nil {
 		return nil, err
 	}
+	var results = make([]CalcUsage, 0, len(rows))
+	for _, r := range rows {
+		results = append(results, r.calc())
+	}
 	return results, nil
 }
 
-func QueryUserUsage(userid, from, to string) (*CalcUsage, error) {
-	var results = new(CalcUsage)
-	err := usage.Model(&DailyUsage{}).Select(`user_id, 
-	--SUM(prompt_units) AS prompt_units,
-	-- SUM(completion_units) AS completion_units,
-	SUM(total_unit) AS total_unit,
-	printf('%.6f', SUM(cost)) AS cost`).
-		Where("user_id = ? AND date >= ? AND date < ?", userid, from, to).
-		Find(&results).Error
+func (s *Store) QueryUserUsage(ctx context.Context, userid, from, end string) (*CalcUsage, error) {
+	var row usageSum
+	err := s.usage.WithContext(ctx).Model(&DailyUsage{}).Select("SUM(total_unit) AS total_unit, "+sumCost+" AS cost").
+		Where("user_id = ? AND date >= ? AND date < ?", userid, from, end).
+		Find(&row).Error
 	if err != nil {
 		return nil, err
 	}
-	return results, nil
+	row.UserID = to.Int(userid)
+	results := row.calc()
+	return &results, nil
 }
 
 type Tokens struct {
@@ -93,7 +113,7 @@ type Tokens struct {
 	PromptHash      string
 }
 
-func Record(chatlog *Tokens) (err error) {
+func (s *Store) Record(ctx context.Context, chatlog *Tokens) (err error) {
 	u := &Usage{
 		UserID:          chatlog.UserID,
 		SKU:             chatlog.Model,
@@ -102,60 +122,76 @@ func Record(chatlog *Tokens) (err error) {
 		CompletionUnits: chatlog.CompletionCount,
 		TotalUnit:       chatlog.TotalTokens,
 		Cost:            to.String(chatlog.Cost),
-		Date:            time.Now(),
+		Date:            time.Now().UTC(),
 	}
-	err = usage.Create(u).Error
+	err = s.usage.WithContext(ctx).Create(u).Error
 	return
 
 }
 
-func SumDaily(userid int) error {
+// SumDaily 重算用户当天 (UTC) 的日汇总, 日期与 Record 写入的 UTC 时间和 PruneUsage 的分桶一致
+func (s *Store) SumDaily(ctx context.Context, userid int) error {
+	today := usageDay(time.Now())
 	var count int64
-	err := usage.Model(&DailyUsage{}).Where("user_id = ? and date = ?", userid, time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 0, 0, 0, 0, time.UTC)).Count(&count).Error
+	err := s.usage.WithContext(ctx).Model(&DailyUsage{}).Where("user_id = ? and date = ?", userid, today).Count(&count).Error
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		return err
 	}
 	if count == 0 {
-		if err := insertSumDaily(userid); err != nil {
-			return err
+		// 并发请求可能先一步写入当日汇总, 唯一索引冲突时改为更新
+		if err := s.insertSumDaily(ctx, userid, today); err != nil {
+			if errUpdate := s.updateSumDaily(ctx, userid, today); errUpdate != nil {
+				return err
+			}
 		}
 	} else {
-		if err := updateSumDaily(userid, time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 0, 0, 0, 0, time.UTC)); err != nil {
+		if err := s.updateSumDaily(ctx, userid, today); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func insertSumDaily(uid int) error {
-	nowstr := time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 0, 0, 0, 0, time.UTC)
-	err := usage.Exec(`INSERT INTO daily_usages
-		(user_id, date, sku, prompt_units, completion_units, total_unit, cost)
-		SELECT 
-		user_id,
-		?,
-		sku,
+// insertSumDaily 先汇总再写入, 避免 INSERT ... SELECT 中的参数类型在 postgres 上无法推断
+func (s *Store) insertSumDaily(ctx context.Context, uid int, nowstr time.Time) error {
+	var sums []Summary
+	err := s.usage.WithContext(ctx).Model(&Usage{}).Select(`user_id,
+		MAX(sku) AS sku,
 		SUM(prompt_units) AS sum_prompt_units,
 		SUM(completion_units) AS sum_completion_units,
 		SUM(total_unit) AS sum_total_unit,
-		SUM(cost) AS sum_cost
-		FROM usages 
-		WHERE date >= ?
-		AND user_id = ?`, nowstr, nowstr, uid).Error
+		`+sumCost+` AS sum_cost`).
+		Where("date >= ? AND user_id = ?", nowstr, uid).
+		Group("user_id").
+		Find(&sums).Error
 	if err != nil {
 		return err
 	}
+	for _, sum := range sums {
+		err := s.usage.WithContext(ctx).Create(&DailyUsage{
+			UserID:          sum.UserId,
+			Date:            nowstr,
+			SKU:             sum.SKU,
+			PromptUnits:     sum.SumPromptUnits,
+			CompletionUnits: sum.SumCompletionUnits,
+			TotalUnit:       sum.SumTotalUnit,
+			Cost:            strconv.FormatFloat(sum.SumCost, 'f', -1, 64),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func updateSumDaily(uid int, date time.Time) error {
+func (s *Store) updateSumDaily(ctx context.Context, uid int, date time.Time) error {
 	// var u = Summary{}
-	err := usage.Model(&Usage{}).Exec(`UPDATE daily_usages
+	err := s.usage.WithContext(ctx).Model(&Usage{}).Exec(`UPDATE daily_usages
 	SET 
 	prompt_units = (SELECT SUM(prompt_units) FROM usages WHERE user_id = daily_usages.user_id AND date >= daily_usages.date),
 	completion_units = (SELECT SUM(completion_units) FROM usages WHERE user_id = daily_usages.user_id AND date >= daily_usages.date),
 	total_unit = (SELECT SUM(total_unit) FROM usages WHERE user_id = daily_usages.user_id AND date >= daily_usages.date),
-	cost = (SELECT SUM(cost) FROM usages WHERE user_id = daily_usages.user_id AND date >= daily_usages.date)
+	cost = (SELECT `+sumCost+` FROM usages WHERE user_id = daily_usages.user_id AND date >= daily_usages.date)
 	WHERE user_id = ? AND date >= ?`, uid, date).Error
 	if err != nil {
 		return err
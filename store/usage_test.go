@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+func TestRecordAndSumDaily(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []Tokens
+		// want 为 SumDaily 之后当日汇总的 prompt, completion, total 与 cost
+		prompt, completion, total int
+		cost                      string
+	}{
+		{
+			name:    "single",
+			records: []Tokens{{PromptCount: 10, CompletionCount: 5, TotalTokens: 15, Cost: "0.000450", Model: "gpt-4"}},
+			prompt:  10, completion: 5, total: 15, cost: "0.00045",
+		},
+		{
+			name: "several",
+			records: []Tokens{
+				{PromptCount: 10, CompletionCount: 5, TotalTokens: 15, Cost: "0.25", Model: "gpt-4"},
+				{PromptCount: 1, CompletionCount: 2, TotalTokens: 3, Cost: "0.5", Model: "gpt-3.5-turbo"},
+				{PromptCount: 100, CompletionCount: 0, TotalTokens: 100, Cost: "1.125", Model: "gpt-4"},
+			},
+			prompt: 111, completion: 7, total: 118, cost: "1.875",
+		},
+		{
+			// 未配置价格时 cost 可能为空串, 按 0 计
+			name: "empty cost",
+			records: []Tokens{
+				{PromptCount: 4, CompletionCount: 4, TotalTokens: 8, Cost: "", Model: "other"},
+				{PromptCount: 2, CompletionCount: 2, TotalTokens: 4, Cost: "0.1", Model: "gpt-4"},
+			},
+			prompt: 6, completion: 6, total: 12, cost: "0.1",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			ctx := context.Background()
+			uid := i + 1
+			for _, r := range tt.records {
+				r.UserID = uid
+				if err := s.Record(ctx, &r); err != nil {
+					t.Fatal(err)
+				}
+				// 每次记录后都汇总一次, 与代理中的调用方式一致
+				if err := s.SumDaily(ctx, uid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var rows []DailyUsage
+			if err := s.usage.Where("user_id = ?", uid).Find(&rows).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("daily rows = %d, want 1", len(rows))
+			}
+			d := rows[0]
+			if d.PromptUnits != tt.prompt || d.CompletionUnits != tt.completion || d.TotalUnit != tt.total {
+				t.Errorf("daily units = %d/%d/%d, want %d/%d/%d", d.PromptUnits, d.CompletionUnits, d.TotalUnit, tt.prompt, tt.completion, tt.total)
+			}
+			if got := trimZeros(d.Cost); got != tt.cost {
+				t.Errorf("daily cost = %q, want %q", d.Cost, tt.cost)
+			}
+		})
+	}
+}
+
+func trimZeros(s string) string {
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+func TestQueryUsageSumsCost(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	rows := []DailyUsage{
+		{UserID: 1, Date: today, TotalUnit: 10, Cost: "0.1"},
+		{UserID: 1, Date: today.AddDate(0, 0, -1), TotalUnit: 20, Cost: "0.2"},
+		{UserID: 2, Date: today, TotalUnit: 5, Cost: ""},
+		{UserID: 2, Date: today.AddDate(0, 0, -40), TotalUnit: 1000, Cost: "9"},
+	}
+	if err := s.usage.Create(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	from := today.AddDate(0, 0, -7).Format("2006-01-02")
+	to := today.AddDate(0, 0, 1).Format("2006-01-02")
+
+	tests := []struct {
+		user        string
+		total       int
+		cost        string
+		from, until string
+	}{
+		{user: "1", total: 30, cost: "0.300000", from: from, until: to},
+		{user: "2", total: 5, cost: "0.000000", from: from, until: to},
+		// 没有用量时 SUM 为 NULL
+		{user: "3", total: 0, cost: "0.000000", from: from, until: to},
+		{user: "1", total: 10, cost: "0.100000", from: today.Format("2006-01-02"), until: to},
+	}
+	for _, tt := range tests {
+		got, err := s.QueryUserUsage(ctx, tt.user, tt.from, tt.until)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.TotalUnit != tt.total || got.Cost != tt.cost {
+			t.Errorf("user %s %s..%s: total %d cost %s, want %d %s", tt.user, tt.from, tt.until, got.TotalUnit, got.Cost, tt.total, tt.cost)
+		}
+	}
+
+	all, err := s.QueryUsage(ctx, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byUser := map[int]CalcUsage{}
+	for _, u := range all {
+		byUser[u.UserID] = u
+	}
+	if len(byUser) != 2 || byUser[1].Cost != "0.300000" || byUser[2].TotalUnit != 5 {
+		t.Errorf("QueryUsage = %+v", all)
+	}
+}
+
+func TestMigrateKeyEncryptionEncryptsPlaintext(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.db.Exec("INSERT INTO keys (name, ?, api_type, enabled, weight) VALUES ('k1', 'sk-plain', 'openai', true, 1)", clause.Column{Name: "key"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.migrateKeyEncryption(s.db); err != nil {
+		t.Fatal(err)
+	}
+	var k Key
+	if err := s.db.First(&k).Error; err != nil {
+		t.Fatal(err)
+	}
+	if k.Key == "sk-plain" || k.KeyHint == "" {
+		t.Errorf("plaintext key not encrypted: %q", k.Key)
+	}
+}
+
+// 本地时区与 UTC 不同时, 原始用量仍按 UTC 记录, 与日汇总及清理的分桶一致
+func TestUsageIsRecordedInUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC-12", -12*3600)
+	t.Cleanup(func() { time.Local = local })
+
+	s := newTestStore(t)
+	ctx := context.Background()
+	if err := s.Record(ctx, &Tokens{UserID: 1, PromptCount: 1, CompletionCount: 2, TotalTokens: 3, Cost: "0.5", Model: "gpt-4"}); err != nil {
+		t.Fatal(err)
+	}
+	var u Usage
+	if err := s.usage.First(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, off := u.Date.Zone(); off != 0 {
+		t.Errorf("usage recorded at %v, want UTC", u.Date)
+	}
+	if err := s.SumDaily(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	var d DailyUsage
+	if err := s.usage.First(&d).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !d.Date.Equal(usageDay(u.Date)) || d.TotalUnit != 3 {
+		t.Errorf("daily usage %v total %d, want %v total 3", d.Date, d.TotalUnit, usageDay(u.Date))
+	}
+
+	// 升级前以本地时间记录的行由迁移改写为 UTC
+	old := time.Date(2026, 1, 2, 20, 0, 0, 0, time.FixedZone("UTC+8", 8*3600))
+	if err := s.usage.Create(&Usage{UserID: 2, Date: old}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUsageDatesUTC(s.usage); err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	if err := s.usage.Model(&Usage{}).Where("user_id = 2 AND date >= ? AND date < ?", usageDay(old), usageDay(old).AddDate(0, 0, 1)).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("migrated usage not in UTC day %s", usageDay(old).Format("2006-01-02"))
+	}
+}
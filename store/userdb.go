@@ -1,104 +1,400 @@
 package store
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
 type User struct {
-	gorm.Model
-	IsDelete  bool      `gorm:"default:false" json:"IsDelete"`
-	ID        uint      `gorm:"primarykey autoIncrement;" json:"id,omitempty"`
-	Name      string    `gorm:"unique;not null" json:"name,omitempty"`
-	Token     string    `gorm:"unique;not null" json:"token,omitempty"`
-	CreatedAt time.Time `json:"createdAt,omitempty"`
-	UpdatedAt time.Time `json:"updatedAt,omitempty"`
-	// DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
-}
-
-func CreateUser(u *User) error {
-	result := db.Create(u)
-	if result.Error != nil {
-		return result.Error
+	ID uint `gorm:"primarykey" json:"id,omitempty"`
+	// Name 与 Token 只在未删除的行中唯一, 见 migrateUserSoftDelete
+	Name string `gorm:"size:255;not null" json:"name,omitempty"`
+	// Token 只保存加盐哈希, 明文仅在创建或重置时返回一次
+	Token       string `gorm:"size:255;not null" json:"-"`
+	TokenPrefix string `gorm:"size:64;index" json:"tokenPrefix,omitempty"`
+	Role        Role   `gorm:"size:32;not null;default:member" json:"role,omitempty"`
+	// OIDCSubject 为 SSO 用户在 IdP 中的 sub, 本地用户为空
+	OIDCSubject string `gorm:"column:oidc_subject;size:255;index" json:"oidcSubject,omitempty"`
+	// GroupID 为所属组, 为空表示未分组
+	GroupID *uint `gorm:"index" json:"groupId,omitempty"`
+	// Disabled 的用户无法认证, 但保留用量归属
+	Disabled  bool           `gorm:"not null;default:false" json:"disabled"`
+	CreatedAt time.Time      `json:"createdAt,omitempty"`
+	UpdatedAt time.Time      `json:"updatedAt,omitempty"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+func (u *User) groupID() uint {
+	if u.GroupID == nil {
+		return 0
+	}
+	return *u.GroupID
+}
+
+var ErrUserNameTaken = errors.New("user name already exists")
+
+// checkUserName 确认 name 未被其他未删除用户占用. sqlite 与 postgres 另有部分唯一索引兜底
+func checkUserName(tx *gorm.DB, name string, exceptID uint) error {
+	var n int64
+	if err := tx.Model(&User{}).Where("name = ? AND id <> ?", name, exceptID).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrUserNameTaken
+	}
+	return nil
+}
+
+// CreateUser 创建用户, u.Token 传入明文, 写库前替换为哈希
+func (s *Store) CreateUser(ctx context.Context, u *User) error {
+	u.TokenPrefix = TokenPrefix(u.Token)
+	u.Token = HashToken(u.Token)
+	if err := s.createUser(ctx, u); err != nil {
+		return err
 	}
-	LoadAuthCache()
+	s.LoadAuthCache()
 	return nil
 }
 
 // 添加用户
-func AddUser(name, token string) error {
-	user := &User{Name: name, Token: token}
-	result := db.Create(&user)
-	if result.Error != nil {
-		return result.Error
+func (s *Store) AddUser(ctx context.Context, name, token string, role Role) error {
+	user := &User{Name: name, Token: HashToken(token), TokenPrefix: TokenPrefix(token), Role: role}
+	if err := s.createUser(ctx, user); err != nil {
+		return err
+	}
+	s.LoadAuthCache()
+	return nil
+}
+
+func (s *Store) createUser(ctx context.Context, u *User) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := checkUserName(tx, u.Name, 0); err != nil {
+			return err
+		}
+		if err := tx.Create(u).Error; err != nil {
+			return err
+		}
+		// postgres 的自增序列不会因显式写入 id (如恢复的备份) 而前进
+		if dialect(tx) == DriverPostgres {
+			return tx.Exec("SELECT setval(pg_get_serial_sequence('users', 'id'), (SELECT MAX(id) FROM users))").Error
+		}
+		return nil
+	})
+}
+
+// ErrOwnerExists 表示已有 owner, 不能再通过初始化接口创建
+var ErrOwnerExists = errors.New("super user already exists, use cli to reset password")
+
+// CreateFirstOwner 在尚无 owner 时把 u 创建为 owner, 用于初始化 root; u.Token 传入明文
+func (s *Store) CreateFirstOwner(ctx context.Context, u *User) error {
+	u.Role = RoleOwner
+	u.TokenPrefix = TokenPrefix(u.Token)
+	u.Token = HashToken(u.Token)
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var owners int64
+		if err := tx.Model(&User{}).Where("role = ?", RoleOwner).Count(&owners).Error; err != nil {
+			return err
+		}
+		if owners > 0 {
+			return ErrOwnerExists
+		}
+		if err := checkUserName(tx, u.Name, 0); err != nil {
+			return err
+		}
+		return tx.Create(u).Error
+	})
+	if err != nil {
+		return err
 	}
-	LoadAuthCache()
+	s.LoadAuthCache()
 	return nil
 }
 
+// GetOwner 返回 id 最小的可用 owner, 通常即初始化时创建的 root; 没有可用 owner 时返回 gorm.ErrRecordNotFound
+func (s *Store) GetOwner(ctx context.Context) (*User, error) {
+	var user User
+	if err := s.db.WithContext(ctx).Where("role = ? AND disabled = ?", RoleOwner, false).Order("id").First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 // 删除用户
-func DeleteUser(id uint) error {
-	result := db.Delete(&User{}, id)
-	if result.Error != nil {
-		return result.Error
+func (s *Store) DeleteUser(ctx context.Context, id uint) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := guardLastOwner(tx, id); err != nil {
+			return err
+		}
+		return tx.Delete(&User{}, id).Error
+	})
+	if err != nil {
+		return err
+	}
+	s.LoadAuthCache()
+	return nil
+}
+
+// 修改用户角色
+func (s *Store) UpdateUserRole(ctx context.Context, id uint, role Role) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if role != RoleOwner {
+			if err := guardLastOwner(tx, id); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&User{}).Where("id = ?", id).Update("role", role).Error
+	})
+	if err != nil {
+		return err
 	}
-	LoadAuthCache()
+	s.LoadAuthCache()
 	return nil
 }
 
-// 修改用户
-func UpdateUser(id uint, token string) error {
-	user := &User{Token: token}
-	result := db.Model(&User{}).Where("id = ?", id).Updates(user)
+// UserPatch 描述对用户的部分修改, nil 字段保持不变
+type UserPatch struct {
+	Name     *string
+	Disabled *bool
+	// GroupID 指向 0 表示移出组
+	GroupID *uint
+}
+
+// UpdateUserFields 在一个事务内应用 p, 禁用时同样不允许移除最后一个 owner
+func (s *Store) UpdateUserFields(ctx context.Context, id uint, p UserPatch) error {
+	updates := map[string]interface{}{}
+	if p.Name != nil {
+		updates["name"] = *p.Name
+	}
+	if p.Disabled != nil {
+		updates["disabled"] = *p.Disabled
+	}
+	if p.GroupID != nil {
+		if *p.GroupID == 0 {
+			updates["group_id"] = nil
+		} else {
+			if _, err := s.GetGroup(ctx, *p.GroupID); err != nil {
+				return fmt.Errorf("group: %w", err)
+			}
+			updates["group_id"] = *p.GroupID
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if p.Name != nil {
+			if err := checkUserName(tx, *p.Name, id); err != nil {
+				return err
+			}
+		}
+		if p.Disabled != nil && *p.Disabled {
+			if err := guardLastOwner(tx, id); err != nil {
+				return err
+			}
+		}
+		result := tx.Model(&User{}).Where("id = ?", id).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if p.GroupID != nil {
+		// 组成员变化, 已缓存的组费用作废
+		s.spendCache.Flush()
+	}
+	s.LoadAuthCache()
+	return nil
+}
+
+// SetUserDisabled 禁用或启用用户, 禁用后其主 token 与命名 token 均无法认证
+func (s *Store) SetUserDisabled(ctx context.Context, id uint, disabled bool) error {
+	return s.UpdateUserFields(ctx, id, UserPatch{Disabled: &disabled})
+}
+
+// guardLastOwner 在 id 是唯一可用的 owner 时返回 ErrLastOwner
+func guardLastOwner(tx *gorm.DB, id uint) error {
+	var u User
+	if err := tx.Where("id = ?", id).First(&u).Error; err != nil {
+		return err
+	}
+	if u.Role != RoleOwner || u.Disabled {
+		return nil
+	}
+	var owners int64
+	if err := tx.Model(&User{}).Where("role = ? AND disabled = ?", RoleOwner, false).Count(&owners).Error; err != nil {
+		return err
+	}
+	if owners <= 1 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// migrateRoles 为升级前的数据补齐角色: 没有 owner 时最早创建的用户 (root) 为 owner, 其余为 member
+func migrateRoles(tx *gorm.DB) error {
+	if err := tx.Model(&User{}).Where("role = '' OR role IS NULL").Update("role", RoleMember).Error; err != nil {
+		return err
+	}
+	var owners int64
+	if err := tx.Model(&User{}).Where("role = ?", RoleOwner).Count(&owners).Error; err != nil {
+		return err
+	}
+	if owners == 0 {
+		var first User
+		if err := tx.Order("id").Limit(1).Find(&first).Error; err != nil || first.ID == 0 {
+			return err
+		}
+		return tx.Model(&User{}).Where("id = ?", first.ID).Update("role", RoleOwner).Error
+	}
+	return nil
+}
+
+// 修改用户 Token
+func (s *Store) UpdateUser(ctx context.Context, id uint, token string) error {
+	user := &User{Token: HashToken(token), TokenPrefix: TokenPrefix(token)}
+	result := s.db.WithContext(ctx).Model(&User{}).Where("id = ?", id).Updates(user)
 	if result.Error != nil {
 		return result.Error
 	}
-	LoadAuthCache()
+	s.LoadAuthCache()
 	return nil
 }
 
-func GetUserByID(id uint) (*User, error) {
+func (s *Store) GetUserByID(ctx context.Context, id uint) (*User, error) {
 	var user User
-	result := db.Where("id = ?", id).First(&user)
+	result := s.db.WithContext(ctx).Where("id = ?", id).First(&user)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return &user, nil
 }
 
-func GetUserByName(name string) (*User, error) {
+func (s *Store) GetUserByName(ctx context.Context, name string) (*User, error) {
 	var user User
-	result := db.Where(&User{Name: name}).First(&user)
+	result := s.db.WithContext(ctx).Where(&User{Name: name}).First(&user)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return &user, nil
 }
 
-func GetUserByToken(token string) (*User, error) {
-	var user User
-	result := db.Where("token = ?", token).First(&user)
+// GetUserByToken 先按前缀缩小范围, 再逐个校验哈希
+func (s *Store) GetUserByToken(ctx context.Context, token string) (*User, error) {
+	var users []User
+	result := s.db.WithContext(ctx).Where("token_prefix = ?", TokenPrefix(token)).Find(&users)
 	if result.Error != nil {
 		return nil, result.Error
 	}
-	return &user, nil
+	for i := range users {
+		if VerifyToken(token, users[i].Token) {
+			return &users[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
 }
 
-func GetUserID(authkey string) (int, error) {
-	var user User
-	result := db.Where(&User{Token: authkey}).First(&user)
-	if result.Error != nil {
-		return 0, result.Error
+func (s *Store) GetUserID(ctx context.Context, authkey string) (int, error) {
+	cred, err := s.Authenticate(ctx, authkey)
+	if err != nil {
+		return 0, err
 	}
-	return int(user.ID), nil
+	return int(cred.UserID), nil
 }
 
-func GetAllUsers() ([]*User, error) {
+// GetUserNames 返回 id 到用户名的映射, 包含已删除用户, 用于历史用量展示
+func (s *Store) GetUserNames(ctx context.Context, ids []uint) (map[uint]string, error) {
+	var users []User
+	if err := s.db.WithContext(ctx).Unscoped().Select("id", "name").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	names := make(map[uint]string, len(users))
+	for _, u := range users {
+		names[u.ID] = u.Name
+	}
+	return names, nil
+}
+
+func (s *Store) GetAllUsers(ctx context.Context) ([]*User, error) {
 	var users []*User
-	result := db.Find(&users)
+	result := s.db.WithContext(ctx).Find(&users)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return users, nil
 }
+
+// migrateUserSoftDelete 重建升级前的 users 表: 旧表的 name/token 为列级 UNIQUE 约束,
+// 软删除后的用户名无法复用; 新表改为仅约束未删除行的部分唯一索引, 并去掉 is_delete 列
+func migrateUserSoftDelete(tx *gorm.DB) error {
+	switch dialect(tx) {
+	case DriverSQLite:
+	case DriverPostgres:
+		return createActiveUserIndexes(tx)
+	default:
+		// mysql 不支持部分索引, 未删除用户名的唯一性由 checkUserName 保证
+		return nil
+	}
+	var ddl string
+	if err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'").Scan(&ddl).Error; err != nil {
+		return err
+	}
+	if strings.Contains(ddl, "UNIQUE") || tx.Migrator().HasColumn("users", "is_delete") {
+		if err := rebuildUsersTable(tx); err != nil {
+			return err
+		}
+	}
+	return createActiveUserIndexes(tx)
+}
+
+// rebuildUsersTable 按当前结构重建 sqlite 的 users 表并复制旧数据
+func rebuildUsersTable(tx *gorm.DB) error {
+	var indexes []string
+	if err := tx.Raw("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'users' AND sql IS NOT NULL").Scan(&indexes).Error; err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if err := tx.Exec("DROP INDEX " + tx.Statement.Quote(idx)).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Migrator().RenameTable("users", "users_legacy"); err != nil {
+		return err
+	}
+	if err := tx.Migrator().CreateTable(&User{}); err != nil {
+		return err
+	}
+	// is_delete 为 true 的旧数据视为已删除
+	deletedAt := "deleted_at"
+	if tx.Migrator().HasColumn("users_legacy", "is_delete") {
+		deletedAt = "CASE WHEN deleted_at IS NULL AND is_delete THEN updated_at ELSE deleted_at END"
+	}
+	cols := "id, name, token, token_prefix, role, oidc_subject, group_id, disabled, created_at, updated_at"
+	if err := tx.Exec("INSERT INTO users (" + cols + ", deleted_at) SELECT " + cols + ", " + deletedAt + " FROM users_legacy").Error; err != nil {
+		return err
+	}
+	return tx.Migrator().DropTable("users_legacy")
+}
+
+// createActiveUserIndexes 创建只约束未删除行的部分唯一索引 (sqlite 与 postgres)
+func createActiveUserIndexes(tx *gorm.DB) error {
+	for _, stmt := range []string{
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_name_active ON users(name) WHERE deleted_at IS NULL",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_token_active ON users(token) WHERE deleted_at IS NULL",
+	} {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}